@@ -1,3 +1,7 @@
 module node
 
 go 1.13
+
+require github.com/idste/goproxy/proxy v0.0.0
+
+replace github.com/idste/goproxy/proxy => ../../proxy
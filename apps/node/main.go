@@ -5,20 +5,130 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
+	"fmt"
+	"github.com/idste/goproxy/proxy"
+	"github.com/idste/goproxy/proxy/handshake"
+	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
+	"time"
 )
 
+type arg_list []string
+
+func (i *arg_list) String() string {
+	return ""
+}
+
+func (i *arg_list) Set(value string) error {
+	*i = append(*i, value)
+	return nil
+}
+
+//日志，由-log_format和-log_level设置
+var logger = proxy.DefaultLogger
+
+//创建输出到标准输出的日志
+//@format text或json
+//@level debug、info、warn或error
+func newLogger(format string, level string) (proxy.Logger, error) {
+	lv, err := proxy.ParseLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case "text":
+		return proxy.NewTextLogger(os.Stdout, lv), nil
+	case "json":
+		return proxy.NewJSONLogger(os.Stdout, lv), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q", format)
+}
+
 var UUID *string
 func main() {
 	host := flag.String("host", "127.0.0.1", "proxy host 代理服务器地址")
 	port := flag.Int("port", 925, "proxy port 代理端口")
 	password := flag.String("password", "1e4d4e53556a1bb5f6adf4753e7956cb", "password")
 	UUID = flag.String("uuid", "idste", "UUID")
+	cipherList := flag.String("ciphers", "aes-128-gcm,chacha20-poly1305,aes-256-gcm", "cipher suites 加密套件，按优先级排序")
+	tlsCert := flag.String("tls_cert", "", "TLS client certificate file 客户端证书，设置后使用TLS双向认证登录")
+	tlsKey := flag.String("tls_key", "", "TLS client key file 客户端私钥")
+	tlsCA := flag.String("tls_ca", "", "CA file for server certificate 服务端证书CA，默认使用系统证书")
+	tlsServerName := flag.String("tls_server_name", "", "server certificate name 服务端证书名称，默认为host")
+	links := flag.Int("links", 1, "main connections 主连接数，多条主连接绑定同一会话")
+	resume := flag.Int("resume_timeout", 60, "session resume timeout in seconds 会话恢复等待时间(秒)，0表示不恢复")
+	keepalive := flag.Int("keepalive_interval", 60, "keepalive interval in seconds 主连接keepalive发送间隔(秒)")
+	keepaliveTimeout := flag.Int("keepalive_timeout", 120, "keepalive timeout in seconds 主连接keepalive超时(秒)，应大于对端的发送间隔")
+	shutdownTimeout := flag.Int("shutdown_timeout", 30, "graceful shutdown timeout in seconds 收到SIGTERM后等待子连接结束的时间(秒)")
+	metricsAddr := flag.String("metrics_listen", "", "Prometheus metrics listen address 指标接口监听地址，为空时不启用")
+	logFormat := flag.String("log_format", "text", "log format, text or json 日志格式")
+	logLevel := flag.String("log_level", "info", "log level, debug/info/warn/error 日志级别")
+	//服务端请求的转发地址和监听地址的访问控制规则，见proxy.ParseRule
+	var dialAllow, dialDeny, listenAllow, listenDeny arg_list
+	flag.Var(&dialAllow, "dial_allow", "allowed forward address rule 允许服务端请求连接的地址规则，可多次传入该参数")
+	flag.Var(&dialDeny, "dial_deny", "denied forward address rule 禁止服务端请求连接的地址规则，可多次传入该参数")
+	flag.Var(&listenAllow, "listen_allow", "allowed listen address rule 允许服务端请求监听的地址规则，可多次传入该参数")
+	flag.Var(&listenDeny, "listen_deny", "denied listen address rule 禁止服务端请求监听的地址规则，可多次传入该参数")
 	flag.Parse()
+	l, err := newLogger(*logFormat, *logLevel)
+	if err != nil {
+		panic(err)
+	}
+	logger = l
 	if *port > 40000 || *port <= 0 {
 		panic("端口错误，1-40000")
 	}
-	NewNode(*host + ":" + strconv.Itoa(*port), *UUID, *password)
-	select {}
+	if *links < 1 || *links > 16 {
+		panic("主连接数错误，1-16")
+	}
+	dialPolicy, err := proxy.ParsePolicy(dialAllow, dialDeny)
+	if err != nil {
+		panic(err)
+	}
+	listenPolicy, err := proxy.ParsePolicy(listenAllow, listenDeny)
+	if err != nil {
+		panic(err)
+	}
+	ciphers, err := proxy.ParseCipherSuites(*cipherList)
+	if err != nil {
+		panic(err)
+	}
+	cfg := proxy.Config{
+		ResumeTimeout:     time.Duration(*resume) * time.Second,
+		KeepaliveInterval: time.Duration(*keepalive) * time.Second,
+		KeepaliveTimeout:  time.Duration(*keepaliveTimeout) * time.Second,
+		Logger:            logger,
+		DialPolicy:        dialPolicy,
+		ListenPolicy:      listenPolicy,
+		CipherSuites:      ciphers,
+	}
+	if err := cfg.Validate(); err != nil {
+		panic(err)
+	}
+	var tlsConfig *tls.Config
+	if *tlsCert != "" {
+		serverName := *tlsServerName
+		if serverName == "" {
+			serverName = *host
+		}
+		tlsConfig, err = handshake.ClientTLSConfig(*tlsCert, *tlsKey, *tlsCA, serverName)
+		if err != nil {
+			panic(err)
+		}
+	}
+	n := NewNode(*host + ":" + strconv.Itoa(*port), *UUID, *password, tlsConfig, *links, cfg)
+	if *metricsAddr != "" {
+		go n.serveMetrics(*metricsAddr)
+	}
+	//收到SIGTERM或SIGINT时平滑关闭会话后退出
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-ch
+	signal.Stop(ch)
+	logger.Info("收到退出信号，关闭会话", "signal", sig.String(), "timeout", time.Duration(*shutdownTimeout)*time.Second)
+	n.shutdown(time.Duration(*shutdownTimeout) * time.Second)
 }
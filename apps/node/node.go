@@ -5,103 +5,193 @@
 package main
 
 import (
-	"bytes"
-	"crypto/aes"
-	"crypto/md5"
-	"fmt"
+	"context"
+	"crypto/tls"
+	"errors"
 	"github.com/idste/goproxy/proxy"
+	"github.com/idste/goproxy/proxy/handshake"
+	"github.com/idste/goproxy/proxy/metrics"
 	"net"
+	"net/http"
 	"strings"
+	"sync"
 	"time"
 )
 
 type Node struct {
+	//节点运行中，会话结束后重新登录，由mutex保护
 	active bool
 	c      net.Conn
+	//当前会话，由mutex保护
+	mutex  sync.Mutex
 	proxy  *proxy.Proxy
 	bp     *proxy.BufferPool
 	addr   proxy.Address
 	uuid	 string
 	password string
+	//TLS双向认证配置，不为nil时使用客户端证书登录，不再使用uuid和密码
+	tlsConfig *tls.Config
+	//主连接数，大于1时在登录后建立附加主连接加入同一会话
+	links int
+	//会话参数，ResumeTimeout大于0时主连接全部断开后重新连接并恢复会话
+	cfg proxy.Config
 }
 
-func nodeProxyExit(p *proxy.Proxy) {
-	n := p.Ctx.(*Node)
+//运行会话，会话结束后重新登录
+func (n *Node) run(p *proxy.Proxy) {
+	err := p.Run(context.Background())
+	n.mutex.Lock()
 	n.proxy = nil
-	if n.active {
-		go n.newConnect()
+	active := n.active
+	n.mutex.Unlock()
+	if !active {
+		return
 	}
-}
-
-//自定义登录过程，完成连接认证和aes128密钥获取
-func (n *Node) login(c net.Conn) (p *proxy.Proxy, ok bool) {
-	data := make([]byte, 4096)
-	for {
-		//发送标识"  v1"
-		if _, err := c.Write([]byte("  v1")); err != nil {
-			break
-		}
-		//读取hello
-		if n, err := c.Read(data); err != nil || n != 5 || bytes.Equal(data, []byte("hello")){
-			break
-		}
-
-		//发送uuid
-		if _, err := c.Write([]byte(n.uuid)); err != nil {
-			break
-		}
-
-		//读取16字节随机数
-		if n, err := c.Read(data); err != nil || n != 16 {
-			break
-		}
-		copy(data[16:], n.password)
-		size := 16 + len(n.password)
-		md5sum := md5.Sum(data[:size])
-		blk, err := aes.NewCipher(md5sum[0:16])
-		if err != nil {
-			break
-		}
-		blk.Encrypt(data[0:16], data[0:16])
-		//发送aes encrypt data[0:16]
-		if _, err := c.Write(data[0:16]); err != nil {
-			break
-		}
-		p := proxy.NewProxy(0, c, n, blk, n.bp, nodeProxyExit)
-		n.proxy = p
-		return p, true
+	if errors.Is(err, proxy.ErrPeerGoAway) {
+		logger.Info("服务端关闭会话，重新登录", "addr", n.addr.Addr, "proxy", p.ID)
+	} else {
+		logger.Info("会话结束，重新登录", "addr", n.addr.Addr, "proxy", p.ID, "error", err)
 	}
-	return nil, false
+	go n.newConnect()
 }
 
 func (n *Node) newConnect() {
 	for {
 		s := strings.Split(n.addr.Addr, ":")
 		if len(s) != 2 {
-			fmt.Printf("地址错误(%s)，稍后重试\n", n.addr.Addr)
+			logger.Error("地址错误", "addr", n.addr.Addr)
 			break
 		}
 		ips, err := net.LookupHost(s[0])
 		if err != nil {
-			fmt.Printf("未知主机(%s)，稍后重试\n", n.addr.Addr)
+			logger.Warn("未知主机，稍后重试", "addr", n.addr.Addr, "error", err)
+			time.Sleep(1 * time.Second)
+			continue
 		}
 		c, err := net.Dial(n.addr.Domain, ips[0]+":"+s[1])
 		if err == nil {
 			n.c = c
-			//首先完成登录
-			if p, ok := n.login(c); ok == true {
-				fmt.Printf("连接成功\n")
-				go p.Handle()
+			//首先完成登录，完成连接认证和X25519密钥交换
+			p, err := n.login(c, nil)
+			if err == nil {
+				n.mutex.Lock()
+				n.proxy = p
+				n.mutex.Unlock()
+				logger.Info("连接成功", "addr", n.addr.Addr, "proxy", p.ID)
+				go n.run(p)
+				if n.links > 1 || n.cfg.ResumeTimeout > 0 {
+					go n.keepLinks(p, c.RemoteAddr().String())
+				}
 				break
 			}
+			logger.Warn("登录失败", "addr", n.addr.Addr, "error", err)
+			_ = c.Close()
+		} else {
+			logger.Warn("连接失败，稍后重试", "addr", n.addr.Addr, "error", err)
 		}
-		fmt.Printf("连接失败(%s)，稍后重试\n")
 		time.Sleep(1 * time.Second)
 	}
 }
 
-func NewNode(addr string, uuid string, password string) {
-	n := &Node{active: true, uuid:uuid, password: password, addr: proxy.Address{Domain: "tcp", Addr: addr}}
+//在已建立的连接上登录
+//@join 不为nil时连接作为附加主连接加入该会话
+func (n *Node) login(c net.Conn, join *proxy.Proxy) (*proxy.Proxy, error) {
+	cfg := &handshake.Config{Ctx: n, BufferPool: n.bp, Join: join}
+	cfg.Options = []proxy.Option{proxy.WithConfig(n.cfg)}
+	if n.tlsConfig != nil {
+		return handshake.ClientHandshakeTLS(c, n.tlsConfig, cfg)
+	}
+	creds := &handshake.Credentials{UUID: n.uuid, Password: n.password}
+	return handshake.ClientHandshake(c, creds, cfg)
+}
+
+//保持会话的主连接数，主连接断开后重新建立，会话结束后退出
+//启用会话恢复时主连接全部断开后仍重新连接，服务端会话已不存在时结束本端会话，由run重新登录
+//@addr 第一条主连接的服务端地址
+func (n *Node) keepLinks(p *proxy.Proxy, addr string) {
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.Done():
+			return
+		case <-ticker.C:
+		}
+		cnt := p.Links()
+		if cnt == 0 && n.cfg.ResumeTimeout == 0 {
+			return
+		}
+		if cnt >= n.links {
+			continue
+		}
+		kind := "附加主连接"
+		if cnt == 0 {
+			kind = "恢复会话"
+		}
+		c, err := net.Dial(n.addr.Domain, addr)
+		if err != nil {
+			logger.Warn(kind+"失败，稍后重试", "addr", addr, "proxy", p.ID, "error", err)
+			continue
+		}
+		if _, err := n.login(c, p); err != nil {
+			logger.Warn(kind+"登录失败", "addr", addr, "proxy", p.ID, "error", err)
+			_ = c.Close()
+			if errors.Is(err, handshake.ErrSessionNotFound) {
+				p.Close()
+				return
+			}
+			continue
+		}
+		if cnt == 0 {
+			logger.Info("重新连接成功，会话已恢复", "addr", addr, "proxy", p.ID)
+		} else {
+			logger.Info("附加主连接成功", "addr", addr, "proxy", p.ID)
+		}
+	}
+}
+
+//创建节点
+//@tlsConfig TLS双向认证配置，为nil时使用uuid和密码登录
+//@links 主连接数，多条主连接绑定同一会话，任一主连接断开不影响子连接
+//@cfg 会话参数，ResumeTimeout为0时主连接全部断开即结束会话并重新登录
+func NewNode(addr string, uuid string, password string, tlsConfig *tls.Config, links int, cfg proxy.Config) *Node {
+	n := &Node{active: true, uuid:uuid, password: password, tlsConfig: tlsConfig, links: links, cfg: cfg, addr: proxy.Address{Domain: "tcp", Addr: addr}}
 	n.bp = proxy.NewBufferPool(10240)
 	go n.newConnect()
+	return n
+}
+
+//平滑关闭当前会话，不再重新登录
+//@timeout 等待子连接结束的时间，超时后强制关闭
+func (n *Node) shutdown(timeout time.Duration) {
+	n.mutex.Lock()
+	n.active = false
+	p := n.proxy
+	n.mutex.Unlock()
+	if p == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := p.Shutdown(ctx); err != nil {
+		logger.Warn("会话未能在等待时间内结束，强制关闭", "proxy", p.ID, "error", err)
+	}
+}
+
+//启动指标接口，输出Prometheus文本格式的会话统计
+//@addr 监听地址
+func (n *Node) serveMetrics(addr string) {
+	sessions := func() []metrics.Session {
+		n.mutex.Lock()
+		defer n.mutex.Unlock()
+		if n.proxy == nil {
+			return nil
+		}
+		return []metrics.Session{{Proxy: n.proxy, Labels: map[string]string{"uuid": n.uuid}}}
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler(sessions, n.bp))
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logger.Error("指标接口监听失败", "addr", addr, "error", err)
+	}
 }
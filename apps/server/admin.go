@@ -0,0 +1,202 @@
+// Copyright 2019 The goproxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+/*
+管理接口，HTTP/JSON格式，请求需携带"Authorization: Bearer <admin_token>"头
+GET    /api/nodes                              在线节点列表
+GET    /api/nodes/{id}                         节点信息，包括监听、子连接数和收发字节数
+DELETE /api/nodes/{id}                         断开节点
+POST   /api/nodes/{id}/listeners               增加本端监听，请求体与-listener参数格式相同
+DELETE /api/nodes/{id}/listeners/{lid}         关闭本端监听
+POST   /api/nodes/{id}/peer_listeners          增加对端监听，等待对端监听结果
+DELETE /api/nodes/{id}/peer_listeners/{lid}    关闭对端监听
+POST   /api/reload                             重新读取配置文件
+运行期间增加的监听不写入配置文件，节点重新登录后按配置文件重新下发
+*/
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/idste/goproxy/proxy"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	//请求体大小限制
+	ADMIN_MAX_BODY = 64 * 1024
+	//等待对端监听结果的时间
+	ADMIN_LISTEN_TIMEOUT = 10 * time.Second
+)
+
+//节点信息
+type nodeInfo struct {
+	ID            uint32               `json:"id"`
+	UUID          string               `json:"uuid"`
+	Links         int                  `json:"links"`
+	Streams       int                  `json:"streams"`
+	BytesIn       uint64               `json:"bytes_in"`
+	BytesOut      uint64               `json:"bytes_out"`
+	Listeners     []proxy.ListenerInfo `json:"listeners,omitempty"`
+	PeerListeners []proxy.ListenerInfo `json:"peer_listeners,omitempty"`
+}
+
+type adminHandler struct {
+	s     *Server
+	token []byte
+}
+
+//启动管理接口
+//@addr 监听地址，建议只监听本地地址
+//@token 认证令牌
+func (s *Server) serveAdmin(addr string, token string) {
+	srv := &http.Server{Addr: addr, Handler: &adminHandler{s: s, token: []byte(token)}}
+	if err := srv.ListenAndServe(); err != nil {
+		logger.Error("管理接口监听失败", "addr", addr, "error", err)
+	}
+}
+
+func (h *adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") || subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), h.token) != 1 {
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(path) < 2 || path[0] != "api" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	switch {
+	case len(path) == 2 && path[1] == "reload" && r.Method == http.MethodPost:
+		if err := h.s.reload(); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"result": "ok"})
+	case len(path) == 2 && path[1] == "nodes" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, h.s.nodes())
+	case len(path) >= 3 && path[1] == "nodes":
+		id, err := strconv.ParseUint(path[2], 10, 32)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid node id")
+			return
+		}
+		p, uuid := h.s.node(uint32(id))
+		if p == nil {
+			writeError(w, http.StatusNotFound, "node not found")
+			return
+		}
+		h.serveNode(w, r, p, uuid, path[3:])
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+//处理/api/nodes/{id}下的请求
+//@path {id}之后的路径
+func (h *adminHandler) serveNode(w http.ResponseWriter, r *http.Request, p *proxy.Proxy, uuid string, path []string) {
+	switch {
+	case len(path) == 0 && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, newNodeInfo(p, uuid, true))
+	case len(path) == 0 && r.Method == http.MethodDelete:
+		logger.Info("会话由管理接口断开", "uuid", uuid, "proxy", p.ID)
+		p.Close()
+		writeJSON(w, http.StatusOK, map[string]string{"result": "ok"})
+	case len(path) == 1 && r.Method == http.MethodPost:
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, ADMIN_MAX_BODY))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		switch path[0] {
+		case "listeners":
+			id, err := p.NewListener(body)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]int{"id": id})
+		case "peer_listeners":
+			ctx, cancel := context.WithTimeout(r.Context(), ADMIN_LISTEN_TIMEOUT)
+			defer cancel()
+			info, err := p.NewPeerListenerContext(ctx, body)
+			if err != nil {
+				writeError(w, http.StatusBadGateway, err.Error())
+				return
+			}
+			writeJSON(w, http.StatusOK, info)
+		default:
+			writeError(w, http.StatusNotFound, "not found")
+		}
+	case len(path) == 2 && r.Method == http.MethodDelete:
+		id, err := strconv.Atoi(path[1])
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid listener id")
+			return
+		}
+		switch path[0] {
+		case "listeners":
+			err = p.CloseListener(id)
+		case "peer_listeners":
+			err = p.ClosePeerListener(id)
+		default:
+			writeError(w, http.StatusNotFound, "not found")
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"result": "ok"})
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+//在线节点列表，按ID排序
+func (s *Server) nodes() []nodeInfo {
+	s.mutex.RLock()
+	list := make([]nodeInfo, 0, len(s.proxys))
+	for id, p := range s.proxys {
+		list = append(list, newNodeInfo(p, s.uuids[id], false))
+	}
+	s.mutex.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+//查询节点
+func (s *Server) node(id uint32) (*proxy.Proxy, string) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.proxys[id], s.uuids[id]
+}
+
+//@listeners 是否包含监听列表
+func newNodeInfo(p *proxy.Proxy, uuid string, listeners bool) nodeInfo {
+	stats := p.Stats()
+	info := nodeInfo{ID: p.ID, UUID: uuid, Links: stats.Links, Streams: stats.Streams, BytesIn: stats.BytesIn, BytesOut: stats.BytesOut}
+	if listeners {
+		info.Listeners = p.Listeners()
+		info.PeerListeners = p.PeerListeners()
+	}
+	return info
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, map[string]string{"error": msg})
+}
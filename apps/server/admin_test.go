@@ -0,0 +1,126 @@
+// Copyright 2019 The goproxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/idste/goproxy/proxy"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+//向管理接口发送请求，返回应答
+func testAdminRequest(h http.Handler, method, path, auth string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, nil)
+	if auth != "" {
+		r.Header.Set("Authorization", auth)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestAdminAuth(t *testing.T) {
+	h := &adminHandler{s: &Server{}, token: []byte("secret")}
+	tests := []struct {
+		name string
+		auth string
+	}{
+		{"missing", ""},
+		{"wrong token", "Bearer wrong"},
+		{"token prefix", "Bearer secre"},
+		{"token suffix", "Bearer secretx"},
+		{"empty token", "Bearer "},
+		{"bad scheme", "Basic secret"},
+		{"scheme only", "Bearer"},
+	}
+	for _, tt := range tests {
+		w := testAdminRequest(h, http.MethodGet, "/api/nodes", tt.auth)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%s: status %d, want 401", tt.name, w.Code)
+		}
+	}
+	//认证失败时不执行操作
+	if w := testAdminRequest(h, http.MethodPost, "/api/reload", "Bearer wrong"); w.Code != http.StatusUnauthorized {
+		t.Errorf("reload: status %d, want 401", w.Code)
+	}
+}
+
+func TestAdminNodes(t *testing.T) {
+	logger = proxy.NewTextLogger(ioutil.Discard, proxy.LEVEL_ERROR)
+	//会话两端的ID分别为1和2，作为两个节点
+	p1, p2 := testSession(t, nil, nil)
+	defer p1.Close()
+	defer p2.Close()
+	c1, c2 := testSession(t, nil, nil)
+	defer c1.Close()
+	defer c2.Close()
+	s := &Server{
+		proxys: map[uint32]*proxy.Proxy{2: p2, 1: p1},
+		uuids:  map[uint32]string{2: "bob", 1: "alice"},
+	}
+	h := &adminHandler{s: s, token: []byte("secret")}
+	auth := "Bearer secret"
+
+	w := testAdminRequest(h, http.MethodGet, "/api/nodes", auth)
+	if w.Code != http.StatusOK {
+		t.Fatalf("list: status %d", w.Code)
+	}
+	var list []nodeInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].ID != 1 || list[0].UUID != "alice" || list[1].ID != 2 || list[1].UUID != "bob" {
+		t.Fatalf("list %+v", list)
+	}
+	if list[0].Listeners != nil || list[0].PeerListeners != nil {
+		t.Errorf("list includes listeners: %+v", list[0])
+	}
+
+	w = testAdminRequest(h, http.MethodGet, "/api/nodes/1", auth)
+	var info nodeInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &info); w.Code != http.StatusOK || err != nil {
+		t.Fatalf("node: status %d, %v", w.Code, err)
+	}
+	if info.ID != 1 || info.UUID != "alice" {
+		t.Errorf("node %+v", info)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		method string
+		path   string
+		code   int
+	}{
+		{"unknown node", http.MethodGet, "/api/nodes/3", http.StatusNotFound},
+		{"invalid id", http.MethodGet, "/api/nodes/abc", http.StatusBadRequest},
+		{"kick unknown node", http.MethodDelete, "/api/nodes/3", http.StatusNotFound},
+		{"unknown path", http.MethodGet, "/api/other", http.StatusNotFound},
+		{"wrong method", http.MethodPut, "/api/nodes", http.StatusNotFound},
+	} {
+		if w := testAdminRequest(h, tt.method, tt.path, auth); w.Code != tt.code {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.code)
+		}
+	}
+
+	//断开节点，其他节点不受影响
+	if w := testAdminRequest(h, http.MethodDelete, "/api/nodes/2", auth); w.Code != http.StatusOK {
+		t.Fatalf("kick: status %d", w.Code)
+	}
+	select {
+	case <-p2.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("node not closed")
+	}
+	select {
+	case <-c1.Done():
+	case <-c2.Done():
+		t.Fatal("other node closed")
+	default:
+	}
+}
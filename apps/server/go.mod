@@ -1,3 +1,10 @@
 module server
 
 go 1.13
+
+require (
+	github.com/bitly/go-simplejson v0.5.1
+	github.com/idste/goproxy/proxy v0.0.0
+)
+
+replace github.com/idste/goproxy/proxy => ../../proxy
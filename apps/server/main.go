@@ -5,11 +5,17 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"github.com/bitly/go-simplejson"
+	"github.com/idste/goproxy/proxy"
+	"github.com/idste/goproxy/proxy/handshake"
 	"io/ioutil"
+	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 const (
@@ -24,17 +30,20 @@ type listen struct {
 
 type client struct {
 	password string
+	//TLS方式登录时与客户端证书CommonName或DNS名称匹配的名称，为空时使用uuid
+	tlsName string
 	list map[int]*listen
 }
 
 type arg_list[] string
 var  listenType = [2]string{LISTEN:"listen", PEER_LISTEN: "peerListen"}
 
-var clients map[string]*client
+//虚拟主机和SNI路由监听地址，为空时不启用
+var vhostListen string
+var sniListen string
 
-func init() {
-	clients = make(map[string]*client)
-}
+//对端请求的转发地址和监听地址的访问控制规则，配置文件中的规则追加在命令行参数之后，见proxy.ParseRule
+var dialAllow, dialDeny, listenAllow, listenDeny arg_list
 
 func (i *arg_list) String() string {
 	return ""
@@ -45,23 +54,59 @@ func (i *arg_list) Set(value string) error {
 	return nil
 }
 
-func loadConfig(path string) {
+//读取配置文件
+func readConfig(path string) (*simplejson.Json, error) {
 	body, err := ioutil.ReadFile(path)
 	if err != nil {
-		fmt.Printf("read config file(%s) error:%s\n", path, err.Error())
-		return
+		return nil, fmt.Errorf("read config file(%s) error:%s", path, err.Error())
 	}
 
 	js, err := simplejson.NewJson(body);
 	if err != nil {
-		fmt.Printf("create new json object failed:%s\n", err.Error())
+		return nil, fmt.Errorf("create new json object failed:%s", err.Error())
+	}
+	return js, nil
+}
+
+//读取配置文件中的客户端和虚拟主机、SNI路由配置
+//@clients 读入的客户端
+func loadConfig(path string, clients map[string]*client) error {
+	js, err := readConfig(path)
+	if err != nil {
+		return err
+	}
+	if err := loadClients(js, clients); err != nil {
+		return fmt.Errorf("%s in config file(%s)", err.Error(), path)
+	}
+	if listen, ok := loadRoutes(js, "vhosts", vhosts); ok {
+		vhostListen = listen
+	}
+	if listen, ok := loadRoutes(js, "sni", sniHosts); ok {
+		sniListen = listen
+	}
+	loadACL(js)
+	return nil
+}
+
+//读取访问控制规则
+func loadACL(js *simplejson.Json) {
+	jacl, ok := js.CheckGet("acl")
+	if !ok {
 		return
 	}
+	lists := map[string]*arg_list{"dial_allow": &dialAllow, "dial_deny": &dialDeny, "listen_allow": &listenAllow, "listen_deny": &listenDeny}
+	for key, list := range lists {
+		rules, _ := jacl.Get(key).StringArray()
+		*list = append(*list, rules...)
+	}
+}
 
+//读取客户端配置
+//@clients 读入的客户端
+func loadClients(js *simplejson.Json, clients map[string]*client) error {
 	jclients, ok := js.CheckGet("clients")
 	if !ok {
-		fmt.Printf("can not get `clients` from config file(%s)\n", path)
-		return;
+		return fmt.Errorf("can not get `clients`")
 	}
 
 	i := 0
@@ -73,11 +118,10 @@ func loadConfig(path string) {
 		if err != nil {
 			break
 		}
-		password, err := jclient.Get("password").String()
-		if err != nil {
-			break
-		}
-		cli := &client{password:password}
+		//仅使用TLS方式登录的客户端可不配置password
+		password, _ := jclient.Get("password").String()
+		tlsName, _ := jclient.Get("tls_name").String()
+		cli := &client{password:password, tlsName: tlsName}
 		cli.list = make(map[int]*listen)
 		for kind, v := range listenType {
 			if jl, ok := jclient.CheckGet(v); ok {
@@ -95,8 +139,12 @@ func loadConfig(path string) {
 							break
 						}
 					}
+					//SOCKS5等监听类型由客户端指定目的地址，可不配置Forward
+					lsnKind, _ := addr.Get("Kind").String()
 					if t, ok := addr.CheckGet("Forward"); !ok {
-						break
+						if lsnKind == "" {
+							break
+						}
 					} else {
 						if _, ok := t.CheckGet("Domain"); !ok {
 							break
@@ -116,11 +164,64 @@ func loadConfig(path string) {
 				}
 			}
 		}
-		if len(cli.list) > 0 {
-			clients[uuid] = cli
+		clients[uuid] = cli
+	}
+	return nil
+}
+
+//读取虚拟主机或SNI路由配置
+//@key 配置项名称
+//@routes 主机名对应的路由
+//return listen配置的监听地址，ok配置项是否存在
+func loadRoutes(js *simplejson.Json, key string, routes map[string]*vhost) (listen string, ok bool) {
+	jroutes, ok := js.CheckGet(key)
+	if !ok {
+		return "", false
+	}
+	listen, _ = jroutes.Get("listen").String()
+	jhosts, _ := jroutes.Get("hosts").Array()
+	for i := range jhosts {
+		jhost := jroutes.Get("hosts").GetIndex(i)
+		host, err := jhost.Get("host").String()
+		if err != nil {
+			continue
+		}
+		uuid, err := jhost.Get("uuid").String()
+		if err != nil {
+			continue
 		}
+		domain, _ := jhost.Get("forward").Get("Domain").String()
+		addr, err := jhost.Get("forward").Get("Addr").String()
+		if err != nil {
+			continue
+		}
+		if domain == "" {
+			domain = "tcp"
+		}
+		routes[strings.ToLower(host)] = &vhost{uuid: uuid, forward: proxy.Address{Domain: domain, Addr: addr}}
+	}
+	return listen, true
+}
+//日志，由-log_format和-log_level设置
+var logger = proxy.DefaultLogger
+
+//创建输出到标准输出的日志
+//@format text或json
+//@level debug、info、warn或error
+func newLogger(format string, level string) (proxy.Logger, error) {
+	lv, err := proxy.ParseLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case "text":
+		return proxy.NewTextLogger(os.Stdout, lv), nil
+	case "json":
+		return proxy.NewJSONLogger(os.Stdout, lv), nil
 	}
+	return nil, fmt.Errorf("unknown log format %q", format)
 }
+
 func main() {
 	var listeners arg_list
 	var peerListeners arg_list
@@ -129,37 +230,144 @@ func main() {
 	uuid := flag.String("uuid", "idste", "UUID")
 	password := flag.String("password", "1e4d4e53556a1bb5f6adf4753e7956cb", "password")
 	configPath := flag.String("config_path", "/etc/goproxy.conf", "config file")
+	cipherList := flag.String("ciphers", "aes-128-gcm,chacha20-poly1305,aes-256-gcm", "cipher suites 加密套件，按优先级排序")
+	tlsPort := flag.Int("tls_port", 0, "TLS listen port TLS双向认证监听端口，0表示不启用")
+	tlsCert := flag.String("tls_cert", "", "TLS server certificate file 服务端证书")
+	tlsKey := flag.String("tls_key", "", "TLS server key file 服务端私钥")
+	tlsClientCA := flag.String("tls_client_ca", "", "CA file for client certificates 客户端证书CA")
+	vhostAddr := flag.String("vhost_listen", "", "vhost listen address 虚拟主机监听地址，覆盖配置文件")
+	sniAddr := flag.String("sni_listen", "", "TLS SNI routing listen address SNI路由监听地址，覆盖配置文件")
+	resume := flag.Int("resume_timeout", 60, "session resume timeout in seconds 会话恢复等待时间(秒)，0表示不恢复")
+	keepalive := flag.Int("keepalive_interval", 60, "keepalive interval in seconds 主连接keepalive发送间隔(秒)")
+	keepaliveTimeout := flag.Int("keepalive_timeout", 120, "keepalive timeout in seconds 主连接keepalive超时(秒)，应大于对端的发送间隔")
+	shutdownTimeout := flag.Int("shutdown_timeout", 30, "graceful shutdown timeout in seconds 收到SIGTERM后等待子连接结束的时间(秒)")
+	adminAddr := flag.String("admin_listen", "", "admin HTTP API listen address 管理接口监听地址，为空时不启用")
+	adminToken := flag.String("admin_token", "", "admin HTTP API bearer token 管理接口认证令牌")
+	metricsAddr := flag.String("metrics_listen", "", "Prometheus metrics listen address 指标接口监听地址，为空时不启用")
+	logFormat := flag.String("log_format", "text", "log format, text or json 日志格式")
+	logLevel := flag.String("log_level", "info", "log level, debug/info/warn/error 日志级别")
 	flag.Var(&listeners, "listener", "listen&forward address list代理端监听转发地址，可多次传入该参数")
 	flag.Var(&peerListeners, "peer_listener", "peer listen&forward address list内网代理转发地址，可多次传入该参数")
+	flag.Var(&dialAllow, "dial_allow", "allowed forward address rule 允许客户端请求连接的地址规则，可多次传入该参数")
+	flag.Var(&dialDeny, "dial_deny", "denied forward address rule 禁止客户端请求连接的地址规则，可多次传入该参数")
+	flag.Var(&listenAllow, "listen_allow", "allowed listen address rule 允许客户端请求监听的地址规则，可多次传入该参数")
+	flag.Var(&listenDeny, "listen_deny", "denied listen address rule 禁止客户端请求监听的地址规则，可多次传入该参数")
 	flag.Parse()
-	if *port > 40000 || *port <= 0 {
+	l, err := newLogger(*logFormat, *logLevel)
+	if err != nil {
+		panic(err)
+	}
+	logger = l
+	//启用TLS时port可为0，表示不启用uuid和密码认证方式
+	if *port > 40000 || *port < 0 || (*port == 0 && *tlsPort == 0) {
 		panic("端口错误，1-40000")
 	}
-	loadConfig(*configPath)
-	if _, ok := clients[*uuid]; !ok {
-		cli := &client{password:*password}
-		cli.list = make(map[int]*listen)
-		i := 0
-		for _, v := range listeners {
-			lsn := &listen{kind:LISTEN, addr:string(v)}
-			cli.list[i] = lsn
-			i++
+	if *tlsPort > 40000 || *tlsPort < 0 {
+		panic("TLS端口错误，1-40000")
+	}
+	ciphers, err := proxy.ParseCipherSuites(*cipherList)
+	if err != nil {
+		panic(err)
+	}
+	var tlsConfig *tls.Config
+	tlsAddr := ""
+	if *tlsPort > 0 {
+		tlsConfig, err = handshake.ServerTLSConfig(*tlsCert, *tlsKey, *tlsClientCA)
+		if err != nil {
+			panic(err)
+		}
+		tlsAddr = *host + ":" + strconv.Itoa(*tlsPort)
+	}
+	addr := ""
+	if *port > 0 {
+		addr = *host + ":" + strconv.Itoa(*port)
+	}
+	clients := make(map[string]*client)
+	if err := loadConfig(*configPath, clients); err != nil {
+		logger.Error("读取配置文件失败", "path", *configPath, "error", err)
+	}
+	if *vhostAddr != "" {
+		vhostListen = *vhostAddr
+	}
+	if *sniAddr != "" {
+		sniListen = *sniAddr
+	}
+	//命令行配置的默认客户端，配置文件中没有该uuid时使用
+	cli := &client{password:*password}
+	cli.list = make(map[int]*listen)
+	i := 0
+	for _, v := range listeners {
+		lsn := &listen{kind:LISTEN, addr:string(v)}
+		cli.list[i] = lsn
+		i++
+	}
+	for _, v := range peerListeners {
+		lsn := &listen{kind:PEER_LISTEN, addr:string(v)}
+		cli.list[i] = lsn
+		i++
+	}
+	if _, ok := clients[*uuid]; !ok && len(cli.list) > 0 {
+		clients[*uuid] = cli
+	}
+	//重新读取配置文件中的客户端，见Server.reload
+	reload := func() (map[string]*client, error) {
+		js, err := readConfig(*configPath)
+		if err != nil {
+			return nil, err
 		}
-		for _, v := range peerListeners {
-			lsn := &listen{kind:PEER_LISTEN, addr:string(v)}
-			cli.list[i] = lsn
-			i++
+		table := make(map[string]*client)
+		if err := loadClients(js, table); err != nil {
+			return nil, err
 		}
-		if len(cli.list) > 0 {
-			clients[*uuid] = cli
+		if _, ok := table[*uuid]; !ok && len(cli.list) > 0 {
+			table[*uuid] = cli
 		}
+		return table, nil
 	}
 	for k, v := range clients {
-		fmt.Printf("uuid:%s:\n", k)
 		for i, v1 := range v.list {
-			fmt.Printf("  id:%d password:%s, kind:%s addr:%s\n", i, v.password, listenType[v1.kind], v1.addr)
+			logger.Info("客户端监听", "uuid", k, "id", i, "kind", listenType[v1.kind], "addr", v1.addr)
 		}
 	}
-	NewServer(*host + ":" +strconv.Itoa(*port))
-	select {}
+	for k, v := range vhosts {
+		logger.Info("虚拟主机", "vhost", k, "uuid", v.uuid, "forward", v.forward)
+	}
+	for k, v := range sniHosts {
+		logger.Info("SNI路由", "sni", k, "uuid", v.uuid, "forward", v.forward)
+	}
+	dialPolicy, err := proxy.ParsePolicy(dialAllow, dialDeny)
+	if err != nil {
+		panic(err)
+	}
+	listenPolicy, err := proxy.ParsePolicy(listenAllow, listenDeny)
+	if err != nil {
+		panic(err)
+	}
+	if dialPolicy != nil || listenPolicy != nil {
+		logger.Info("访问控制", "dial_allow", strings.Join(dialAllow, ","), "dial_deny", strings.Join(dialDeny, ","),
+			"listen_allow", strings.Join(listenAllow, ","), "listen_deny", strings.Join(listenDeny, ","))
+	}
+	proxyConfig := proxy.Config{
+		ResumeTimeout:     time.Duration(*resume) * time.Second,
+		KeepaliveInterval: time.Duration(*keepalive) * time.Second,
+		KeepaliveTimeout:  time.Duration(*keepaliveTimeout) * time.Second,
+		Logger:            logger,
+		DialPolicy:        dialPolicy,
+		ListenPolicy:      listenPolicy,
+		CipherSuites:      ciphers,
+	}
+	if err := proxyConfig.Validate(); err != nil {
+		panic(err)
+	}
+	if *adminAddr != "" && *adminToken == "" {
+		panic("管理接口需要设置admin_token")
+	}
+	s := NewServer(addr, tlsAddr, tlsConfig, vhostListen, sniListen, proxyConfig, clients, reload)
+	if *adminAddr != "" {
+		go s.serveAdmin(*adminAddr, *adminToken)
+	}
+	if *metricsAddr != "" {
+		go s.serveMetrics(*metricsAddr)
+	}
+	s.handleSignals(time.Duration(*shutdownTimeout) * time.Second)
 }
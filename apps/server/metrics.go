@@ -0,0 +1,32 @@
+// Copyright 2019 The goproxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"github.com/idste/goproxy/proxy/metrics"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+//启动指标接口，输出Prometheus文本格式的会话统计，每个会话带uuid和id标签
+//@addr 监听地址，指标接口不认证，建议只监听本地或内网地址
+func (s *Server) serveMetrics(addr string) {
+	sessions := func() []metrics.Session {
+		s.mutex.RLock()
+		defer s.mutex.RUnlock()
+		list := make([]metrics.Session, 0, len(s.proxys))
+		for id, p := range s.proxys {
+			list = append(list, metrics.Session{Proxy: p, Labels: map[string]string{"uuid": s.uuids[id], "id": strconv.FormatUint(uint64(id), 10)}})
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].Proxy.ID < list[j].Proxy.ID })
+		return list
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler(sessions, s.bp))
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logger.Error("指标接口监听失败", "addr", addr, "error", err)
+	}
+}
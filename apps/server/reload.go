@@ -0,0 +1,130 @@
+// Copyright 2019 The goproxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"github.com/idste/goproxy/proxy"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+//收到SIGHUP时重新读取配置文件，收到SIGTERM或SIGINT时平滑关闭所有会话后返回
+//@timeout 平滑关闭的等待时间
+func (s *Server) handleSignals(timeout time.Duration) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT)
+	for sig := range ch {
+		if sig != syscall.SIGHUP {
+			logger.Info("收到退出信号，关闭所有会话", "signal", sig.String(), "timeout", timeout)
+			signal.Stop(ch)
+			s.shutdown(timeout)
+			return
+		}
+		if err := s.reload(); err != nil {
+			logger.Error("重新读取配置文件失败", "error", err)
+		}
+	}
+}
+
+//重新读取配置文件中的客户端配置，由SIGHUP或管理接口触发
+//删除或修改了认证信息的客户端断开连接，其余在线客户端按新配置增删监听，未修改的监听不受影响
+//虚拟主机和SNI路由不重新读取
+func (s *Server) reload() error {
+	clients, err := s.reloadClients()
+	if err != nil {
+		return err
+	}
+	type session struct {
+		p    *proxy.Proxy
+		uuid string
+		cli  *client
+	}
+	var kick, update []session
+	s.listenMutex.Lock()
+	defer s.listenMutex.Unlock()
+	s.mutex.Lock()
+	old := s.clients
+	s.clients = clients
+	for id, p := range s.proxys {
+		uuid := s.uuids[id]
+		cli, ok := clients[uuid]
+		prev := old[uuid]
+		if !ok || (prev != nil && (cli.password != prev.password || cli.tlsName != prev.tlsName)) {
+			kick = append(kick, session{p: p, uuid: uuid})
+			continue
+		}
+		update = append(update, session{p: p, uuid: uuid, cli: cli})
+	}
+	//清理已结束会话的监听记录
+	for p := range s.mappings {
+		if s.proxys[p.ID] != p {
+			delete(s.mappings, p)
+		}
+	}
+	s.mutex.Unlock()
+	for _, v := range kick {
+		logger.Info("认证信息已删除或修改，断开会话", "uuid", v.uuid, "proxy", v.p.ID)
+		delete(s.mappings, v.p)
+		v.p.Close()
+	}
+	for _, v := range update {
+		s.applyListeners(v.p, v.uuid, v.cli)
+	}
+	logger.Info("重新读取配置文件", "clients", len(clients), "kicked", len(kick))
+	return nil
+}
+
+//按客户端配置增删会话的监听，只处理由配置创建的监听，调用时需持有listenMutex
+func (s *Server) applyListeners(p *proxy.Proxy, uuid string, cli *client) {
+	//会话已结束，监听记录已由run清理
+	select {
+	case <-p.Done():
+		return
+	default:
+	}
+	current, ok := s.mappings[p]
+	if !ok {
+		current = make(map[listen]int)
+		s.mappings[p] = current
+	}
+	want := make(map[listen]bool)
+	for _, v := range cli.list {
+		want[*v] = true
+	}
+	for k, id := range current {
+		if want[k] {
+			continue
+		}
+		var err error
+		if k.kind == LISTEN {
+			err = p.CloseListener(id)
+		} else {
+			err = p.ClosePeerListener(id)
+		}
+		if err != nil {
+			logger.Warn("关闭监听失败", "uuid", uuid, "proxy", p.ID, "listen", k.addr, "error", err)
+		}
+		delete(current, k)
+	}
+	for k := range want {
+		if _, ok := current[k]; ok {
+			continue
+		}
+		var id int
+		var err error
+		if k.kind == LISTEN {
+			id, err = p.NewListener([]byte(k.addr))
+		} else {
+			id, err = p.NewPeerListener([]byte(k.addr))
+		}
+		if err != nil {
+			logger.Warn("监听地址错误", "uuid", uuid, "proxy", p.ID, "listen", k.addr, "error", err)
+			continue
+		}
+		current[k] = id
+	}
+}
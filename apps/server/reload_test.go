@@ -0,0 +1,144 @@
+// Copyright 2019 The goproxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"github.com/idste/goproxy/proxy"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+//监听配置项，转发至本地端口
+func testListen(kind int, forward string) *listen {
+	return &listen{kind: kind, addr: `{"Listen":{"Domain":"tcp","Addr":"127.0.0.1:0"},"Forward":{"Domain":"tcp","Addr":"` + forward + `"}}`}
+}
+
+//等待条件成立
+func testWait(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+//活动的监听数
+func testActive(list []proxy.ListenerInfo) int {
+	n := 0
+	for _, info := range list {
+		if info.Active {
+			n++
+		}
+	}
+	return n
+}
+
+//按新配置增删监听，未修改的监听保持不变
+func TestApplyListeners(t *testing.T) {
+	logger = proxy.NewTextLogger(ioutil.Discard, proxy.LEVEL_ERROR)
+	p1, p2 := testSession(t, nil, nil)
+	defer p1.Close()
+	defer p2.Close()
+	s := &Server{mappings: make(map[*proxy.Proxy]map[listen]int)}
+	keep, removed, added := testListen(LISTEN, "127.0.0.1:1"), testListen(LISTEN, "127.0.0.1:2"), testListen(LISTEN, "127.0.0.1:3")
+	peer := testListen(PEER_LISTEN, "127.0.0.1:4")
+
+	s.applyListeners(p1, "alice", &client{list: map[int]*listen{0: keep, 1: removed, 2: peer}})
+	testWait(t, "listeners", func() bool { return testActive(p1.Listeners()) == 2 && testActive(p1.PeerListeners()) == 1 })
+	ids := make(map[listen]int)
+	for k, id := range s.mappings[p1] {
+		ids[k] = id
+	}
+	var removedAddr string
+	for _, info := range p1.Listeners() {
+		if info.ID == ids[*removed] {
+			removedAddr = info.Addr
+		}
+	}
+	if removedAddr == "" {
+		t.Fatalf("listener %d not found in %+v", ids[*removed], p1.Listeners())
+	}
+
+	s.applyListeners(p1, "alice", &client{list: map[int]*listen{0: keep, 1: added}})
+	testWait(t, "listeners", func() bool { return testActive(p1.Listeners()) == 2 && len(p1.PeerListeners()) == 0 })
+	current := s.mappings[p1]
+	if len(current) != 2 || current[*keep] != ids[*keep] {
+		t.Fatalf("mappings %v, want %s kept as %d", current, keep.addr, ids[*keep])
+	}
+	if _, ok := current[*added]; !ok {
+		t.Fatalf("mappings %v, %s not added", current, added.addr)
+	}
+	if len(p2.Listeners()) != 0 {
+		t.Errorf("peer listener not closed: %+v", p2.Listeners())
+	}
+	//关闭的监听已释放端口
+	l, err := net.Listen("tcp", removedAddr)
+	if err != nil {
+		t.Fatalf("removed listener still holds %s: %v", removedAddr, err)
+	}
+	l.Close()
+
+	//会话结束后不再处理
+	p1.Close()
+	<-p1.Done()
+	s.applyListeners(p1, "alice", &client{})
+	if len(s.mappings[p1]) != 2 {
+		t.Errorf("mappings of a closed session changed: %v", s.mappings[p1])
+	}
+}
+
+//删除或修改了认证信息的客户端断开连接，其余客户端按新配置增删监听
+func TestReload(t *testing.T) {
+	logger = proxy.NewTextLogger(ioutil.Discard, proxy.LEVEL_ERROR)
+	a1, a2 := testSession(t, nil, nil)
+	defer a1.Close()
+	defer a2.Close()
+	b1, b2 := testSession(t, nil, nil)
+	defer b1.Close()
+	defer b2.Close()
+	c1, c2 := testSession(t, nil, nil)
+	defer c1.Close()
+	defer c2.Close()
+	lsn := testListen(LISTEN, "127.0.0.1:1")
+	var clients map[string]*client
+	s := &Server{
+		//三个会话的server一侧ID都为1，以不同ID登记
+		proxys:        map[uint32]*proxy.Proxy{1: a1, 2: b1, 3: c1},
+		uuids:         map[uint32]string{1: "alice", 2: "bob", 3: "carol"},
+		clients:       map[string]*client{"alice": {password: "a"}, "bob": {password: "b"}, "carol": {password: "c"}},
+		reloadClients: func() (map[string]*client, error) { return clients, nil },
+		mappings:      make(map[*proxy.Proxy]map[listen]int),
+	}
+	clients = map[string]*client{
+		"alice": {password: "a", list: map[int]*listen{0: lsn}},
+		"bob":   {password: "changed"},
+	}
+	if err := s.reload(); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []*proxy.Proxy{b1, c1} {
+		select {
+		case <-p.Done():
+		case <-time.After(5 * time.Second):
+			t.Fatal("session not closed")
+		}
+	}
+	select {
+	case <-a1.Done():
+		t.Fatal("unchanged client closed")
+	default:
+	}
+	testWait(t, "listener", func() bool { return testActive(a1.Listeners()) == 1 })
+	if s.clients["bob"].password != "changed" || s.clients["carol"] != nil {
+		t.Errorf("clients not replaced")
+	}
+	if len(s.mappings) != 1 || len(s.mappings[a1]) != 1 {
+		t.Errorf("mappings %v", s.mappings)
+	}
+}
@@ -5,156 +5,266 @@
 package main
 
 import (
-	"bytes"
-	"crypto/aes"
-	"crypto/md5"
-	"crypto/rand"
-	"fmt"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"github.com/idste/goproxy/proxy"
-	"io"
+	"github.com/idste/goproxy/proxy/handshake"
 	"net"
 	"sync"
 	"time"
 )
 
 type Server struct {
+	//服务运行中，由mutex保护，shutdown后不再接受新会话
 	active     bool
 	id         uint32
 	listenAddr proxy.Address
+	//TLS双向认证监听地址和配置，tlsConfig为nil时不启用
+	tlsAddr    proxy.Address
+	tlsConfig  *tls.Config
 	mutex      sync.RWMutex
-	l          net.Listener
 	proxys     map[uint32]*proxy.Proxy
+	//uuid对应的在线代理对象，用于虚拟主机路由
+	users      map[string]*proxy.Proxy
 	bp         *proxy.BufferPool
+	//会话参数，包括会话恢复等待时间、keepalive和日志
+	proxyConfig proxy.Config
+	//客户端配置，由mutex保护，reloadClients重新读取配置文件
+	clients       map[string]*client
+	reloadClients func() (map[string]*client, error)
+	//代理对象ID对应的uuid
+	uuids map[uint32]string
+	//按客户端配置创建的监听(配置项->监听ID)，由listenMutex保护，见applyListeners
+	listenMutex sync.Mutex
+	mappings    map[*proxy.Proxy]map[listen]int
 }
 
-func serverProxyExit(p *proxy.Proxy) {
-	s := p.Ctx.(*Server)
+//运行会话，会话结束后移除
+func (s *Server) run(p *proxy.Proxy, uuid string) {
+	err := p.Run(context.Background())
+	logger.Info("会话结束", "uuid", uuid, "proxy", p.ID, "error", err)
 	s.mutex.Lock()
-	delete(s.proxys, p.ID)
+	if s.proxys[p.ID] == p {
+		delete(s.proxys, p.ID)
+		delete(s.uuids, p.ID)
+	}
+	for uuid, v := range s.users {
+		if v == p {
+			delete(s.users, uuid)
+		}
+	}
 	s.mutex.Unlock()
+	s.listenMutex.Lock()
+	delete(s.mappings, p)
+	s.listenMutex.Unlock()
 }
 
-//自定义登录过程，完成连接认证和aes128密钥下发
-func (s *Server) login(c net.Conn) (p *proxy.Proxy, cli *client, ok bool) {
-	data := make([]byte, 4096)
-	for {
-		//read flag "  v1"
-		_ = c.SetReadDeadline(time.Now().Add(time.Second * 5))
-		if n, err := c.Read(data); err != nil || n < 4 {
-			break
-		}
-		if !bytes.Equal(data[0:4], []byte("  v1")) {
-			break
-		}
-		if n, err := c.Write([]byte("hello")); err != nil || n < 4 {
-			break
-		}
-		//read uuid
-		_ = c.SetReadDeadline(time.Now().Add(time.Second * 5))
-		n, err := c.Read(data)
-		if err != nil || n <= 0 {
-			break
-		}
-
-		cli, ok := clients[string(data[0:n])]
-		if !ok {
-			break
-		}
-		//generate 16bytes random string
-		var tmpstr [16]byte
-		if _, err := io.ReadFull(rand.Reader, tmpstr[0:]); err != nil {
-			break
-		}
+//查询uuid对应的在线代理对象
+func (s *Server) user(uuid string) *proxy.Proxy {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.users[uuid]
+}
 
-		if n, err := c.Write(tmpstr[0:]); err != nil || n < 16 {
-			break
-		}
+//查询uuid对应的密码，供登录握手使用，未配置密码的客户端只能使用TLS方式登录
+func (s *Server) password(uuid string) (string, bool) {
+	s.mutex.RLock()
+	cli, ok := s.clients[uuid]
+	s.mutex.RUnlock()
+	if !ok || cli.password == "" {
+		return "", false
+	}
+	return cli.password, true
+}
 
-		copy(data[0:16], tmpstr[0:16])
-		copy(data[16:], cli.password)
-		size := 16 + len(cli.password)
-		md5sum := md5.Sum(data[:size])
-		blk, err := aes.NewCipher(md5sum[0:16])
-		if err != nil {
-			break
+//由客户端证书的CommonName或DNS名称查找客户端，客户端未配置tls_name时与uuid比较
+func (s *Server) identify(cert *x509.Certificate) (string, bool) {
+	names := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for uuid, cli := range s.clients {
+		name := cli.tlsName
+		if name == "" {
+			name = uuid
 		}
-		//read aes encrypted data, then decrypt it and compare with tmpstr
-		_ = c.SetReadDeadline(time.Now().Add(time.Second * 5))
-		if n, err := c.Read(data); err != nil || n != 16 {
-			break
-		}
-		blk.Decrypt(data[0:16], data[0:16])
-		if !bytes.Equal(data[0:16], tmpstr[0:16]) {
-			break
-		}
-		s.mutex.Lock()
-		for {
-			if _, ok := s.proxys[s.id]; ok == true {
-				s.id++
-			} else {
-				break
+		for _, v := range names {
+			if v == name {
+				return uuid, true
 			}
 		}
-		p := proxy.NewProxy(s.id, c, s, blk, s.bp, serverProxyExit)
-		s.proxys[s.id] = p
-		s.mutex.Unlock()
-		return p, cli, true
 	}
-	return nil, nil, false
+	return "", false
 }
 
+//登录握手配置
+func (s *Server) config() *handshake.Config {
+	cfg := &handshake.Config{Ctx: s, BufferPool: s.bp, Session: s.user}
+	cfg.Options = []proxy.Option{proxy.WithConfig(s.proxyConfig)}
+	return cfg
+}
+
+//处理uuid和密码认证的主连接
 func (s *Server) handle(c net.Conn) {
-	var p *proxy.Proxy = nil
-	p, cli, ok := s.login(c)
-	if ok == false {
+	//完成连接认证和X25519密钥交换
+	cfg := s.config()
+	p, uuid, err := handshake.ServerHandshake(c, handshake.AuthenticatorFunc(s.password), cfg)
+	if err != nil {
+		_ = c.Close()
+		logger.Warn("登录失败", "uuid", uuid, "peer", c.RemoteAddr(), "error", err)
+		return
+	}
+	s.serve(p, uuid, c)
+}
+
+//处理TLS双向认证的主连接
+func (s *Server) handleTLS(c net.Conn) {
+	cfg := s.config()
+	p, uuid, err := handshake.ServerHandshakeTLS(c, s.tlsConfig, handshake.CertAuthenticatorFunc(s.identify), cfg)
+	if err != nil {
 		_ = c.Close()
-		fmt.Printf("登录失败\n")
+		logger.Warn("TLS登录失败", "uuid", uuid, "peer", c.RemoteAddr(), "error", err)
 		return
 	}
-	if len(cli.list) == 0 {
-		fmt.Printf("增加listen参数可设置本端监听地址， 示例: -listener '{\"Listen\":{\"Domain\":\"tcp\",\"Addr\":\"127.0.0.1:1511\"},\"Forward\":{\"Domain\":\"tcp\", \"Addr\":\"127.0.0.1:80\"}}'\n")
-		fmt.Printf("增加peer_listen参数可添加对端监听地址， 示例: -peer_listener '{\"Listen\":{\"Domain\":\"tcp\",\"Addr\":\"127.0.0.1:1511\"},\"Forward\":{\"Domain\":\"tcp\", \"Addr\":\"127.0.0.1:80\"}}'\n")
+	s.serve(p, uuid, c)
+}
+
+//登录成功后运行代理对象并下发监听地址
+//客户端加入已有会话时连接已作为附加主连接运行
+func (s *Server) serve(p *proxy.Proxy, uuid string, c net.Conn) {
+	s.mutex.RLock()
+	joined := s.proxys[p.ID] == p
+	s.mutex.RUnlock()
+	if joined {
+		logger.Info("新主连接加入会话", "uuid", uuid, "proxy", p.ID, "peer", c.RemoteAddr())
+		return
+	}
+	s.mutex.RLock()
+	cli, ok := s.clients[uuid]
+	s.mutex.RUnlock()
+	if !ok || len(cli.list) == 0 && !vhostUser(uuid) {
+		logger.Warn("客户端未配置监听地址，增加listener参数可设置本端监听地址，增加peer_listener参数可添加对端监听地址", "uuid", uuid,
+			"example", `-listener '{"Listen":{"Domain":"tcp","Addr":"127.0.0.1:1511"},"Forward":{"Domain":"tcp", "Addr":"127.0.0.1:80"}}'`)
+		_ = c.Close()
+		return
+	}
+	s.mutex.Lock()
+	//正在关闭服务，不再接受新会话
+	if !s.active {
+		s.mutex.Unlock()
 		_ = c.Close()
 		return
 	}
-	go p.Handle()
-	for _, v := range cli.list {
-		if v.kind == LISTEN {
-			p.NewListener([]byte(v.addr))
+	for {
+		if _, ok := s.proxys[s.id]; ok == true {
+			s.id++
 		} else {
-			p.NewPeerListener([]byte(v.addr))
+			break
 		}
 	}
+	p.ID = s.id
+	s.proxys[s.id] = p
+	s.uuids[s.id] = uuid
+	//同一uuid重复登录时使用最新的连接，等待恢复的旧会话不再恢复，关闭以释放其监听地址
+	old := s.users[uuid]
+	s.users[uuid] = p
+	s.mutex.Unlock()
+	if old != nil && old.Links() == 0 {
+		old.Close()
+	}
+	go s.run(p, uuid)
+	s.listenMutex.Lock()
+	s.applyListeners(p, uuid, cli)
+	s.listenMutex.Unlock()
 }
 
-func (s *Server) newListen() {
+//监听主连接
+//@addr 监听地址
+//@handle 主连接处理函数
+func (s *Server) newListen(addr proxy.Address, handle func(c net.Conn)) {
 	for {
+		var l net.Listener
 		for {
-			l, err := net.Listen("tcp", s.listenAddr.Addr)
+			var err error
+			l, err = net.Listen(addr.Domain, addr.Addr)
 			if err == nil {
-				s.l = l
 				break
 			}
-			fmt.Printf("监听失败(%s)，稍后重试\n", s.listenAddr.Addr)
+			logger.Error("监听失败，稍后重试", "listen", addr, "error", err)
 			time.Sleep(5 * time.Second)
 		}
 		for {
-			c, err := s.l.Accept()
+			c, err := l.Accept()
 			if err != nil {
-				fmt.Println("accept tcp connection failed:", err)
+				logger.Warn("accept failed", "listen", addr, "error", err)
 				break
 			}
-			go s.handle(c)
+			go handle(c)
 		}
-		if !s.active {
+		s.mutex.RLock()
+		active := s.active
+		s.mutex.RUnlock()
+		if !active {
 			break
 		}
 	}
 }
 
-func NewServer(addr string) {
-	s := &Server{active: true, listenAddr: proxy.Address{Domain: "tcp", Addr: addr}}
+//创建服务
+//@addr uuid和密码认证方式的监听地址，为空时不启用
+//@tlsAddr TLS双向认证方式的监听地址，tlsConfig为nil时不启用
+//@vhostAddr HTTP虚拟主机监听地址，为空时不启用
+//@sniAddr TLS SNI路由监听地址，为空时不启用
+//@proxyConfig 会话参数，ResumeTimeout为0时主连接全部断开即结束会话
+//@clients 客户端配置
+//@reload 重新读取客户端配置，见Server.reload
+func NewServer(addr string, tlsAddr string, tlsConfig *tls.Config, vhostAddr string, sniAddr string, proxyConfig proxy.Config, clients map[string]*client, reload func() (map[string]*client, error)) *Server {
+	s := &Server{active: true, proxyConfig: proxyConfig, listenAddr: proxy.Address{Domain: "tcp", Addr: addr}}
+	s.clients = clients
+	s.reloadClients = reload
+	s.uuids = make(map[uint32]string)
+	s.mappings = make(map[*proxy.Proxy]map[listen]int)
+	s.tlsAddr = proxy.Address{Domain: "tcp", Addr: tlsAddr}
+	s.tlsConfig = tlsConfig
 	s.proxys = make(map[uint32]*proxy.Proxy)
+	s.users = make(map[string]*proxy.Proxy)
 	s.bp = proxy.NewBufferPool(10240)
-	go s.newListen()
+	if addr != "" {
+		go s.newListen(s.listenAddr, s.handle)
+	}
+	if tlsConfig != nil {
+		go s.newListen(s.tlsAddr, s.handleTLS)
+	}
+	if vhostAddr != "" {
+		go s.newListen(proxy.Address{Domain: "tcp", Addr: vhostAddr}, s.handleVhost)
+	}
+	if sniAddr != "" {
+		go s.newListen(proxy.Address{Domain: "tcp", Addr: sniAddr}, s.handleSNI)
+	}
+	return s
+}
+
+//平滑关闭所有会话，不再接受新会话，通知客户端后等待已有子连接结束
+//@timeout 等待时间，超时后强制关闭
+func (s *Server) shutdown(timeout time.Duration) {
+	s.mutex.Lock()
+	s.active = false
+	proxys := make([]*proxy.Proxy, 0, len(s.proxys))
+	for _, p := range s.proxys {
+		proxys = append(proxys, p)
+	}
+	s.mutex.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, p := range proxys {
+		wg.Add(1)
+		go func(p *proxy.Proxy) {
+			defer wg.Done()
+			if err := p.Shutdown(ctx); err != nil {
+				logger.Warn("会话未能在等待时间内结束，强制关闭", "proxy", p.ID, "error", err)
+			}
+		}(p)
+	}
+	wg.Wait()
 }
@@ -0,0 +1,81 @@
+// Copyright 2019 The goproxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+/*
+TLS SNI路由，多个客户端共用server上的一个TLS端口(如443)，server不终止TLS，
+仅解析ClientHello中的服务器名称，按配置查找客户端和转发地址后转发原始数据流，证书保留在客户端一侧
+*/
+
+var errSNIFound = errors.New("sni found")
+
+//只读连接，用于解析ClientHello，写操作丢弃
+type readOnlyConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *readOnlyConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *readOnlyConn) Write(b []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+//读取ClientHello中的服务器名称，返回名称和已读取的原始数据
+func peekSNI(c net.Conn) (string, []byte, error) {
+	var head bytes.Buffer
+	sni := ""
+	cfg := &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			sni = hello.ServerName
+			return nil, errSNIFound
+		},
+	}
+	err := tls.Server(&readOnlyConn{Conn: c, r: io.TeeReader(c, &head)}, cfg).Handshake()
+	if sni == "" {
+		if err == nil || err == errSNIFound {
+			err = errors.New("no server name")
+		}
+		return "", nil, err
+	}
+	return sni, head.Bytes(), nil
+}
+
+//处理SNI路由监听接受的连接，未知名称或客户端不在线时直接关闭连接
+func (s *Server) handleSNI(c net.Conn) {
+	_ = c.SetReadDeadline(time.Now().Add(VHOST_TIMEOUT))
+	sni, head, err := peekSNI(c)
+	if err != nil {
+		logger.Warn("read sni failed", "peer", c.RemoteAddr(), "error", err)
+		_ = c.Close()
+		return
+	}
+	_ = c.SetReadDeadline(time.Time{})
+	sni = strings.ToLower(sni)
+	v, ok := sniHosts[sni]
+	if !ok {
+		logger.Warn("unknown sni", "sni", sni, "peer", c.RemoteAddr())
+		_ = c.Close()
+		return
+	}
+	conn, err := s.dialRoute(sni, v)
+	if err != nil {
+		_ = c.Close()
+		return
+	}
+	relay(&prefixConn{Conn: c, r: io.MultiReader(bytes.NewReader(head), c)}, conn)
+}
@@ -0,0 +1,166 @@
+// Copyright 2019 The goproxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/idste/goproxy/proxy"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+//客户端发送的第一条TLS记录(ClientHello)
+//@serverName 为空时不带SNI
+func testClientHello(t *testing.T, serverName string) []byte {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go func() {
+		_ = tls.Client(c1, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+		c1.Close()
+	}()
+	head := make([]byte, 5)
+	if _, err := io.ReadFull(c2, head); err != nil {
+		t.Fatal(err)
+	}
+	body := make([]byte, int(head[3])<<8|int(head[4]))
+	if _, err := io.ReadFull(c2, body); err != nil {
+		t.Fatal(err)
+	}
+	return append(head, body...)
+}
+
+//自签名证书
+func testCertificate(t *testing.T, name string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{name},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestPeekSNI(t *testing.T) {
+	hello := testClientHello(t, "App.Example.com")
+	tests := []struct {
+		name string
+		in   []byte
+		sni  string
+	}{
+		{"sni", hello, "App.Example.com"},
+		{"no sni", testClientHello(t, ""), ""},
+		{"truncated", hello[:len(hello)/2], ""},
+		{"truncated header", hello[:3], ""},
+		{"not tls", []byte("GET / HTTP/1.1\r\nHost: app.example.com\r\n\r\n"), ""},
+	}
+	for _, tt := range tests {
+		c1, c2 := testConnPair(t)
+		if _, err := c1.Write(tt.in); err != nil {
+			t.Fatal(err)
+		}
+		_ = c1.(*net.TCPConn).CloseWrite()
+		_ = c2.SetReadDeadline(time.Now().Add(5 * time.Second))
+		sni, head, err := peekSNI(c2)
+		c1.Close()
+		c2.Close()
+		if sni != tt.sni {
+			t.Errorf("%s: sni %q, want %q", tt.name, sni, tt.sni)
+		}
+		if tt.sni == "" && err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+		//返回的数据为读取的ClientHello原文
+		if tt.sni != "" && (err != nil || !bytes.Equal(head, tt.in)) {
+			t.Errorf("%s: head %d bytes, want %d, %v", tt.name, len(head), len(tt.in), err)
+		}
+	}
+}
+
+//经SNI路由与后端完成TLS握手，说明已读取的ClientHello被原样转发
+func TestSNIRoute(t *testing.T) {
+	logger = proxy.NewTextLogger(ioutil.Discard, proxy.LEVEL_ERROR)
+	backend, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{testCertificate(t, "app.example.com")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		for {
+			c, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	p1, p2 := testSession(t, nil, nil)
+	defer p1.Close()
+	defer p2.Close()
+	sniHosts["app.example.com"] = &vhost{uuid: "alice", forward: proxy.Address{Domain: "tcp", Addr: backend.Addr().String()}}
+	defer delete(sniHosts, "app.example.com")
+	s := &Server{users: map[string]*proxy.Proxy{"alice": p1}}
+
+	for _, tt := range []struct {
+		name       string
+		serverName string
+		ok         bool
+	}{
+		{"route", "APP.example.com", true},
+		{"unknown sni", "other.example.com", false},
+	} {
+		c1, c2 := testConnPair(t)
+		done := make(chan struct{})
+		go func() {
+			s.handleSNI(c2)
+			close(done)
+		}()
+		tc := tls.Client(c1, &tls.Config{ServerName: tt.serverName, InsecureSkipVerify: true})
+		_ = tc.SetDeadline(time.Now().Add(5 * time.Second))
+		err := tc.Handshake()
+		if tt.ok {
+			if err != nil {
+				t.Fatalf("%s: handshake: %v", tt.name, err)
+			}
+			if state := tc.ConnectionState(); state.PeerCertificates[0].Subject.CommonName != "app.example.com" {
+				t.Errorf("%s: certificate %s", tt.name, state.PeerCertificates[0].Subject)
+			}
+			buf := make([]byte, 4)
+			if _, err := tc.Write([]byte("ping")); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.ReadFull(tc, buf); err != nil || string(buf) != "ping" {
+				t.Errorf("%s: echo %q, %v", tt.name, buf, err)
+			}
+		} else if err == nil {
+			t.Errorf("%s: handshake succeeded", tt.name)
+		}
+		tc.Close()
+		<-done
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2019 The goproxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/idste/goproxy/proxy"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+HTTP虚拟主机，多个内网web服务共用server上的一个监听端口，
+按每个连接首个请求的Host头部查找配置的uuid和转发地址，经该客户端的代理对象连接转发地址，
+请求头原样转发，未知主机或客户端不在线时应答502页面
+*/
+
+const (
+	VHOST_TIMEOUT = 10 * time.Second
+)
+
+//虚拟主机路由
+type vhost struct {
+	uuid    string
+	forward proxy.Address
+}
+
+//主机名为key，小写且不含端口
+var vhosts map[string]*vhost
+
+//SNI路由，TLS ClientHello中的服务器名称为key，小写
+var sniHosts map[string]*vhost
+
+func init() {
+	vhosts = make(map[string]*vhost)
+	sniHosts = make(map[string]*vhost)
+}
+
+//uuid是否被虚拟主机或SNI路由引用
+func vhostUser(uuid string) bool {
+	for _, routes := range []map[string]*vhost{vhosts, sniHosts} {
+		for _, v := range routes {
+			if v.uuid == uuid {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//读取时先返回已读取的请求头
+type prefixConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+//双向转发数据，任一方向结束时关闭两端连接
+func relay(a, b net.Conn) {
+	var once sync.Once
+	closeBoth := func() {
+		a.Close()
+		b.Close()
+	}
+	go func() {
+		_, _ = io.Copy(a, b)
+		once.Do(closeBoth)
+	}()
+	_, _ = io.Copy(b, a)
+	once.Do(closeBoth)
+}
+
+//应答502页面并关闭连接
+func badGateway(c net.Conn, host string) {
+	body := fmt.Sprintf("<html><head><title>502 Bad Gateway</title></head><body><h1>502 Bad Gateway</h1><p>%s is not available.</p></body></html>\n", html(host))
+	_, _ = fmt.Fprintf(c, "HTTP/1.1 502 Bad Gateway\r\nContent-Type: text/html; charset=utf-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", len(body), body)
+	_ = c.Close()
+}
+
+func html(s string) string {
+	r := strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\"", "&quot;")
+	return r.Replace(s)
+}
+
+//处理虚拟主机监听接受的连接
+func (s *Server) handleVhost(c net.Conn) {
+	_ = c.SetReadDeadline(time.Now().Add(VHOST_TIMEOUT))
+	//记录解析请求头时读入的原始数据，转发时原样发送
+	var head bytes.Buffer
+	req, err := http.ReadRequest(bufio.NewReader(io.TeeReader(c, &head)))
+	if err != nil {
+		_ = c.Close()
+		return
+	}
+	_ = c.SetReadDeadline(time.Time{})
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	v, ok := vhosts[host]
+	if !ok {
+		logger.Warn("unknown vhost", "vhost", host, "peer", c.RemoteAddr())
+		badGateway(c, host)
+		return
+	}
+	conn, err := s.dialRoute(host, v)
+	if err != nil {
+		badGateway(c, host)
+		return
+	}
+	relay(&prefixConn{Conn: c, r: io.MultiReader(&head, c)}, conn)
+}
+
+//经路由对应客户端的代理对象连接转发地址
+func (s *Server) dialRoute(host string, v *vhost) (net.Conn, error) {
+	p := s.user(v.uuid)
+	if p == nil {
+		logger.Warn("client offline", "vhost", host, "uuid", v.uuid)
+		return nil, proxy.ErrProxyClosed
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), VHOST_TIMEOUT)
+	conn, err := p.Dial(ctx, v.forward.Domain, v.forward.Addr)
+	cancel()
+	if err != nil {
+		logger.Warn("connect to forward address failed", "vhost", host, "uuid", v.uuid, "forward", v.forward, "error", err)
+		return nil, err
+	}
+	return conn, nil
+}
@@ -0,0 +1,196 @@
+// Copyright 2019 The goproxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/idste/goproxy/proxy"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+//本地TCP连接对
+func testConnPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	ch := make(chan net.Conn, 1)
+	go func() {
+		c, _ := l.Accept()
+		ch <- c
+	}()
+	c1, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2 := <-ch
+	if c2 == nil {
+		t.Fatal("accept failed")
+	}
+	return c1, c2
+}
+
+//通过一条主连接相连的会话，p1为server一侧，p2为客户端一侧，由p2连接转发地址
+func testSession(t *testing.T, o1, o2 []proxy.Option) (*proxy.Proxy, *proxy.Proxy) {
+	t.Helper()
+	c1, c2 := testConnPair(t)
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	s1, r1, err := proxy.DeriveKeys(proxy.CIPHER_AES_128_GCM, secret, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2, r2, err := proxy.DeriveKeys(proxy.CIPHER_AES_128_GCM, secret, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp1, err := proxy.NewCipher(proxy.CIPHER_AES_128_GCM, s1, r1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp2, err := proxy.NewCipher(proxy.CIPHER_AES_128_GCM, s2, r2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	discard := proxy.WithLogger(proxy.NewTextLogger(ioutil.Discard, proxy.LEVEL_ERROR))
+	bp := proxy.NewBufferPool(256)
+	p1 := proxy.NewProxy(1, c1, nil, cp1, bp, nil, append([]proxy.Option{discard}, o1...)...)
+	p2 := proxy.NewProxy(2, c2, nil, cp2, bp, nil, append([]proxy.Option{discard}, o2...)...)
+	go p1.Handle()
+	go p2.Handle()
+	return p1, p2
+}
+
+//只接受一个连接的后端，返回收到的请求头，并应答固定内容
+func testBackend(t *testing.T, reply string) (net.Listener, <-chan string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan string, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		var head bytes.Buffer
+		r := bufio.NewReader(c)
+		for {
+			line, err := r.ReadString('\n')
+			head.WriteString(line)
+			if err != nil || line == "\r\n" {
+				break
+			}
+		}
+		received <- head.String()
+		_, _ = io.WriteString(c, reply)
+	}()
+	return l, received
+}
+
+//经handleVhost发送原始请求，返回应答
+func testVhostRequest(t *testing.T, s *Server, req string) (*http.Response, string) {
+	t.Helper()
+	c1, c2 := testConnPair(t)
+	//等待handleVhost返回，之后才能修改路由
+	done := make(chan struct{})
+	go func() {
+		s.handleVhost(c2)
+		close(done)
+	}()
+	defer func() {
+		c1.Close()
+		<-done
+	}()
+	_ = c1.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(c1, req); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(c1), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	return resp, string(body)
+}
+
+func TestVhost(t *testing.T) {
+	logger = proxy.NewTextLogger(ioutil.Discard, proxy.LEVEL_ERROR)
+	backend, received := testBackend(t, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\nConnection: close\r\n\r\nok")
+	defer backend.Close()
+	p1, p2 := testSession(t, nil, nil)
+	defer p1.Close()
+	defer p2.Close()
+	vhosts["app.example.com"] = &vhost{uuid: "alice", forward: proxy.Address{Domain: "tcp", Addr: backend.Addr().String()}}
+	vhosts["offline.example.com"] = &vhost{uuid: "bob", forward: proxy.Address{Domain: "tcp", Addr: backend.Addr().String()}}
+	defer delete(vhosts, "app.example.com")
+	defer delete(vhosts, "offline.example.com")
+	s := &Server{users: map[string]*proxy.Proxy{"alice": p1}}
+
+	//Host带端口且大小写不同时按主机名路由，请求头原样转发
+	req := "GET /index.html?a=1 HTTP/1.1\r\nHost: App.Example.com:8080\r\nConnection: keep-alive\r\nX-Test: 1\r\n\r\n"
+	resp, body := testVhostRequest(t, s, req)
+	if resp.StatusCode != http.StatusOK || body != "ok" {
+		t.Fatalf("status %d, body %q", resp.StatusCode, body)
+	}
+	if head := <-received; head != req {
+		t.Errorf("backend received %q, want %q", head, req)
+	}
+
+	tests := []struct {
+		name string
+		req  string
+		host string
+	}{
+		{"unknown host", "GET / HTTP/1.1\r\nHost: other.example.com\r\n\r\n", "other.example.com"},
+		{"unknown host with port", "GET / HTTP/1.1\r\nHost: other.example.com:80\r\n\r\n", "other.example.com"},
+		{"client offline", "GET / HTTP/1.1\r\nHost: offline.example.com\r\n\r\n", "offline.example.com"},
+		//主机名转义后出现在502页面中
+		{"escaped host", "GET / HTTP/1.1\r\nHost: <b>\r\n\r\n", "&lt;b&gt;"},
+	}
+	for _, tt := range tests {
+		resp, body := testVhostRequest(t, s, tt.req)
+		if resp.StatusCode != http.StatusBadGateway {
+			t.Errorf("%s: status %d, want 502", tt.name, resp.StatusCode)
+		}
+		if !strings.Contains(body, tt.host+" is not available") {
+			t.Errorf("%s: body %q", tt.name, body)
+		}
+	}
+}
+
+//请求头不完整时关闭连接
+func TestVhostBadRequest(t *testing.T) {
+	c1, c2 := testConnPair(t)
+	defer c1.Close()
+	done := make(chan struct{})
+	go func() {
+		(&Server{}).handleVhost(c2)
+		close(done)
+	}()
+	if _, err := io.WriteString(c1, "GET / HTTP/1.1\r\nHost: app"); err != nil {
+		t.Fatal(err)
+	}
+	_ = c1.(*net.TCPConn).CloseWrite()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handleVhost did not return")
+	}
+	_ = c1.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := c1.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Errorf("read %d, %v, want EOF", n, err)
+	}
+}
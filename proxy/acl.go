@@ -0,0 +1,329 @@
+// Copyright 2019 The goproxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proxy
+
+/*
+访问控制
+对端可以通过PROXY_CMD_NEW_CONNECT要求本端连接任意地址，通过PROXY_CMD_NEW_LISTEN要求本端监听任意地址，
+Config.DialPolicy和Config.ListenPolicy分别限制这两类请求，本端调用NewListener、Dial等接口不受限制
+规则格式为[network://]host[:port]:
+network tcp、udp、unix或pipe，省略时匹配任意网络，tcp匹配tcp4和tcp6
+host    *匹配任意地址，IP或CIDR如10.0.0.0/8，域名如example.com，*.example.com匹配其子域名
+        IPv6地址带端口时使用[]，如[fd00::/8]:22；unix和pipe地址为路径，可使用path.Match通配符，
+        规则和检查的路径都经path.Clean规范化，unix路径必须为绝对路径或以@开头的抽象命名空间地址
+port    端口或端口范围，如22、8000-9000，省略或*时匹配任意端口
+示例: 10.0.0.0/8、*.internal:22、udp://*:53、0.0.0.0:1024-65535、unix:///var/run/*.sock
+匹配任一Deny规则时拒绝；Allow不为空时需匹配任一Allow规则，否则拒绝
+主机名在策略含IP规则时由本端解析，名称或解析得到的全部地址匹配规则才允许，
+连接时使用解析得到的地址，避免两次解析结果不同
+连接地址的主机为空或为0.0.0.0、::(包括解析得到的)时实际连接本机，视为127.0.0.1和::1，两者都需允许；监听地址的主机为空时视为0.0.0.0
+*/
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+)
+
+var ErrAccessDenied = errors.New("access denied by policy")
+
+//Rule 访问规则，见ParseRule
+type Rule struct {
+	text    string
+	network string
+	//host为*
+	any bool
+	//IP或CIDR规则
+	ipnet *net.IPNet
+	//域名或路径规则，suffix为*.开头的域名去掉*后的部分
+	host   string
+	suffix string
+	//端口范围
+	portMin int
+	portMax int
+}
+
+//Policy 访问控制策略，为nil时不限制
+type Policy struct {
+	Allow []Rule
+	Deny  []Rule
+}
+
+//ParseRule解析规则，格式见acl.go
+func ParseRule(s string) (Rule, error) {
+	r := Rule{text: strings.TrimSpace(s), portMax: 65535}
+	s = r.text
+	if s == "" {
+		return r, fmt.Errorf("empty rule")
+	}
+	if i := strings.Index(s, "://"); i >= 0 {
+		r.network = strings.ToLower(s[:i])
+		s = s[i+3:]
+		switch r.network {
+		case "tcp", "udp", DOMAIN_UNIX, DOMAIN_PIPE:
+		default:
+			return r, fmt.Errorf("invalid rule %q: unknown network %q", r.text, r.network)
+		}
+	}
+	if r.network == DOMAIN_UNIX || r.network == DOMAIN_PIPE {
+		if s == "*" {
+			r.any = true
+			return r, nil
+		}
+		if _, err := path.Match(s, ""); err != nil || s == "" {
+			return r, fmt.Errorf("invalid rule %q: bad path pattern", r.text)
+		}
+		//与检查的地址一样规范化
+		if !isAbstractUnix(s) {
+			s = path.Clean(s)
+		}
+		r.host = s
+		return r, nil
+	}
+	host, port := splitRule(s)
+	if port != "" && port != "*" {
+		lo, hi := port, port
+		if i := strings.Index(port, "-"); i >= 0 {
+			lo, hi = port[:i], port[i+1:]
+		}
+		min, err1 := strconv.Atoi(lo)
+		max, err2 := strconv.Atoi(hi)
+		if err1 != nil || err2 != nil || min < 0 || min > max || max > 65535 {
+			return r, fmt.Errorf("invalid rule %q: bad port %q", r.text, port)
+		}
+		r.portMin, r.portMax = min, max
+	}
+	if host == "" || host == "*" {
+		r.any = true
+		return r, nil
+	}
+	if _, ipnet, err := net.ParseCIDR(host); err == nil {
+		r.ipnet = ipnet
+		return r, nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		r.ipnet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		return r, nil
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if strings.HasPrefix(host, "*.") {
+		r.suffix = host[1:]
+		host = host[2:]
+	}
+	if host == "" || strings.ContainsAny(host, "*/[] ") {
+		return r, fmt.Errorf("invalid rule %q: bad host %q", r.text, host)
+	}
+	r.host = host
+	return r, nil
+}
+
+//分离规则的主机和端口，不带[]的IPv6地址没有端口
+func splitRule(s string) (host string, port string) {
+	if strings.HasPrefix(s, "[") {
+		end := strings.Index(s, "]")
+		if end < 0 {
+			return s, ""
+		}
+		host, s = s[1:end], s[end+1:]
+		return host, strings.TrimPrefix(s, ":")
+	}
+	if strings.Count(s, ":") > 1 {
+		return s, ""
+	}
+	if i := strings.LastIndex(s, ":"); i >= 0 {
+		return s[:i], s[i+1:]
+	}
+	return s, ""
+}
+
+//规则原文
+func (r Rule) String() string {
+	return r.text
+}
+
+//规则是否匹配
+//@host 小写的主机名，IP地址时为空
+//@ip 主机的IP地址，主机名未解析时为nil
+//@port tcp和udp地址的端口，unix和pipe地址为-1
+func (r *Rule) match(network string, host string, ip net.IP, port int) bool {
+	if r.network != "" && !strings.HasPrefix(network, r.network) {
+		return false
+	}
+	if port < 0 {
+		if r.any {
+			return true
+		}
+		//路径规则需指定unix或pipe网络
+		matched, _ := path.Match(r.host, host)
+		return (r.network == DOMAIN_UNIX || r.network == DOMAIN_PIPE) && matched
+	}
+	if port < r.portMin || port > r.portMax {
+		return false
+	}
+	switch {
+	case r.any:
+		return true
+	case r.ipnet != nil:
+		return ip != nil && r.ipnet.Contains(ip)
+	case r.suffix != "":
+		return strings.HasSuffix(host, r.suffix)
+	}
+	return host != "" && host == r.host
+}
+
+//ParsePolicy由规则列表创建策略，两个列表都为空时返回nil
+func ParsePolicy(allow []string, deny []string) (*Policy, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+	pl := &Policy{}
+	for _, s := range allow {
+		r, err := ParseRule(s)
+		if err != nil {
+			return nil, err
+		}
+		pl.Allow = append(pl.Allow, r)
+	}
+	for _, s := range deny {
+		r, err := ParseRule(s)
+		if err != nil {
+			return nil, err
+		}
+		pl.Deny = append(pl.Deny, r)
+	}
+	return pl, nil
+}
+
+//是否含IP规则，此时需要解析主机名
+func (pl *Policy) hasIPRules() bool {
+	for _, rules := range [][]Rule{pl.Allow, pl.Deny} {
+		for i := range rules {
+			if rules[i].ipnet != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//查找匹配的规则
+func findRule(rules []Rule, network string, host string, ips []net.IP, port int) *Rule {
+	for i := range rules {
+		r := &rules[i]
+		if host != "" && r.match(network, host, nil, port) {
+			return r
+		}
+		for _, ip := range ips {
+			if r.match(network, "", ip, port) {
+				return r
+			}
+		}
+	}
+	return nil
+}
+
+//检查连接地址，返回需要连接的地址
+//主机名经本端解析时返回解析得到的地址，否则返回addr，unix和pipe地址为规范化的路径
+//@ctx 限制主机名解析的时间
+func (pl *Policy) checkDial(ctx context.Context, addr Address) ([]Address, error) {
+	return pl.check(ctx, addr, true)
+}
+
+//检查监听地址，返回需要监听的地址，unix和pipe地址为规范化的路径
+func (pl *Policy) checkListen(ctx context.Context, addr Address) (Address, error) {
+	addrs, err := pl.check(ctx, addr, false)
+	if err != nil {
+		return addr, err
+	}
+	return addrs[0], nil
+}
+
+//@dial 是否是连接地址
+func (pl *Policy) check(ctx context.Context, addr Address, dial bool) ([]Address, error) {
+	if pl == nil {
+		return []Address{addr}, nil
+	}
+	network := strings.ToLower(addr.Domain)
+	host, port := addr.Addr, -1
+	if strings.HasPrefix(network, DOMAIN_UNIX) || network == DOMAIN_PIPE {
+		//路径规范化后匹配，并使用规范化的路径，避免//、.和..绕过规则；抽象命名空间地址不是路径，原样匹配
+		if network == DOMAIN_PIPE || !isAbstractUnix(host) {
+			if network != DOMAIN_PIPE && !path.IsAbs(host) {
+				return nil, fmt.Errorf("%w: relative unix path %q", ErrAccessDenied, host)
+			}
+			host = path.Clean(host)
+			addr.Addr = host
+		}
+	} else {
+		h, ps, err := net.SplitHostPort(addr.Addr)
+		if err != nil {
+			return nil, err
+		}
+		if port, err = strconv.Atoi(ps); err != nil || port < 0 || port > 65535 {
+			return nil, fmt.Errorf("invalid port %q", ps)
+		}
+		host = strings.TrimSuffix(strings.ToLower(h), ".")
+	}
+	var ips []net.IP
+	resolved := false
+	if port >= 0 {
+		ip := net.ParseIP(host)
+		if dial && (host == "" || ip != nil && ip.IsUnspecified()) {
+			//连接未指定地址时连接本机
+			ips = []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+			host = ""
+		} else if host == "" {
+			ips = []net.IP{net.IPv4zero}
+		} else if ip != nil {
+			ips = []net.IP{ip}
+			host = ""
+		} else if pl.hasIPRules() {
+			ias, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+			if err != nil {
+				return nil, err
+			}
+			for _, ia := range ias {
+				if dial && ia.IP.IsUnspecified() {
+					ips = append(ips, net.IPv4(127, 0, 0, 1), net.IPv6loopback)
+				} else {
+					ips = append(ips, ia.IP)
+				}
+			}
+			resolved = true
+		}
+	}
+	if r := findRule(pl.Deny, network, host, ips, port); r != nil {
+		return nil, fmt.Errorf("%w: %s matches deny rule %q", ErrAccessDenied, addr, r.text)
+	}
+	if len(pl.Allow) > 0 && (host == "" || findRule(pl.Allow, network, host, nil, port) == nil) {
+		//名称不匹配时全部地址都需匹配
+		allowed := len(ips) > 0
+		for _, ip := range ips {
+			if findRule(pl.Allow, network, "", []net.IP{ip}, port) == nil {
+				allowed = false
+				break
+			}
+		}
+		if !allowed {
+			return nil, fmt.Errorf("%w: %s matches no allow rule", ErrAccessDenied, addr)
+		}
+	}
+	//监听地址不使用解析结果
+	if !resolved || !dial {
+		return []Address{addr}, nil
+	}
+	addrs := make([]Address, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, Address{Domain: addr.Domain, Addr: net.JoinHostPort(ip.String(), strconv.Itoa(port))})
+	}
+	return addrs, nil
+}
@@ -0,0 +1,232 @@
+// Copyright 2019 The goproxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRule(t *testing.T) {
+	for _, s := range []string{"", "foo://x", "1.2.3.4:70000", "x:5-3", "x:a", "a*b.com", "unix://[", "[::1"} {
+		if _, err := ParseRule(s); err == nil {
+			t.Errorf("ParseRule(%q) succeeded, want error", s)
+		}
+	}
+	for _, s := range []string{"*", "10.0.0.0/8", "[fd00::/8]:22", "::1", "*.example.com:443", "udp://*:53", "unix:///tmp/*.sock", "pipe://*", "0.0.0.0:1024-65535"} {
+		r, err := ParseRule(s)
+		if err != nil {
+			t.Errorf("ParseRule(%q): %v", s, err)
+		} else if r.String() != s {
+			t.Errorf("ParseRule(%q).String() = %q", s, r.String())
+		}
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	if pl, err := ParsePolicy(nil, nil); pl != nil || err != nil {
+		t.Errorf("ParsePolicy(nil, nil) = %v, %v, want nil, nil", pl, err)
+	}
+	if _, err := ParsePolicy([]string{"10.0.0.0/8"}, []string{"x:a"}); err == nil {
+		t.Error("ParsePolicy with bad deny rule succeeded")
+	}
+}
+
+type policyTest struct {
+	addr Address
+	dial bool
+	ok   bool
+}
+
+func testPolicy(t *testing.T, pl *Policy, tests []policyTest) {
+	t.Helper()
+	for _, tt := range tests {
+		_, err := pl.check(context.Background(), tt.addr, tt.dial)
+		if tt.ok && err != nil {
+			t.Errorf("check(%v, dial=%v): %v", tt.addr, tt.dial, err)
+		} else if !tt.ok && !errors.Is(err, ErrAccessDenied) {
+			t.Errorf("check(%v, dial=%v) = %v, want ErrAccessDenied", tt.addr, tt.dial, err)
+		}
+	}
+}
+
+func TestPolicyCheck(t *testing.T) {
+	pl, err := ParsePolicy(
+		[]string{"10.0.0.0/8", "udp://*:53", "[fd00::/8]:22", "unix:///tmp/*.sock"},
+		[]string{"10.9.0.0/16", "10.1.1.1:22"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testPolicy(t, pl, []policyTest{
+		{Address{"tcp", "10.1.2.3:80"}, true, true},
+		{Address{"tcp", "[::ffff:10.1.2.3]:80"}, true, true},
+		{Address{"tcp", "10.9.2.3:80"}, true, false},
+		{Address{"tcp", "10.1.1.1:22"}, true, false},
+		{Address{"tcp", "10.1.1.1:23"}, true, true},
+		{Address{"tcp", "192.168.1.1:80"}, true, false},
+		{Address{"udp", "8.8.8.8:53"}, true, true},
+		{Address{"tcp", "8.8.8.8:53"}, true, false},
+		{Address{"tcp6", "[fd00::1]:22"}, true, true},
+		{Address{"tcp", "[fe00::1]:22"}, true, false},
+		{Address{"unix", "/tmp/a.sock"}, true, true},
+		{Address{"unix", "/var/a.sock"}, true, false},
+		{Address{"pipe", "x"}, true, false},
+	})
+}
+
+func TestPolicyDomain(t *testing.T) {
+	//不含IP规则时不解析主机名
+	pl, err := ParsePolicy([]string{"*.example.com:443", "localhost:8000-9000"}, []string{"bad.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testPolicy(t, pl, []policyTest{
+		{Address{"tcp", "a.example.com:443"}, true, true},
+		{Address{"tcp", "A.Example.COM.:443"}, true, true},
+		{Address{"tcp", "a.example.com:80"}, true, false},
+		{Address{"tcp", "example.com:443"}, true, false},
+		{Address{"tcp", "bad.example.com:443"}, true, false},
+		{Address{"tcp", "localhost:8080"}, true, true},
+		{Address{"tcp", "1.2.3.4:443"}, true, false},
+	})
+}
+
+func TestPolicyResolve(t *testing.T) {
+	pl, err := ParsePolicy(nil, []string{"127.0.0.0/8", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	//解析得到的地址匹配拒绝规则
+	testPolicy(t, pl, []policyTest{
+		{Address{"tcp", "localhost:80"}, true, false},
+	})
+	pl, err = ParsePolicy([]string{"10.0.0.0/8"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := pl.checkDial(ctx, Address{"tcp", "host.invalid:80"}); err == nil {
+		t.Error("checkDial with canceled context succeeded")
+	}
+}
+
+func TestPolicyUnspecified(t *testing.T) {
+	//连接未指定地址等同于连接本机
+	pl, err := ParsePolicy(nil, []string{"127.0.0.0/8", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testPolicy(t, pl, []policyTest{
+		{Address{"tcp", ":22"}, true, false},
+		{Address{"tcp", "0.0.0.0:22"}, true, false},
+		{Address{"tcp", "[::]:22"}, true, false},
+		{Address{"tcp", "[::ffff:0.0.0.0]:22"}, true, false},
+		{Address{"udp", "0.0.0.0:53"}, true, false},
+		{Address{"tcp", "10.0.0.1:22"}, true, true},
+		//监听未指定地址不是本机地址
+		{Address{"tcp", ":8080"}, false, true},
+		{Address{"tcp", "0.0.0.0:8080"}, false, true},
+		{Address{"tcp", "127.0.0.1:8080"}, false, false},
+	})
+	//只允许127.0.0.1时不能连接未指定地址，::1可能是另一个服务
+	pl, err = ParsePolicy([]string{"127.0.0.1"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testPolicy(t, pl, []policyTest{
+		{Address{"tcp", "127.0.0.1:22"}, true, true},
+		{Address{"tcp", "0.0.0.0:22"}, true, false},
+	})
+	pl, err = ParsePolicy([]string{"127.0.0.1", "::1"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testPolicy(t, pl, []policyTest{
+		{Address{"tcp", "0.0.0.0:22"}, true, true},
+		{Address{"tcp", ":22"}, true, true},
+	})
+	//监听0.0.0.0需匹配规则
+	pl, err = ParsePolicy(nil, []string{"*:1-1023", "0.0.0.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testPolicy(t, pl, []policyTest{
+		{Address{"tcp", ":8080"}, false, false},
+		{Address{"tcp", "127.0.0.1:80"}, false, false},
+		{Address{"tcp", "127.0.0.1:8080"}, false, true},
+	})
+}
+
+func TestPolicyNil(t *testing.T) {
+	var pl *Policy
+	addr := Address{"tcp", "0.0.0.0:22"}
+	if addrs, err := pl.checkDial(context.Background(), addr); err != nil || len(addrs) != 1 || addrs[0] != addr {
+		t.Errorf("nil policy checkDial = %v, %v", addrs, err)
+	}
+}
+
+//路径经规范化后匹配，//、.和..不能绕过规则
+func TestPolicyUnixPath(t *testing.T) {
+	pl, err := ParsePolicy(nil, []string{"unix:///var/run/docker.sock", "pipe://a/../secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testPolicy(t, pl, []policyTest{
+		{Address{"unix", "/var/run/docker.sock"}, true, false},
+		{Address{"unix", "/var/run//docker.sock"}, true, false},
+		{Address{"unix", "/var/run/./docker.sock"}, true, false},
+		{Address{"unix", "/var/../var/run/docker.sock"}, true, false},
+		{Address{"unixgram", "/var/run//docker.sock"}, false, false},
+		{Address{"unix", "/var/run/other.sock"}, true, true},
+		{Address{"unix", "@/var/run/docker.sock"}, true, true},
+		//相对路径依赖进程的工作目录，总是拒绝
+		{Address{"unix", "docker.sock"}, true, false},
+		{Address{"unix", "../run/docker.sock"}, false, false},
+		{Address{"pipe", "secret"}, true, false},
+		{Address{"pipe", "x/../secret"}, true, false},
+		{Address{"pipe", "other"}, true, true},
+	})
+	//返回规范化的路径
+	addrs, err := pl.checkDial(context.Background(), Address{"unix", "/var/run/../run//other.sock"})
+	if err != nil || len(addrs) != 1 || addrs[0] != (Address{"unix", "/var/run/other.sock"}) {
+		t.Errorf("checkDial = %v, %v", addrs, err)
+	}
+	addr, err := pl.checkListen(context.Background(), Address{"unix", "/tmp/./a.sock"})
+	if err != nil || addr != (Address{"unix", "/tmp/a.sock"}) {
+		t.Errorf("checkListen = %v, %v", addr, err)
+	}
+}
+
+//对端创建的监听被ListenPolicy拒绝时通知对端，本端不保留监听，会话不受影响
+func TestPeerListenPolicy(t *testing.T) {
+	lp, err := ParsePolicy(nil, []string{"*:1-1023"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p1, p2 := testPair(t, nil, []Option{WithConfig(Config{ListenPolicy: lp})})
+	defer p1.Close()
+	defer p2.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = p1.NewPeerListenerContext(ctx, []byte(`{"Listen":{"Domain":"tcp","Addr":"127.0.0.1:80"},"Forward":{"Domain":"tcp","Addr":"127.0.0.1:1"}}`))
+	if !errors.Is(err, ErrListenFailed) || !strings.Contains(err.Error(), ErrAccessDenied.Error()) {
+		t.Fatalf("denied listen: %v", err)
+	}
+	testWait(t, "listener removal", func() bool { return len(p2.Listeners()) == 0 })
+	if n := p2.Stats().PolicyDenials; n != 1 {
+		t.Errorf("PolicyDenials = %d, want 1", n)
+	}
+	info, err := p1.NewPeerListenerContext(ctx, []byte(`{"Listen":{"Domain":"tcp","Addr":"127.0.0.1:0"},"Forward":{"Domain":"tcp","Addr":"127.0.0.1:1"}}`))
+	if err != nil || !info.Active {
+		t.Fatalf("allowed listen: %+v, %v", info, err)
+	}
+	if n := len(p2.Listeners()); n != 1 {
+		t.Errorf("%d listeners, want 1", n)
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2019 The goproxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+//本地回环链路上的吞吐量测试
+//两个会话通过回环TCP连接相连，由一端Dial本地接收服务，每次操作写入1MB
+
+//接收服务，读取所有数据后通过done返回接收的字节数
+func benchSink(b *testing.B, done chan int64) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	go func() {
+		defer l.Close()
+		c, err := l.Accept()
+		if err != nil {
+			done <- 0
+			return
+		}
+		n, _ := io.Copy(ioutil.Discard, c)
+		c.Close()
+		done <- n
+	}()
+	return l.Addr().String()
+}
+
+func benchLoopback(b *testing.B, frameSize uint32) {
+	//会话日志与测试结果输出在一起，不输出
+	opts := []Option{WithMaxFrameSize(frameSize), WithInitialWindow(MAX_STREAM_WINDOW), WithLogger(NewTextLogger(ioutil.Discard, LEVEL_WARN))}
+	p1, p2 := testPair(b, opts, opts)
+	defer p1.Close()
+	defer p2.Close()
+	done := make(chan int64, 1)
+	c, err := p1.Dial(context.Background(), "tcp", benchSink(b, done))
+	if err != nil {
+		b.Fatal(err)
+	}
+	//写缓存大于最大帧，使每次读取都能填满一帧
+	data := make([]byte, 1024*1024)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.Write(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+	c.Close()
+	if n := <-done; n != int64(b.N)*int64(len(data)) {
+		b.Fatalf("received %d bytes, want %d", n, int64(b.N)*int64(len(data)))
+	}
+}
+
+//帧数据区不小于FRAME_PAYLOAD_BASE，1K实际为1288字节
+func BenchmarkLoopback1K(b *testing.B)  { benchLoopback(b, 1024) }
+func BenchmarkLoopback16K(b *testing.B) { benchLoopback(b, 16*1024) }
+func BenchmarkLoopback64K(b *testing.B) { benchLoopback(b, 64*1024) }
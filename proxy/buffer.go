@@ -6,12 +6,22 @@ package proxy
 
 import (
 	"sync"
+	"sync/atomic"
 )
 
 const (
 	DEFAULT_BUFFER_SIZE = 1312
 )
 
+//缓存大小分级，最小级别为DEFAULT_BUFFER_SIZE，其余级别为帧数据区大小加帧头和认证标签
+var bufferClasses = []int{
+	DEFAULT_BUFFER_SIZE,
+	16*1024 + FRAME_HEAD_SIZE + FRAME_TAG_SIZE,
+	64*1024 + FRAME_HEAD_SIZE + FRAME_TAG_SIZE,
+	256*1024 + FRAME_HEAD_SIZE + FRAME_TAG_SIZE,
+	MAX_FRAME_PAYLOAD + FRAME_HEAD_SIZE + FRAME_TAG_SIZE,
+}
+
 type buffer struct {
 	size int
 	next *buffer
@@ -27,8 +37,23 @@ type bufferHeader struct {
 	tail    *buffer
 }
 
+//按bufferClasses分级的缓存池
 type BufferPool struct {
-	pool    chan *buffer
+	//从池中取得缓存和新分配缓存的次数(原子访问，保持64位对齐)
+	hits   uint64
+	misses uint64
+	pools  []chan *buffer
+}
+
+//PoolStats 缓存池统计信息，见BufferPool.Stats
+type PoolStats struct {
+	Hits   uint64
+	Misses uint64
+}
+
+//Stats返回缓存池统计信息
+func (bp *BufferPool) Stats() PoolStats {
+	return PoolStats{Hits: atomic.LoadUint64(&bp.hits), Misses: atomic.LoadUint64(&bp.misses)}
 }
 
 //创建缓存头bufferHeader
@@ -117,34 +142,50 @@ func (bh *bufferHeader) isEmpty() bool {
 	return bh.cnt == 0
 }
 
-//渐满，缓存总数大于当前预定保持数量2/3时true
-func (bh *bufferHeader) almostFull() bool {
-	bh.mutex.RLock()
-	defer bh.mutex.RUnlock()
-	return bh.cnt > (bh.holdcnt * 2 / 3)
+//创建新的缓存池
+//@holecnt 最小级别缓存的最大保持数。释放缓存时，当缓存数多于保持数时释放内存，否则保留
+//其他级别按相同内存总量折算保持数，至少保持4个
+func NewBufferPool(holdcnt uint32) *BufferPool {
+	bp := &BufferPool{pools: make([]chan *buffer, len(bufferClasses))}
+	for i, size := range bufferClasses {
+		n := int(holdcnt) * DEFAULT_BUFFER_SIZE / size
+		if n < 4 {
+			n = 4
+		}
+		bp.pools[i] = make(chan *buffer, n)
+	}
+	return bp
 }
 
-//渐空，缓存总数小于当前预定保持数量1/3时true
-func (bh *bufferHeader) almostEmpty() bool {
-	bh.mutex.RLock()
-	defer bh.mutex.RUnlock()
-	return bh.cnt < (bh.holdcnt / 3)
+//获取容纳size字节的最小缓存级别，超过最大级别时返回-1
+func bufferClass(size int) int {
+	for i, v := range bufferClasses {
+		if size <= v {
+			return i
+		}
+	}
+	return -1
 }
 
-//创建新的缓存池
-//@holecnt 最大保持数。释放缓存时，当缓存数多于保持数时释放内存，否则保留
-func NewBufferPool(holdcnt uint32) *BufferPool {
-	return &BufferPool{pool: make(chan *buffer, holdcnt)}
+//从缓存池获取最小级别的缓存
+func (bp *BufferPool) get() *buffer {
+	return bp.getSize(DEFAULT_BUFFER_SIZE)
 }
 
-//从缓存池获取缓存
-func (bp *BufferPool) get() *buffer {
+//从缓存池获取至少size字节的缓存，size超过最大级别时返回nil
+func (bp *BufferPool) getSize(size int) *buffer {
+	i := bufferClass(size)
+	if i < 0 {
+		return nil
+	}
 	var b *buffer
 	select {
-	case b = <- bp.pool:
+	case b = <- bp.pools[i]:
+		atomic.AddUint64(&bp.hits, 1)
 	default:
+		atomic.AddUint64(&bp.misses, 1)
 		b = &buffer{}
-		b.data = make([]byte, DEFAULT_BUFFER_SIZE)
+		b.data = make([]byte, bufferClasses[i])
 	}
 	return b
 }
@@ -153,8 +194,12 @@ func (bp *BufferPool) get() *buffer {
 func (bp *BufferPool) put(b *buffer) {
 	b.next = nil
 	b.size = 0
+	i := bufferClass(len(b.data))
+	if i < 0 || bufferClasses[i] != len(b.data) {
+		return
+	}
 	select {
-	case bp.pool <- b:
+	case bp.pools[i] <- b:
 	default:
 	}
 }
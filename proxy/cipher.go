@@ -0,0 +1,237 @@
+// Copyright 2019 The goproxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"strings"
+)
+
+//主连接加密套件，由登录过程协商
+const (
+	CIPHER_AES_128_GCM       = 1
+	CIPHER_AES_256_GCM       = 2
+	CIPHER_CHACHA20_POLY1305 = 3
+)
+
+var (
+	ErrFrameAuth         = errors.New("frame authentication failed")
+	ErrFrameSize         = errors.New("invalid frame size")
+	ErrFrameTruncated    = errors.New("frame truncated")
+	ErrSequenceExhausted = errors.New("frame sequence number exhausted")
+	ErrUnknownCipher     = errors.New("unknown cipher suite")
+)
+
+//本端默认支持的加密套件，按优先级排序
+var DefaultCipherSuites = []byte{CIPHER_AES_128_GCM, CIPHER_CHACHA20_POLY1305, CIPHER_AES_256_GCM}
+
+var cipherNames = map[byte]string{
+	CIPHER_AES_128_GCM:       "aes-128-gcm",
+	CIPHER_AES_256_GCM:       "aes-256-gcm",
+	CIPHER_CHACHA20_POLY1305: "chacha20-poly1305",
+}
+
+//主连接帧加密对象，收发方向使用独立密钥
+//nonce由各方向递增的64位序号生成，重放、重排、篡改的帧都无法通过认证
+type Cipher struct {
+	suite   byte
+	send    cipher.AEAD
+	recv    cipher.AEAD
+	sendSeq uint64
+	recvSeq uint64
+	//收发go程各自使用的nonce
+	sendNonce [12]byte
+	recvNonce [12]byte
+}
+
+//CipherSuiteName返回加密套件名称
+func CipherSuiteName(suite byte) string {
+	if name, ok := cipherNames[suite]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", suite)
+}
+
+//是否都是本端实现的加密套件
+func knownCipherSuites(suites []byte) bool {
+	for _, suite := range suites {
+		if _, ok := cipherNames[suite]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+//ParseCipherSuites解析逗号分隔的加密套件名称列表
+//@s 示例:"aes-128-gcm,chacha20-poly1305"
+func ParseCipherSuites(s string) ([]byte, error) {
+	var suites []byte
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		found := false
+		for suite, v := range cipherNames {
+			if v == name {
+				suites = append(suites, suite)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownCipher, name)
+		}
+	}
+	if len(suites) == 0 {
+		return nil, ErrUnknownCipher
+	}
+	return suites, nil
+}
+
+//SelectCipherSuite按本端优先级从对端提供的列表中选择加密套件
+//@local 本端支持的套件，按优先级排序
+//@offered 对端支持的套件
+func SelectCipherSuite(local, offered []byte) (byte, bool) {
+	for _, suite := range local {
+		if _, ok := cipherNames[suite]; !ok {
+			continue
+		}
+		for _, v := range offered {
+			if v == suite {
+				return suite, true
+			}
+		}
+	}
+	return 0, false
+}
+
+//CipherKeySize返回加密套件所需密钥长度
+func CipherKeySize(suite byte) int {
+	switch suite {
+	case CIPHER_AES_128_GCM:
+		return 16
+	case CIPHER_AES_256_GCM:
+		return 32
+	case CIPHER_CHACHA20_POLY1305:
+		return chacha20poly1305.KeySize
+	}
+	return 0
+}
+
+//DeriveKeys由协商得到的会话密钥派生收发两个方向的密钥(HKDF-SHA256)
+//@initiator 是否是发起连接的一端，两端取值必须相反
+func DeriveKeys(suite byte, secret []byte, initiator bool) (sendKey, recvKey []byte, err error) {
+	size := CipherKeySize(suite)
+	if size == 0 {
+		return nil, nil, ErrUnknownCipher
+	}
+	c2s := make([]byte, size)
+	s2c := make([]byte, size)
+	if _, err = io.ReadFull(hkdf.New(sha256.New, secret, nil, []byte("goproxy c2s key")), c2s); err != nil {
+		return nil, nil, err
+	}
+	if _, err = io.ReadFull(hkdf.New(sha256.New, secret, nil, []byte("goproxy s2c key")), s2c); err != nil {
+		return nil, nil, err
+	}
+	if initiator {
+		return c2s, s2c, nil
+	}
+	return s2c, c2s, nil
+}
+
+//NewCipher创建主连接帧加密对象
+//@sendKey 发送方向密钥
+//@recvKey 接收方向密钥
+func NewCipher(suite byte, sendKey, recvKey []byte) (*Cipher, error) {
+	send, err := newAEAD(suite, sendKey)
+	if err != nil {
+		return nil, err
+	}
+	recv, err := newAEAD(suite, recvKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Cipher{suite: suite, send: send, recv: recv}, nil
+}
+
+func newAEAD(suite byte, key []byte) (cipher.AEAD, error) {
+	if len(key) != CipherKeySize(suite) {
+		return nil, fmt.Errorf("%s: invalid key size %d", CipherSuiteName(suite), len(key))
+	}
+	switch suite {
+	case CIPHER_AES_128_GCM, CIPHER_AES_256_GCM:
+		blk, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(blk)
+	case CIPHER_CHACHA20_POLY1305:
+		return chacha20poly1305.New(key)
+	}
+	return nil, ErrUnknownCipher
+}
+
+//Suite返回协商的加密套件
+func (c *Cipher) Suite() byte {
+	return c.suite
+}
+
+//Overhead返回每帧附加的认证标签长度
+func (c *Cipher) Overhead() int {
+	return c.send.Overhead()
+}
+
+//由序号生成nonce，前8字节为小端序号，后4字节为0
+func makeNonce(nonce *[12]byte, seq uint64) []byte {
+	binary.LittleEndian.PutUint64(nonce[0:8], seq)
+	return nonce[:]
+}
+
+//加密缓存，out[0:3]写入密文长度并作为附加认证数据，b.data[3:size]加密至out[3:]并在尾部追加认证标签
+//b保持明文，主连接断开后可在其他主连接重新加密发送
+//只能在主连接写go程中调用
+//return 密文帧长度
+func (c *Cipher) seal(b *buffer, out []byte) (int, error) {
+	length := b.size - FRAME_LENGTH_SIZE + c.send.Overhead()
+	if b.size < FRAME_HEAD_SIZE || b.size+c.send.Overhead() > len(out) || length > 0xffffff {
+		return 0, ErrFrameSize
+	}
+	if c.sendSeq == ^uint64(0) {
+		return 0, ErrSequenceExhausted
+	}
+	out[0] = byte(length)
+	out[1] = byte(length >> 8)
+	out[2] = byte(length >> 16)
+	c.send.Seal(out[FRAME_LENGTH_SIZE:FRAME_LENGTH_SIZE], makeNonce(&c.sendNonce, c.sendSeq), b.data[FRAME_LENGTH_SIZE:b.size], out[0:FRAME_LENGTH_SIZE])
+	c.sendSeq++
+	return b.size + c.send.Overhead(), nil
+}
+
+//解密缓存，b.size为含长度前缀的完整帧大小，成功后b.size减去认证标签长度
+//只能在主连接读go程中调用
+func (c *Cipher) open(b *buffer) error {
+	if b.size < FRAME_HEAD_SIZE+c.recv.Overhead() {
+		return ErrFrameSize
+	}
+	if c.recvSeq == ^uint64(0) {
+		return ErrSequenceExhausted
+	}
+	_, err := c.recv.Open(b.data[FRAME_LENGTH_SIZE:FRAME_LENGTH_SIZE], makeNonce(&c.recvNonce, c.recvSeq), b.data[FRAME_LENGTH_SIZE:b.size], b.data[0:FRAME_LENGTH_SIZE])
+	if err != nil {
+		return ErrFrameAuth
+	}
+	c.recvSeq++
+	b.size -= c.recv.Overhead()
+	return nil
+}
@@ -0,0 +1,242 @@
+// Copyright 2019 The goproxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+//加密一帧，返回密文帧
+func testSeal(t *testing.T, cp *Cipher, bp *BufferPool, cmd byte, body []byte) []byte {
+	t.Helper()
+	b := bp.get()
+	defer bp.put(b)
+	b.data[3] = cmd
+	b.data[4], b.data[5], b.data[6], b.data[7] = 0, 0, 0, 0
+	b.size = FRAME_HEAD_SIZE + copy(b.data[FRAME_HEAD_SIZE:], body)
+	out := make([]byte, b.size+cp.Overhead())
+	n, err := cp.seal(b, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out[:n]
+}
+
+//解密一帧，返回明文帧
+func testOpen(cp *Cipher, bp *BufferPool, frame []byte) ([]byte, error) {
+	b := bp.getSize(len(frame))
+	defer bp.put(b)
+	b.size = copy(b.data, frame)
+	if err := cp.open(b); err != nil {
+		return nil, err
+	}
+	return append([]byte{}, b.data[:b.size]...), nil
+}
+
+func TestCipherRoundTrip(t *testing.T) {
+	bp := NewBufferPool(16)
+	for _, suite := range DefaultCipherSuites {
+		t.Run(CipherSuiteName(suite), func(t *testing.T) {
+			cp1, cp2 := testCipherPair(t, suite)
+			for i, body := range [][]byte{nil, []byte("ping"), bytes.Repeat([]byte{0x5a}, FRAME_PAYLOAD_BASE)} {
+				frame := testSeal(t, cp1, bp, PROXY_CMD_KEEPALIVE, body)
+				if len(frame) != FRAME_HEAD_SIZE+len(body)+FRAME_TAG_SIZE {
+					t.Fatalf("frame %d: size %d, want %d", i, len(frame), FRAME_HEAD_SIZE+len(body)+FRAME_TAG_SIZE)
+				}
+				//长度前缀为明文，其余均已加密
+				if length := int(frame[0]) | int(frame[1])<<8 | int(frame[2])<<16; length != len(frame)-FRAME_LENGTH_SIZE {
+					t.Fatalf("frame %d: length prefix %d, want %d", i, length, len(frame)-FRAME_LENGTH_SIZE)
+				}
+				if len(body) > 0 && bytes.Contains(frame, body) {
+					t.Fatalf("frame %d: plaintext visible", i)
+				}
+				plain, err := testOpen(cp2, bp, frame)
+				if err != nil {
+					t.Fatalf("frame %d: %v", i, err)
+				}
+				if plain[3] != PROXY_CMD_KEEPALIVE || !bytes.Equal(plain[FRAME_HEAD_SIZE:], body) {
+					t.Fatalf("frame %d: got %x", i, plain)
+				}
+			}
+		})
+	}
+}
+
+//长度前缀、头部、数据区和认证标签任一字节被修改都无法通过认证
+func TestCipherTamper(t *testing.T) {
+	bp := NewBufferPool(16)
+	cp1, cp2 := testCipherPair(t, CIPHER_AES_128_GCM)
+	frame := testSeal(t, cp1, bp, PROXY_CMD_KEEPALIVE, []byte("0123456789"))
+	for i := range frame {
+		tampered := append([]byte{}, frame...)
+		tampered[i] ^= 0x01
+		if _, err := testOpen(cp2, bp, tampered); err != ErrFrameAuth {
+			t.Fatalf("byte %d: got %v, want ErrFrameAuth", i, err)
+		}
+	}
+	//认证失败不推进序号，原帧仍可解密
+	if _, err := testOpen(cp2, bp, frame); err != nil {
+		t.Fatal(err)
+	}
+}
+
+//重放或重排的帧序号不符，无法通过认证
+func TestCipherReplay(t *testing.T) {
+	bp := NewBufferPool(16)
+	cp1, cp2 := testCipherPair(t, CIPHER_CHACHA20_POLY1305)
+	f1 := testSeal(t, cp1, bp, PROXY_CMD_KEEPALIVE, []byte("first"))
+	f2 := testSeal(t, cp1, bp, PROXY_CMD_KEEPALIVE, []byte("second"))
+	if _, err := testOpen(cp2, bp, f2); err != ErrFrameAuth {
+		t.Fatalf("reordered frame: got %v, want ErrFrameAuth", err)
+	}
+	if _, err := testOpen(cp2, bp, f1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testOpen(cp2, bp, f1); err != ErrFrameAuth {
+		t.Fatalf("replayed frame: got %v, want ErrFrameAuth", err)
+	}
+	if _, err := testOpen(cp2, bp, f2); err != nil {
+		t.Fatal(err)
+	}
+	//发送方向的帧不能被本端接收方向解密
+	f3 := testSeal(t, cp1, bp, PROXY_CMD_KEEPALIVE, nil)
+	if _, err := testOpen(cp1, bp, f3); err != ErrFrameAuth {
+		t.Fatalf("reflected frame: got %v, want ErrFrameAuth", err)
+	}
+}
+
+func TestCipherTruncated(t *testing.T) {
+	bp := NewBufferPool(16)
+	cp1, cp2 := testCipherPair(t, CIPHER_AES_256_GCM)
+	frame := testSeal(t, cp1, bp, PROXY_CMD_KEEPALIVE, []byte("0123456789"))
+	//不足头部和认证标签长度
+	if _, err := testOpen(cp2, bp, frame[:FRAME_HEAD_SIZE+FRAME_TAG_SIZE-1]); err != ErrFrameSize {
+		t.Fatalf("short frame: got %v, want ErrFrameSize", err)
+	}
+	//截去尾部，认证标签不完整
+	if _, err := testOpen(cp2, bp, frame[:len(frame)-1]); err != ErrFrameAuth {
+		t.Fatalf("truncated frame: got %v, want ErrFrameAuth", err)
+	}
+	//输出缓存不足
+	b := bp.get()
+	defer bp.put(b)
+	b.size = FRAME_HEAD_SIZE + 10
+	if _, err := cp1.seal(b, make([]byte, b.size+cp1.Overhead()-1)); err != ErrFrameSize {
+		t.Fatalf("short output: got %v, want ErrFrameSize", err)
+	}
+}
+
+func TestCipherSuites(t *testing.T) {
+	suites, err := ParseCipherSuites(" chacha20-poly1305, aes-128-gcm ,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(suites, []byte{CIPHER_CHACHA20_POLY1305, CIPHER_AES_128_GCM}) {
+		t.Fatalf("ParseCipherSuites = %v", suites)
+	}
+	for _, s := range []string{"", " , ", "aes-128-gcm,rc4"} {
+		if _, err := ParseCipherSuites(s); !errors.Is(err, ErrUnknownCipher) {
+			t.Errorf("ParseCipherSuites(%q) = %v, want ErrUnknownCipher", s, err)
+		}
+	}
+	tests := []struct {
+		local   []byte
+		offered []byte
+		suite   byte
+		ok      bool
+	}{
+		{DefaultCipherSuites, DefaultCipherSuites, CIPHER_AES_128_GCM, true},
+		//按本端优先级选择
+		{[]byte{CIPHER_AES_256_GCM, CIPHER_AES_128_GCM}, []byte{CIPHER_AES_128_GCM, CIPHER_AES_256_GCM}, CIPHER_AES_256_GCM, true},
+		{[]byte{CIPHER_AES_128_GCM}, []byte{CIPHER_CHACHA20_POLY1305}, 0, false},
+		//本端列表中的未知套件被忽略
+		{[]byte{0xff, CIPHER_CHACHA20_POLY1305}, []byte{0xff, CIPHER_CHACHA20_POLY1305}, CIPHER_CHACHA20_POLY1305, true},
+	}
+	for _, tt := range tests {
+		suite, ok := SelectCipherSuite(tt.local, tt.offered)
+		if suite != tt.suite || ok != tt.ok {
+			t.Errorf("SelectCipherSuite(%v, %v) = %d, %v, want %d, %v", tt.local, tt.offered, suite, ok, tt.suite, tt.ok)
+		}
+	}
+	if _, _, err := DeriveKeys(0xff, []byte("secret"), true); err != ErrUnknownCipher {
+		t.Errorf("DeriveKeys unknown suite = %v, want ErrUnknownCipher", err)
+	}
+	if _, err := NewCipher(CIPHER_AES_128_GCM, make([]byte, 32), make([]byte, 16)); err == nil {
+		t.Error("NewCipher accepted a 32-byte AES-128 key")
+	}
+	//会话参数中的加密套件
+	cfg := Config{CipherSuites: []byte{CIPHER_AES_256_GCM, 0xff}}
+	if err := cfg.Validate(); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("Validate unknown suite = %v, want ErrInvalidConfig", err)
+	}
+	if got := ConfigOf(WithConfig(cfg)).CipherSuites; !bytes.Equal(got, DefaultCipherSuites) {
+		t.Errorf("ConfigOf unknown suite = %v, want defaults", got)
+	}
+	if got := ConfigOf(WithConfig(Config{}), WithCipherSuites([]byte{CIPHER_CHACHA20_POLY1305})).CipherSuites; !bytes.Equal(got, []byte{CIPHER_CHACHA20_POLY1305}) {
+		t.Errorf("ConfigOf(WithCipherSuites) = %v", got)
+	}
+}
+
+//主连接收到无法解密或不完整的帧时结束会话
+func TestLinkFrameErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		//向主连接写入的数据，由对端加密对象生成
+		frames func(t *testing.T, cp *Cipher, bp *BufferPool) []byte
+	}{
+		{"tamper", ErrFrameAuth, func(t *testing.T, cp *Cipher, bp *BufferPool) []byte {
+			f := testSeal(t, cp, bp, PROXY_CMD_KEEPALIVE, []byte("ping"))
+			f[FRAME_HEAD_SIZE] ^= 0x80
+			return f
+		}},
+		{"replay", ErrFrameAuth, func(t *testing.T, cp *Cipher, bp *BufferPool) []byte {
+			f := testSeal(t, cp, bp, PROXY_CMD_KEEPALIVE, nil)
+			return append(append([]byte{}, f...), f...)
+		}},
+		{"truncated", ErrFrameTruncated, func(t *testing.T, cp *Cipher, bp *BufferPool) []byte {
+			f := testSeal(t, cp, bp, PROXY_CMD_KEEPALIVE, []byte("ping"))
+			return f[:len(f)-1]
+		}},
+		{"size", ErrFrameSize, func(t *testing.T, cp *Cipher, bp *BufferPool) []byte {
+			return []byte{0xff, 0xff, 0xff, 0}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c1, c2 := testConnPair(t)
+			defer c2.Close()
+			go func() {
+				_, _ = io.Copy(ioutil.Discard, c2)
+			}()
+			cp1, cp2 := testCipherPair(t, CIPHER_AES_128_GCM)
+			bp := NewBufferPool(16)
+			p := NewProxy(1, c1, nil, cp1, bp, nil, WithLogger(NewTextLogger(ioutil.Discard, LEVEL_WARN)))
+			go p.Handle()
+			defer p.Close()
+			if _, err := c2.Write(tt.frames(t, cp2, bp)); err != nil {
+				t.Fatal(err)
+			}
+			//截断的帧在连接断开时才能确认
+			if tt.err == ErrFrameTruncated {
+				_ = c2.(*net.TCPConn).CloseWrite()
+			}
+			select {
+			case <-p.Done():
+			case <-time.After(5 * time.Second):
+				t.Fatal("session did not end")
+			}
+			if err := p.Err(); err != tt.err {
+				t.Fatalf("Err = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
@@ -5,21 +5,18 @@
 package proxy
 
 import (
-	"fmt"
 	"net"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type client struct {
 	//是否是监听子连接
 	subtype bool
-	//是否暂停接收，用于流控
-	//当待发送缓存数量多于pauseTh需要发送PROXY_CMD_PAUSE消息通知暂时数据发送
-	//当待发送缓存数量少于startTh需要发送PROXY_CMD_RUN消息通知恢复数据发送
-	pause bool
-	//是否已发送暂停命令
-	sendPause bool
+	//是否是数据报子连接，每帧对应一个完整的数据报，见udp.go
+	packet bool
 	//id 在同一proxy对象内，每个client都有唯一ID
 	id uint32
 	//连接句柄
@@ -32,7 +29,22 @@ type client struct {
 	exitChan chan byte
 	//发送缓存列表
 	sendBuffers *bufferHeader
+	//已发送未处理的CTRL_CMD_DATA通知，原子访问
+	dataNotified int32
+	//Dial创建的子连接用于接收对端连接结果，其余子连接为nil
+	connected   chan error
 	wg          sync.WaitGroup
+	//流控窗口，由windowMutex保护
+	//sendWindow 对端允许本端继续发送的字节数，为0时读go程等待PROXY_CMD_WINDOW_UPDATE
+	//recvWindow 本端允许对端继续发送的字节数，对端超出时关闭子连接
+	//consumed 已写入子连接但尚未通知对端的字节数
+	windowMutex sync.Mutex
+	windowCond  *sync.Cond
+	sendWindow  int64
+	recvWindow  int64
+	consumed    int64
+	//子连接已退出，唤醒等待窗口的读go程
+	stopped bool
 }
 
 //NewProxy创建新的代理对象
@@ -41,37 +53,143 @@ func NewClient(id uint32, c net.Conn, proxy *Proxy, subtype bool) *client {
 	cli := &client{id: id, c: c, proxy: proxy, subtype: subtype}
 	cli.ctrlChan = make(chan byte, 256)
 	cli.exitChan = make(chan byte, 16)
-	//发送缓存数大于16即会向对端发送暂停命令
-	cli.sendBuffers = newBufferHeader(32, proxy.bp)
+	//待发送数据量受接收窗口限制
+	cli.sendBuffers = newBufferHeader(proxy.cfg.HoldCount, proxy.bp)
+	cli.windowCond = sync.NewCond(&cli.windowMutex)
+	cli.sendWindow = STREAM_WINDOW_BASE
+	cli.recvWindow = int64(proxy.window)
 	return cli
 }
 
+//对端增加发送窗口
+func (cli *client) addSendWindow(n uint32) {
+	cli.windowMutex.Lock()
+	cli.sendWindow += int64(n)
+	cli.windowMutex.Unlock()
+	cli.windowCond.Broadcast()
+}
+
+//等待发送窗口，返回本次可读取的字节数，子连接退出时返回0
+//@need 至少需要的窗口，数据报子连接为整个数据报的长度
+//@max 缓存可容纳的字节数
+func (cli *client) waitSendWindow(need int, max int) int {
+	cli.windowMutex.Lock()
+	defer cli.windowMutex.Unlock()
+	if cli.sendWindow < int64(need) && !cli.stopped {
+		atomic.AddUint64(&cli.proxy.windowStalls, 1)
+		if hook := cli.proxy.cfg.Hooks.WindowStall; hook != nil {
+			hook(cli.proxy, cli.id)
+		}
+	}
+	for cli.sendWindow < int64(need) && !cli.stopped {
+		cli.windowCond.Wait()
+	}
+	if cli.stopped {
+		return 0
+	}
+	if int64(max) > cli.sendWindow {
+		return int(cli.sendWindow)
+	}
+	return max
+}
+
+//扣除已发送的字节数
+func (cli *client) useSendWindow(n int) {
+	cli.windowMutex.Lock()
+	cli.sendWindow -= int64(n)
+	cli.windowMutex.Unlock()
+}
+
+//收到对端数据时扣除接收窗口，对端超出窗口时返回false
+func (cli *client) useRecvWindow(n int) bool {
+	cli.windowMutex.Lock()
+	defer cli.windowMutex.Unlock()
+	if int64(n) > cli.recvWindow {
+		return false
+	}
+	cli.recvWindow -= int64(n)
+	return true
+}
+
+//数据写入子连接后累计，超过窗口一半时返回需要通知对端的增量
+//数据报子连接在对端剩余窗口可能不足一个最大数据报时即返回，避免对端等待整个数据报的窗口
+func (cli *client) consume(n int) uint32 {
+	cli.windowMutex.Lock()
+	defer cli.windowMutex.Unlock()
+	cli.consumed += int64(n)
+	limit := int64(cli.proxy.window / 2)
+	if cli.packet {
+		if m := int64(cli.proxy.window) - int64(cli.proxy.udpRecvPayload()); m < limit {
+			limit = m
+		}
+	}
+	if cli.consumed < limit {
+		return 0
+	}
+	inc := cli.consumed
+	cli.consumed = 0
+	cli.recvWindow += inc
+	return uint32(inc)
+}
+
+//停止读go程
+func (cli *client) stop() {
+	cli.windowMutex.Lock()
+	cli.stopped = true
+	cli.windowMutex.Unlock()
+	cli.windowCond.Broadcast()
+}
+
+//通知Dial连接结果，只有第一个结果有效
+func (cli *client) notifyConnected(err error) {
+	if cli.connected == nil {
+		return
+	}
+	select {
+	case cli.connected <- err:
+	default:
+	}
+}
+
 //读取数据go程，除超时外任何错误都关闭连接
+//每次读取的数据量不超过发送窗口，窗口用尽时等待对端PROXY_CMD_WINDOW_UPDATE
 func (cli *client) read() {
-	cli.wg.Add(1)
+	if cli.packet {
+		cli.readPacket()
+		return
+	}
 	var b *buffer = nil
 	for {
+		//单帧数据不超过对端声明的帧大小
+		max := cli.waitSendWindow(1, cli.proxy.peerFramePayload())
+		if max == 0 {
+			if b != nil {
+				cli.proxy.bp.put(b)
+			}
+			goto err
+		}
+		//前8字节为头部，尾部为认证标签，预留
+		if b != nil && len(b.data) < FRAME_HEAD_SIZE+max+FRAME_TAG_SIZE {
+			cli.proxy.bp.put(b)
+			b = nil
+		}
 		if b == nil {
-			b = cli.proxy.bp.get()
+			b = cli.proxy.bp.getSize(FRAME_HEAD_SIZE + max + FRAME_TAG_SIZE)
 			if b == nil {
-				fmt.Println("allocate new buffer failed, exit")
+				cli.proxy.log.Error("allocate buffer failed", "stream", cli.id)
 				goto err
 			}
 		}
-		//主动限速
-		if cli.pause {
-			time.Sleep(time.Second / 20)
-		}
-		//超时定时器，用于产生CTRL_CMD_TICK，定时清理空闲缓存
-		_ = cli.c.SetReadDeadline(time.Now().Add(TICK))
-		//前8字节为头部，预留
-		n, err := cli.c.Read(b.data[8:])
+		//定时超时返回，重新检查发送窗口和对端帧大小
+		_ = cli.c.SetReadDeadline(time.Now().Add(cli.proxy.cfg.Tick))
+		n, err := cli.c.Read(b.data[8 : 8+max])
 		if err != nil {
 			if netErr, ok := err.(net.Error); ok && netErr.Timeout() == true {
 				continue
 			}
 			goto err
 		}
+		cli.useSendWindow(n)
 		b.size = n + 8
 		//发送数据，如果主连接发送不及时会在函数内阻塞
 		cli.proxy.clientSendCommand(cli, PROXY_CMD_DATA, b, nil)
@@ -83,8 +201,46 @@ err:
 	cli.ctrlChan <- CTRL_CMD_EXIT
 }
 
+//数据报子连接的读取go程，每次读取一个数据报，等待发送窗口足够后作为一帧发送，不拆分数据报
+//长度上限在收到对端PROXY_CMD_SETTINGS后可能变大，读取缓存按UDP_MAX_DATAGRAM分配，
+//多1字节用于发现超长的数据报，超长的数据报被丢弃，其余数据报复制到与长度相符的帧缓存中
+func (cli *client) readPacket() {
+	pkt := make([]byte, UDP_MAX_DATAGRAM+1)
+	for {
+		_ = cli.c.SetReadDeadline(time.Now().Add(cli.proxy.cfg.Tick))
+		n, err := cli.c.Read(pkt)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() == true {
+				continue
+			}
+			goto err
+		}
+		if max := cli.proxy.udpMaxPayload(); n > max {
+			atomic.AddUint64(&cli.proxy.udpDrops, 1)
+			cli.proxy.log.Warn("udp packet dropped", "stream", cli.id, "size", n, "reason", "exceeds "+strconv.Itoa(max)+" bytes")
+			continue
+		}
+		if cli.waitSendWindow(n, n) < n {
+			goto err
+		}
+		b := cli.proxy.bp.getSize(FRAME_HEAD_SIZE + n + FRAME_TAG_SIZE)
+		if b == nil {
+			cli.proxy.log.Error("allocate buffer failed", "stream", cli.id)
+			goto err
+		}
+		copy(b.data[8:], pkt[:n])
+		cli.useSendWindow(n)
+		b.size = n + 8
+		cli.proxy.clientSendCommand(cli, PROXY_CMD_DATA, b, nil)
+	}
+err:
+	cli.wg.Done()
+	cli.ctrlChan <- CTRL_CMD_EXIT
+}
+
 //写数据
 func (cli *client) write() {
+	cli.wg.Add(1)
 	go cli.read()
 	//空闲缓存清理定时器
 	forceExit := false
@@ -101,34 +257,34 @@ func (cli *client) write() {
 			case CTRL_CMD_EXIT:
 				goto err
 			case CTRL_CMD_DATA:
-				b := cli.sendBuffers.pop()
-				if b == nil {
-					break
-				}
-				//前8字节为头部数据，忽略
-				offset := 8
+				//通知被合并，先清除标记再写完所有待发送缓存，之后追加的缓存会产生新的通知
+				atomic.StoreInt32(&cli.dataNotified, 0)
 				for {
-					cnt, err := cli.c.Write(b.data[offset:b.size])
-					if err != nil {
-						goto err
-					}
-					if cnt+offset == b.size {
+					b := cli.sendBuffers.pop()
+					if b == nil {
 						break
 					}
-					offset += cnt
-					continue
-				}
-				if cli.sendPause == false && cli.sendBuffers.almostFull() {
-					//处理数据缓存过多时暂停对端子连接接收
-					cli.proxy.clientSendCommand(cli, PROXY_CMD_PAUSE, nil, nil)
-					cli.sendPause = true
-				} else if cli.sendPause == true && cli.sendBuffers.almostEmpty() {
-					//处理数据缓存过少时恢复对端子连接接收
-					cli.proxy.clientSendCommand(cli, PROXY_CMD_RUN, nil, nil)
-					cli.sendPause = false
+					//前8字节为头部数据，忽略
+					offset := 8
+					for {
+						cnt, err := cli.c.Write(b.data[offset:b.size])
+						if err != nil {
+							cli.proxy.bp.put(b)
+							goto err
+						}
+						if cnt+offset == b.size {
+							break
+						}
+						offset += cnt
+						continue
+					}
+					//数据已交给子连接，累计到一定数量后向对端归还窗口
+					if inc := cli.consume(b.size - 8); inc > 0 {
+						cli.proxy.sendWindowUpdate(cli, inc, true)
+					}
+					//归还至空闲缓存池，如果池中缓存长时间未使用，会在定时器中归还至根缓存池
+					cli.proxy.bp.put(b)
 				}
-				//归还至空闲缓存池，如果池中缓存长时间未使用，会在定时器中归还至根缓存池
-				cli.proxy.bp.put(b)
 			case CTRL_CMD_FORCE_EXIT:
 				forceExit = true
 				goto err
@@ -137,12 +293,16 @@ func (cli *client) write() {
 	}
 err:
 	cli.c.Close()
+	cli.stop()
 	cli.wg.Wait()
 	clean:
 	for {
+		//写操作出错前可能已收到强制关闭命令
 		select {
-		case <-cli.exitChan:
-		case <-cli.ctrlChan:
+		case cmd := <-cli.exitChan:
+			forceExit = forceExit || cmd == CTRL_CMD_FORCE_EXIT
+		case cmd := <-cli.ctrlChan:
+			forceExit = forceExit || cmd == CTRL_CMD_FORCE_EXIT
 		default:
 			break clean
 		}
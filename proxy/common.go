@@ -5,6 +5,7 @@
 package proxy
 
 import (
+	"errors"
 	"net"
 	"time"
 )
@@ -15,37 +16,142 @@ const (
 	CTRL_CMD_EXIT        = 0
 	CTRL_CMD_FORCE_EXIT = 1
 	CTRL_CMD_DATA       = 2
-	CTRL_CMD_TICK       = 3
 )
 
-//最多支持32条命令
+//最多支持32条命令，1、2为旧版本PAUSE/RUN命令，已由PROXY_CMD_WINDOW_UPDATE取代
 const (
 	PROXY_CMD_DATA          = 0
-	PROXY_CMD_PAUSE         = 1
-	PROXY_CMD_RUN           = 2
 	PROXY_CMD_NEW_CONNECT   = 3
 	PROXY_CMD_CLOSE_CONNECT = 4
 	PROXY_CMD_NEW_LISTEN    = 5
 	PROXY_CMD_KEEPALIVE     = 6
+	//子连接已连接至转发地址，Dial据此返回
+	PROXY_CMD_CONNECT_OK = 7
+	//增加对端子连接的发送窗口，数据区为4字节小端增量
+	PROXY_CMD_WINDOW_UPDATE = 8
+	//主连接参数，ID无效，数据区为4字节小端的本端可接收帧数据区大小
+	PROXY_CMD_SETTINGS = 9
+	//确认本主连接上已处理的帧数，ID无效，数据区为8字节小端帧数
+	PROXY_CMD_LINK_ACK = 10
+	//主连接断开，ID为断开的主连接ID，数据区为8字节小端的本端在该主连接上已处理的帧数和1字节是否需要对端回复
+	PROXY_CMD_LINK_LOST = 11
+	//关闭由PROXY_CMD_NEW_LISTEN创建的监听，ID为发送方分配的监听ID
+	PROXY_CMD_CLOSE_LISTEN = 12
+	//监听结果，ID为PROXY_CMD_NEW_LISTEN的监听ID，数据区为json格式的实际监听地址和错误信息
+	PROXY_CMD_LISTEN_RESULT = 13
+	//对端即将关闭会话，不再发起新的子连接和监听，已有子连接继续传输，见lifecycle.go
+	PROXY_CMD_GOAWAY = 14
 )
 
+//子连接流控窗口
+//子连接创建时双方的发送窗口均为STREAM_WINDOW_BASE，接收方配置的窗口更大时立即发送WINDOW_UPDATE补足差值
 const (
-	PROXY_FLAG_HEAD_DECRYPTED = 1
+	STREAM_WINDOW_BASE    = 64 * 1024
+	DEFAULT_STREAM_WINDOW = 256 * 1024
+	MAX_STREAM_WINDOW     = 16 * 1024 * 1024
+)
+
+//帧格式:
+//data[0:3] 后续密文长度(含认证标签)，小端，明文传输并作为附加认证数据
+//data[3]   低5位为PROXY_CMD_XX命令，最高位表示监听子连接
+//data[4:8] 连接ID，小端
+//data[8:]  数据区，密文尾部附带认证标签
+const (
+	FRAME_LENGTH_SIZE = 3
+	FRAME_HEAD_SIZE   = 8
+	FRAME_TAG_SIZE    = 16
+)
+
+//帧数据区大小
+//收到对端PROXY_CMD_SETTINGS前发送的帧数据区不超过FRAME_PAYLOAD_BASE，之后不超过对端声明的大小
+const (
+	FRAME_PAYLOAD_BASE    = DEFAULT_BUFFER_SIZE - FRAME_HEAD_SIZE - FRAME_TAG_SIZE
+	DEFAULT_FRAME_PAYLOAD = 16 * 1024
+	MAX_FRAME_PAYLOAD     = 1024 * 1024
 )
 
 const (
 	TICK = time.Second
 )
 
+var (
+	ErrKeepaliveTimeout = errors.New("keepalive timeout")
+	ErrConnectFailed    = errors.New("peer connect failed")
+	ErrProxyClosed      = errors.New("proxy closed")
+	ErrListenerNotFound = errors.New("listener not found")
+	ErrListenFailed     = errors.New("peer listen failed")
+)
+
 type Address struct {
 	Domain string
 	Addr   string
 }
 
+func (a Address) String() string {
+	return a.Domain + "/" + a.Addr
+}
+
 type Listener struct {
+	//接受的连接数(UDP为会话数)和读写的字节数，见stats.go(原子访问，保持64位对齐)
+	accepted uint64
+	bytesIn  uint64
+	bytesOut uint64
 	Listen  Address
 	Forward Address
-	active  bool
+	//是否正在监听，由Proxy.mutex保护
+	active bool
+	//监听ID，见Proxy.NewListener
+	id int
+	//已关闭，不再重新监听，由Proxy.mutex保护
+	stopped bool
+	//实际监听地址和监听失败的原因，由Proxy.mutex保护
+	addr string
+	err  string
+	//对端监听ID，对端通过PROXY_CMD_NEW_LISTEN创建时不为0，监听结果通过PROXY_CMD_LISTEN_RESULT通知对端
+	peerID uint32
+	//上次监听失败，只在首次失败时通知对端
+	failed bool
 	//监听句柄
 	l net.Listener
+	//数据报监听句柄，Listen.Domain为udp时使用
+	pc net.PacketConn
+	//unix域套接字文件权限，八进制字串，如"0660"
+	Mode string
+	//监听类型，为空时转发至Forward，KIND_SOCKS5或KIND_HTTP时由客户端指定目的地址
+	Kind string
+	//SOCKS5或HTTP代理用户名密码，Username为空时不认证
+	Username string
+	Password string
+}
+
+//ListenerInfo 监听信息，见Proxy.Listeners
+type ListenerInfo struct {
+	ID      int
+	Listen  Address
+	Forward Address
+	Kind    string
+	//是否正在监听，监听失败时为false并定时重试
+	Active bool
+	//实际监听地址，如Listen端口为0时分配的端口，未监听成功时为空
+	Addr string
+	//监听失败的原因，监听成功后清空
+	Error string
+}
+
+//PROXY_CMD_LISTEN_RESULT数据区
+type listenResult struct {
+	Addr  string
+	Error string
+}
+
+//关闭监听句柄，调用时需持有Proxy.mutex
+func (lsn *Listener) close() {
+	lsn.active = false
+	lsn.stopped = true
+	if lsn.l != nil {
+		_ = lsn.l.Close()
+	}
+	if lsn.pc != nil {
+		_ = lsn.pc.Close()
+	}
 }
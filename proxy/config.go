@@ -0,0 +1,232 @@
+// Copyright 2019 The goproxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proxy
+
+/*
+会话参数
+NewProxy的可选参数都保存在Config中，WithConfig一次设置全部参数，WithInitialWindow等选项修改单个参数
+零值字段使用DefaultConfig中的默认值，NewProxy不返回错误，超出范围的参数取边界值或默认值，
+需要报告错误的调用者(如解析命令行参数)应先调用Config.Validate
+CipherSuites在登录握手时使用: 握手完成前会话尚未创建，handshake包通过ConfigOf读取传给NewProxy的参数，
+协商结果通过Cipher传给NewProxy
+*/
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	DEFAULT_KEEPALIVE_INTERVAL = 60 * time.Second
+	DEFAULT_KEEPALIVE_TIMEOUT  = 120 * time.Second
+	DEFAULT_SEND_QUEUE         = 256
+	DEFAULT_EMERGENCY_QUEUE    = 16
+	DEFAULT_HOLD_COUNT         = 32
+	DEFAULT_DIAL_TIMEOUT       = 10 * time.Second
+	//定时检查间隔的下限
+	MIN_TICK = 10 * time.Millisecond
+)
+
+var ErrInvalidConfig = errors.New("invalid config")
+
+//Config 会话参数，见DefaultConfig
+type Config struct {
+	//每个子连接的接收窗口，见WithInitialWindow
+	InitialWindow uint32
+	//本端可接收的帧数据区大小，见WithMaxFrameSize
+	MaxFrameSize uint32
+	//会话恢复等待时间，0表示不恢复，见WithResumeTimeout
+	ResumeTimeout time.Duration
+	//主连接KEEPALIVE发送间隔，超过KeepaliveTimeout未收到对端KEEPALIVE时断开主连接
+	//两者精确到秒，KeepaliveTimeout应大于对端的KeepaliveInterval
+	//移动网络等NAT超时较短的链路可减小间隔，数据中心内可增大间隔
+	KeepaliveInterval time.Duration
+	KeepaliveTimeout  time.Duration
+	//定时检查间隔，用于keepalive、主连接确认、子连接空闲缓存和UDP会话清理，不大于KeepaliveInterval
+	Tick time.Duration
+	//会话发送队列和紧急队列长度
+	SendQueueSize      int
+	EmergencyQueueSize int
+	//每个子连接保留的空闲发送缓存数，超出部分归还缓存池
+	HoldCount int
+	//会话日志，为nil时使用DefaultLogger，见WithLogger
+	Logger Logger
+	//连接对端请求的转发地址，为nil时使用net.Dialer，DOMAIN_PIPE地址不经过该函数
+	Dial func(ctx context.Context, network string, addr string) (net.Conn, error)
+	//连接转发地址(含DialPolicy解析主机名)的超时时间，超时后通知对端连接失败
+	DialTimeout time.Duration
+	//对端请求连接的转发地址和请求监听的地址的访问控制策略，为nil时不限制，见acl.go
+	DialPolicy   *Policy
+	ListenPolicy *Policy
+	//事件回调，用于对接外部监控
+	Hooks Hooks
+	//本端支持的加密套件，按优先级排序，登录握手时与对端协商，见WithCipherSuites和ParseCipherSuites
+	CipherSuites []byte
+}
+
+//Hooks 会话事件回调，在产生事件的go程中同步调用，不能阻塞，为nil的回调不调用
+type Hooks struct {
+	//主连接可用和断开
+	LinkUp   func(p *Proxy, link uint32)
+	LinkDown func(p *Proxy, link uint32, err error)
+	//收到KEEPALIVE回复，rtt为往返时间
+	RTT func(p *Proxy, link uint32, rtt time.Duration)
+	//子连接因发送窗口耗尽而等待
+	WindowStall func(p *Proxy, stream uint32)
+	//连接对端请求的转发地址失败
+	DialFailure func(p *Proxy, forward Address, err error)
+}
+
+//DefaultConfig返回默认参数
+func DefaultConfig() Config {
+	return Config{
+		InitialWindow:      DEFAULT_STREAM_WINDOW,
+		MaxFrameSize:       DEFAULT_FRAME_PAYLOAD,
+		KeepaliveInterval:  DEFAULT_KEEPALIVE_INTERVAL,
+		KeepaliveTimeout:   DEFAULT_KEEPALIVE_TIMEOUT,
+		Tick:               TICK,
+		SendQueueSize:      DEFAULT_SEND_QUEUE,
+		EmergencyQueueSize: DEFAULT_EMERGENCY_QUEUE,
+		HoldCount:          DEFAULT_HOLD_COUNT,
+		DialTimeout:        DEFAULT_DIAL_TIMEOUT,
+		CipherSuites:       DefaultCipherSuites,
+	}
+}
+
+//WithConfig设置全部会话参数，零值字段使用默认值
+//在其后传入的WithInitialWindow等选项覆盖对应参数
+func WithConfig(cfg Config) Option {
+	return func(p *Proxy) {
+		p.cfg = cfg
+	}
+}
+
+//ConfigOf返回依次应用opts后NewProxy使用的会话参数，用于会话创建前读取参数，如登录握手时的加密套件
+func ConfigOf(opts ...Option) Config {
+	p := &Proxy{cfg: DefaultConfig()}
+	for _, opt := range opts {
+		opt(p)
+	}
+	p.cfg.normalize()
+	return p.cfg
+}
+
+//Validate检查参数，返回第一个不合法的参数，零值字段视为默认值
+func (cfg *Config) Validate() error {
+	c := *cfg
+	c.fillDefaults()
+	switch {
+	case c.InitialWindow < STREAM_WINDOW_BASE || c.InitialWindow > MAX_STREAM_WINDOW:
+		return fmt.Errorf("%w: InitialWindow must be in [%d, %d]", ErrInvalidConfig, STREAM_WINDOW_BASE, MAX_STREAM_WINDOW)
+	case c.MaxFrameSize < FRAME_PAYLOAD_BASE || c.MaxFrameSize > MAX_FRAME_PAYLOAD:
+		return fmt.Errorf("%w: MaxFrameSize must be in [%d, %d]", ErrInvalidConfig, FRAME_PAYLOAD_BASE, MAX_FRAME_PAYLOAD)
+	case c.ResumeTimeout < 0:
+		return fmt.Errorf("%w: ResumeTimeout must not be negative", ErrInvalidConfig)
+	case c.KeepaliveInterval < time.Second:
+		return fmt.Errorf("%w: KeepaliveInterval must be at least 1s", ErrInvalidConfig)
+	case c.KeepaliveTimeout <= c.KeepaliveInterval:
+		return fmt.Errorf("%w: KeepaliveTimeout must be greater than KeepaliveInterval", ErrInvalidConfig)
+	case c.Tick < MIN_TICK || c.Tick > c.KeepaliveInterval:
+		return fmt.Errorf("%w: Tick must be in [%s, KeepaliveInterval]", ErrInvalidConfig, MIN_TICK)
+	case c.SendQueueSize < 0 || c.EmergencyQueueSize < 0:
+		return fmt.Errorf("%w: queue sizes must not be negative", ErrInvalidConfig)
+	case c.HoldCount < 0:
+		return fmt.Errorf("%w: HoldCount must not be negative", ErrInvalidConfig)
+	case c.DialTimeout < 0:
+		return fmt.Errorf("%w: DialTimeout must not be negative", ErrInvalidConfig)
+	case !knownCipherSuites(c.CipherSuites):
+		return fmt.Errorf("%w: CipherSuites contains an unknown cipher suite", ErrInvalidConfig)
+	}
+	return nil
+}
+
+//零值字段使用默认值
+func (cfg *Config) fillDefaults() {
+	def := DefaultConfig()
+	if cfg.InitialWindow == 0 {
+		cfg.InitialWindow = def.InitialWindow
+	}
+	if cfg.MaxFrameSize == 0 {
+		cfg.MaxFrameSize = def.MaxFrameSize
+	}
+	if cfg.KeepaliveInterval == 0 {
+		cfg.KeepaliveInterval = def.KeepaliveInterval
+	}
+	if cfg.KeepaliveTimeout == 0 {
+		cfg.KeepaliveTimeout = def.KeepaliveTimeout
+	}
+	if cfg.Tick == 0 {
+		cfg.Tick = def.Tick
+	}
+	if cfg.SendQueueSize == 0 {
+		cfg.SendQueueSize = def.SendQueueSize
+	}
+	if cfg.EmergencyQueueSize == 0 {
+		cfg.EmergencyQueueSize = def.EmergencyQueueSize
+	}
+	if cfg.HoldCount == 0 {
+		cfg.HoldCount = def.HoldCount
+	}
+	if cfg.DialTimeout == 0 {
+		cfg.DialTimeout = def.DialTimeout
+	}
+	if len(cfg.CipherSuites) == 0 {
+		cfg.CipherSuites = def.CipherSuites
+	}
+}
+
+//NewProxy使用的参数，零值字段使用默认值，超出范围时取边界值，不合法的keepalive和队列参数使用默认值
+func (cfg *Config) normalize() {
+	cfg.fillDefaults()
+	if cfg.InitialWindow < STREAM_WINDOW_BASE {
+		cfg.InitialWindow = STREAM_WINDOW_BASE
+	}
+	if cfg.InitialWindow > MAX_STREAM_WINDOW {
+		cfg.InitialWindow = MAX_STREAM_WINDOW
+	}
+	if cfg.MaxFrameSize < FRAME_PAYLOAD_BASE {
+		cfg.MaxFrameSize = FRAME_PAYLOAD_BASE
+	}
+	if cfg.MaxFrameSize > MAX_FRAME_PAYLOAD {
+		cfg.MaxFrameSize = MAX_FRAME_PAYLOAD
+	}
+	if cfg.ResumeTimeout < 0 {
+		cfg.ResumeTimeout = 0
+	}
+	def := DefaultConfig()
+	if cfg.KeepaliveInterval < time.Second || cfg.KeepaliveTimeout <= cfg.KeepaliveInterval {
+		cfg.KeepaliveInterval = def.KeepaliveInterval
+		cfg.KeepaliveTimeout = def.KeepaliveTimeout
+	}
+	if cfg.Tick < MIN_TICK {
+		cfg.Tick = MIN_TICK
+	}
+	if cfg.Tick > cfg.KeepaliveInterval {
+		cfg.Tick = cfg.KeepaliveInterval
+	}
+	if cfg.SendQueueSize < 0 {
+		cfg.SendQueueSize = def.SendQueueSize
+	}
+	if cfg.EmergencyQueueSize < 0 {
+		cfg.EmergencyQueueSize = def.EmergencyQueueSize
+	}
+	if cfg.HoldCount < 0 {
+		cfg.HoldCount = def.HoldCount
+	}
+	if cfg.DialTimeout < 0 {
+		cfg.DialTimeout = def.DialTimeout
+	}
+	if !knownCipherSuites(cfg.CipherSuites) {
+		cfg.CipherSuites = def.CipherSuites
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = DefaultLogger
+	}
+	if cfg.Dial == nil {
+		cfg.Dial = (&net.Dialer{Timeout: cfg.DialTimeout}).DialContext
+	}
+}
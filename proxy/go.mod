@@ -1,3 +1,8 @@
 module github.com/idste/goproxy/proxy
 
 go 1.13
+
+require (
+	github.com/libp2p/go-reuseport v0.4.0
+	golang.org/x/crypto v0.0.0-20220722155217-630584e8d5aa
+)
@@ -0,0 +1,105 @@
+// Copyright 2019 The goproxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package handshake
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/idste/goproxy/proxy"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+/*
+TLS主连接的加密开销
+TLS主连接上的帧仍由帧加密对象加密，数据被加密两次，以下测试比较本地回环上的吞吐量:
+BenchmarkLoopbackPassword uuid和密码登录的会话，仅帧加密
+BenchmarkLoopbackTLS TLS登录的会话，TLS加密和帧加密
+BenchmarkTLSCopy 不经过会话的TLS 1.3连接，仅TLS加密
+每次操作写入1MB，会话最大帧为64KB
+*/
+
+//接收服务，读取所有数据后通过done返回接收的字节数
+func benchSink(b *testing.B, l net.Listener, done chan int64) {
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			done <- 0
+			return
+		}
+		n, _ := io.Copy(ioutil.Discard, c)
+		c.Close()
+		done <- n
+	}()
+}
+
+//写入b.N次1MB数据并确认接收完整
+func benchWrite(b *testing.B, c net.Conn, done chan int64) {
+	data := make([]byte, 1024*1024)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := c.Write(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+	c.Close()
+	if n := <-done; n != int64(b.N)*int64(len(data)) {
+		b.Fatalf("received %d bytes, want %d", n, int64(b.N)*int64(len(data)))
+	}
+}
+
+func benchLoopback(b *testing.B, useTLS bool) {
+	ccfg, scfg := testConfig(1), testConfig(2)
+	for _, cfg := range []*Config{ccfg, scfg} {
+		cfg.Options = append(cfg.Options, proxy.WithMaxFrameSize(64*1024), proxy.WithInitialWindow(proxy.MAX_STREAM_WINDOW))
+	}
+	var r *handshakeResult
+	if useTLS {
+		server, client := testTLSConfigs(b, "alice")
+		r = testHandshakeTLS(b, server, client, ccfg, scfg)
+	} else {
+		r = testHandshake(b, &Credentials{UUID: "alice", Password: "secret"}, ccfg, scfg)
+	}
+	defer r.close()
+	if r.cerr != nil || r.serr != nil {
+		b.Fatalf("client: %v, server: %v", r.cerr, r.serr)
+	}
+	go r.client.Handle()
+	go r.server.Handle()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+	done := make(chan int64, 1)
+	benchSink(b, l, done)
+	c, err := r.client.Dial(context.Background(), "tcp", l.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchWrite(b, c, done)
+}
+
+func BenchmarkLoopbackPassword(b *testing.B) { benchLoopback(b, false) }
+func BenchmarkLoopbackTLS(b *testing.B)      { benchLoopback(b, true) }
+
+func BenchmarkTLSCopy(b *testing.B) {
+	server, client := testTLSConfigs(b, "alice")
+	l, err := tls.Listen("tcp", "127.0.0.1:0", tls13(server))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+	done := make(chan int64, 1)
+	benchSink(b, l, done)
+	c, err := tls.Dial("tcp", l.Addr().String(), tls13(client))
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchWrite(b, c, done)
+}
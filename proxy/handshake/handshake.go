@@ -0,0 +1,401 @@
+// Copyright 2019 The goproxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+主连接登录握手，完成版本协商、加密套件协商、X25519密钥交换和基于密码的双向认证，返回可直接运行的proxy.Proxy对象
+交互过程:
+1. client -> server CLIENT_HELLO 支持的版本、加密套件、uuid、会话字段和临时公钥
+2. server -> client SERVER_HELLO 选定的版本、加密套件和临时公钥
+3. client -> server CLIENT_DONE 客户端确认值
+4. server -> client SERVER_DONE 服务端确认值和会话令牌
+任一阶段失败时服务端发送ALERT消息，由调用者关闭连接
+会话字段为空时创建新会话，否则为会话令牌和客户端分配的主连接ID，连接作为附加主连接加入该会话(见proxy.Proxy.AddLink)，
+加入会话同样需要完成uuid和密码认证，令牌只用于确定会话
+使用TLS 1.3双向认证的主连接见ClientHandshakeTLS和ServerHandshakeTLS
+*/
+package handshake
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/idste/goproxy/proxy"
+	"io"
+	"net"
+	"time"
+)
+
+//协议版本，帧格式不兼容时递增，双方没有共同版本时以ALERT_UNSUPPORTED_VERSION拒绝
+//VERSION_4 PROXY_CMD_WINDOW_UPDATE窗口流控、3字节帧长度、PROXY_CMD_SETTINGS协商帧大小，会话令牌用于多条主连接加入同一会话
+const (
+	VERSION_4 = 4
+)
+
+//加入会话时的会话字段: [会话令牌 SESSION_TOKEN_SIZE字节][主连接ID 4字节 小端]
+const (
+	JOIN_LINK_ID_OFFSET = proxy.SESSION_TOKEN_SIZE
+	JOIN_FIELD_SIZE     = JOIN_LINK_ID_OFFSET + 4
+)
+
+const (
+	DEFAULT_TIMEOUT = 10 * time.Second
+)
+
+//本端支持的协议版本，按优先级排序
+var SupportedVersions = []byte{VERSION_4}
+
+var (
+	ErrProtocol           = errors.New("handshake: protocol error")
+	ErrUnsupportedVersion = errors.New("handshake: unsupported protocol version")
+	ErrNoCipherSuite      = errors.New("handshake: no common cipher suite")
+	ErrAuthFailed         = errors.New("handshake: authentication failed")
+	ErrUnknownUser        = errors.New("handshake: unknown user")
+	ErrSessionNotFound    = errors.New("handshake: session not found")
+)
+
+//Error 握手错误，Op为出错阶段，可使用errors.Is判断具体错误
+type Error struct {
+	Op  string
+	Err error
+}
+
+func (e *Error) Error() string {
+	return e.Op + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+//Credentials 客户端登录凭证
+type Credentials struct {
+	UUID     string
+	Password string
+}
+
+//Authenticator 服务端凭证查询接口，返回uuid对应的密码
+type Authenticator interface {
+	Password(uuid string) (password string, ok bool)
+}
+
+//AuthenticatorFunc 以函数实现Authenticator
+type AuthenticatorFunc func(uuid string) (password string, ok bool)
+
+func (f AuthenticatorFunc) Password(uuid string) (string, bool) {
+	return f(uuid)
+}
+
+//Config 握手参数及创建proxy.Proxy所需参数
+type Config struct {
+	//本端支持的加密套件，按优先级排序，为空时使用Options中的proxy.Config.CipherSuites，默认为proxy.DefaultCipherSuites
+	CipherSuites []byte
+	//握手超时，为0时使用DEFAULT_TIMEOUT
+	Timeout time.Duration
+	//以下参数原样传给proxy.NewProxy，BufferPool不能为空，Exit可为nil，此时使用Proxy.Run获取会话结束原因
+	ID         uint32
+	Ctx        interface{}
+	BufferPool *proxy.BufferPool
+	Exit       func(p *proxy.Proxy)
+	//proxy.NewProxy可选参数，如proxy.WithInitialWindow
+	Options []proxy.Option
+	//客户端: 不为nil时出示该会话的令牌，连接作为附加主连接加入该会话，不再创建新的proxy.Proxy
+	Join *proxy.Proxy
+	//服务端: 查询uuid当前的会话，用于客户端加入已有会话，为nil时不支持加入
+	Session func(uuid string) *proxy.Proxy
+}
+
+//客户端登录请求中的会话字段，新会话为空，加入已有会话时为令牌和本端分配的主连接ID
+func (cfg *Config) joinField() ([]byte, uint32) {
+	if cfg.Join == nil {
+		return nil, 0
+	}
+	id := cfg.Join.NextLinkID()
+	field := make([]byte, JOIN_FIELD_SIZE)
+	copy(field, cfg.Join.Token())
+	binary.LittleEndian.PutUint32(field[JOIN_LINK_ID_OFFSET:], id)
+	return field, id
+}
+
+//服务端查找客户端请求加入的会话，会话字段为空时返回nil
+func (cfg *Config) lookupSession(uuid string, field []byte) (*proxy.Proxy, uint32, error) {
+	if len(field) == 0 {
+		return nil, 0, nil
+	}
+	if len(field) != JOIN_FIELD_SIZE {
+		return nil, 0, ErrProtocol
+	}
+	if cfg.Session == nil {
+		return nil, 0, ErrSessionNotFound
+	}
+	p := cfg.Session(uuid)
+	token := field[:JOIN_LINK_ID_OFFSET]
+	if p == nil || subtle.ConstantTimeCompare(p.Token(), token) != 1 {
+		return nil, 0, ErrSessionNotFound
+	}
+	return p, binary.LittleEndian.Uint32(field[JOIN_LINK_ID_OFFSET:]), nil
+}
+
+//生成新会话的令牌
+func newToken() ([]byte, error) {
+	token := make([]byte, proxy.SESSION_TOKEN_SIZE)
+	if _, err := io.ReadFull(rand.Reader, token); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+//创建新会话或将连接加入已有会话
+//@join 加入的会话，为nil时创建新会话
+func (cfg *Config) newProxy(c net.Conn, cp *proxy.Cipher, token []byte, join *proxy.Proxy, linkID uint32) (*proxy.Proxy, error) {
+	if join != nil {
+		if err := join.AddLink(linkID, c, cp); err != nil {
+			return nil, err
+		}
+		return join, nil
+	}
+	opts := append([]proxy.Option{proxy.WithSessionToken(token)}, cfg.Options...)
+	return proxy.NewProxy(cfg.ID, c, cfg.Ctx, cp, cfg.BufferPool, cfg.Exit, opts...), nil
+}
+
+func (cfg *Config) cipherSuites() []byte {
+	if len(cfg.CipherSuites) == 0 {
+		return proxy.ConfigOf(cfg.Options...).CipherSuites
+	}
+	return cfg.CipherSuites
+}
+
+func (cfg *Config) timeout() time.Duration {
+	if cfg.Timeout == 0 {
+		return DEFAULT_TIMEOUT
+	}
+	return cfg.Timeout
+}
+
+func alertError(code byte) error {
+	switch code {
+	case ALERT_UNSUPPORTED_VERSION:
+		return ErrUnsupportedVersion
+	case ALERT_NO_CIPHER_SUITE:
+		return ErrNoCipherSuite
+	case ALERT_AUTH_FAILED:
+		return ErrAuthFailed
+	case ALERT_SESSION_NOT_FOUND:
+		return ErrSessionNotFound
+	}
+	return ErrProtocol
+}
+
+func alertCode(err error) byte {
+	switch {
+	case errors.Is(err, ErrUnsupportedVersion):
+		return ALERT_UNSUPPORTED_VERSION
+	case errors.Is(err, ErrNoCipherSuite):
+		return ALERT_NO_CIPHER_SUITE
+	case errors.Is(err, ErrAuthFailed), errors.Is(err, ErrUnknownUser):
+		return ALERT_AUTH_FAILED
+	case errors.Is(err, ErrSessionNotFound):
+		return ALERT_SESSION_NOT_FOUND
+	}
+	return ALERT_PROTOCOL
+}
+
+//选择双方都支持的版本，按本端优先级
+func selectVersion(local, offered []byte) (byte, bool) {
+	for _, v := range local {
+		for _, o := range offered {
+			if v == o {
+				return v, true
+			}
+		}
+	}
+	return 0, false
+}
+
+//ClientHandshake在已建立的主连接上完成客户端(发起端)握手
+//成功返回的proxy.Proxy需要调用Handle运行，失败时不关闭连接
+//cfg.Join不为nil时连接加入该会话并返回cfg.Join，服务端找不到会话时返回ErrSessionNotFound
+func ClientHandshake(c net.Conn, creds *Credentials, cfg *Config) (*proxy.Proxy, error) {
+	if len(creds.UUID) == 0 || len(creds.UUID) > 255 {
+		return nil, &Error{Op: "client hello", Err: fmt.Errorf("%w: invalid uuid length", ErrProtocol)}
+	}
+	_ = c.SetDeadline(time.Now().Add(cfg.timeout()))
+	defer c.SetDeadline(time.Time{})
+	kex, err := proxy.NewKeyExchange()
+	if err != nil {
+		return nil, &Error{Op: "key exchange", Err: err}
+	}
+	suites := cfg.cipherSuites()
+	join, linkID := cfg.joinField()
+	//CLIENT_HELLO: 版本列表、加密套件列表、uuid、会话字段、临时公钥
+	payload := appendField(nil, SupportedVersions)
+	payload = appendField(payload, suites)
+	payload = appendField(payload, []byte(creds.UUID))
+	payload = appendField(payload, join)
+	payload = append(payload, kex.PublicKey()...)
+	msg, err := writeMsg(c, MSG_CLIENT_HELLO, payload)
+	if err != nil {
+		return nil, &Error{Op: "client hello", Err: err}
+	}
+	kex.AddTranscript(msg)
+
+	//SERVER_HELLO: 版本、加密套件、临时公钥
+	msg, payload, err = readMsg(c, MSG_SERVER_HELLO)
+	if err != nil {
+		return nil, &Error{Op: "server hello", Err: err}
+	}
+	if len(payload) != 2+proxy.KEX_PUBLIC_KEY_SIZE {
+		return nil, &Error{Op: "server hello", Err: ErrProtocol}
+	}
+	if _, ok := selectVersion(SupportedVersions, payload[0:1]); !ok {
+		return nil, &Error{Op: "server hello", Err: ErrUnsupportedVersion}
+	}
+	suite, ok := proxy.SelectCipherSuite(suites, payload[1:2])
+	if !ok {
+		return nil, &Error{Op: "server hello", Err: ErrNoCipherSuite}
+	}
+	kex.AddTranscript(msg)
+	keys, err := kex.Finish(payload[2:], creds.Password)
+	if err != nil {
+		return nil, &Error{Op: "key exchange", Err: err}
+	}
+
+	//先发送本端确认值，再校验服务端确认值，确认服务端持有相同密码
+	if _, err := writeMsg(c, MSG_CLIENT_DONE, keys.Finished(true)); err != nil {
+		return nil, &Error{Op: "client done", Err: err}
+	}
+	//SERVER_DONE: 确认值、会话令牌
+	_, payload, err = readMsg(c, MSG_SERVER_DONE)
+	if err != nil {
+		return nil, &Error{Op: "server done", Err: err}
+	}
+	if len(payload) <= proxy.SESSION_TOKEN_SIZE {
+		return nil, &Error{Op: "server done", Err: ErrProtocol}
+	}
+	token := payload[len(payload)-proxy.SESSION_TOKEN_SIZE:]
+	if err := keys.VerifyFinished(true, payload[:len(payload)-proxy.SESSION_TOKEN_SIZE]); err != nil {
+		return nil, &Error{Op: "server done", Err: ErrAuthFailed}
+	}
+	if cfg.Join != nil && !bytes.Equal(token, cfg.Join.Token()) {
+		return nil, &Error{Op: "server done", Err: ErrSessionNotFound}
+	}
+	cp, err := keys.Cipher(suite, true)
+	if err != nil {
+		return nil, &Error{Op: "cipher", Err: err}
+	}
+	p, err := cfg.newProxy(c, cp, token, cfg.Join, linkID)
+	if err != nil {
+		return nil, &Error{Op: "join", Err: err}
+	}
+	return p, nil
+}
+
+//ServerHandshake在已接受的主连接上完成服务端(响应端)握手
+//成功返回proxy.Proxy和客户端uuid，失败时向客户端发送ALERT消息，但不关闭连接
+//客户端出示会话令牌时连接加入cfg.Session查询到的会话，返回的proxy.Proxy为已运行的会话
+func ServerHandshake(c net.Conn, auth Authenticator, cfg *Config) (*proxy.Proxy, string, error) {
+	_ = c.SetDeadline(time.Now().Add(cfg.timeout()))
+	defer c.SetDeadline(time.Time{})
+	p, uuid, err := serverHandshake(c, auth, cfg)
+	if err != nil {
+		_, _ = writeMsg(c, MSG_ALERT, []byte{alertCode(err)})
+		return nil, uuid, err
+	}
+	return p, uuid, nil
+}
+
+func serverHandshake(c net.Conn, auth Authenticator, cfg *Config) (*proxy.Proxy, string, error) {
+	kex, err := proxy.NewKeyExchange()
+	if err != nil {
+		return nil, "", &Error{Op: "key exchange", Err: err}
+	}
+	msg, payload, err := readMsg(c, MSG_CLIENT_HELLO)
+	if err != nil {
+		return nil, "", &Error{Op: "client hello", Err: err}
+	}
+	//先协商版本，其余字段格式可能随版本变化
+	versions, rest, ok := readField(payload)
+	if !ok {
+		return nil, "", &Error{Op: "client hello", Err: ErrProtocol}
+	}
+	version, ok := selectVersion(SupportedVersions, versions)
+	if !ok {
+		return nil, "", &Error{Op: "client hello", Err: ErrUnsupportedVersion}
+	}
+	offered, rest, ok := readField(rest)
+	if !ok {
+		return nil, "", &Error{Op: "client hello", Err: ErrProtocol}
+	}
+	uuid, rest, ok := readField(rest)
+	if !ok || len(uuid) == 0 {
+		return nil, "", &Error{Op: "client hello", Err: ErrProtocol}
+	}
+	join, rest, ok := readField(rest)
+	if !ok || len(rest) != proxy.KEX_PUBLIC_KEY_SIZE {
+		return nil, string(uuid), &Error{Op: "client hello", Err: ErrProtocol}
+	}
+	peerPublic := rest
+	suite, ok := proxy.SelectCipherSuite(cfg.cipherSuites(), offered)
+	if !ok {
+		return nil, string(uuid), &Error{Op: "client hello", Err: ErrNoCipherSuite}
+	}
+	kex.AddTranscript(msg)
+	//未知用户使用随机密码继续握手，在确认阶段失败，避免暴露uuid是否存在
+	password, known := auth.Password(string(uuid))
+	if !known {
+		var random [32]byte
+		if _, err := io.ReadFull(rand.Reader, random[:]); err != nil {
+			return nil, string(uuid), &Error{Op: "key exchange", Err: err}
+		}
+		password = string(random[:])
+	}
+
+	payload = append([]byte{version, suite}, kex.PublicKey()...)
+	msg, err = writeMsg(c, MSG_SERVER_HELLO, payload)
+	if err != nil {
+		return nil, string(uuid), &Error{Op: "server hello", Err: err}
+	}
+	kex.AddTranscript(msg)
+	keys, err := kex.Finish(peerPublic, password)
+	if err != nil {
+		return nil, string(uuid), &Error{Op: "key exchange", Err: err}
+	}
+
+	//客户端必须先证明持有密码，服务端才发送确认值
+	_, payload, err = readMsg(c, MSG_CLIENT_DONE)
+	if err != nil {
+		return nil, string(uuid), &Error{Op: "client done", Err: err}
+	}
+	if !known {
+		return nil, string(uuid), &Error{Op: "client done", Err: ErrUnknownUser}
+	}
+	if err := keys.VerifyFinished(false, payload); err != nil {
+		return nil, string(uuid), &Error{Op: "client done", Err: ErrAuthFailed}
+	}
+	//认证通过后再查找会话，避免暴露会话是否存在
+	session, linkID, err := cfg.lookupSession(string(uuid), join)
+	if err != nil {
+		return nil, string(uuid), &Error{Op: "client done", Err: err}
+	}
+	token := []byte(nil)
+	if session != nil {
+		token = session.Token()
+	} else if token, err = newToken(); err != nil {
+		return nil, string(uuid), &Error{Op: "server done", Err: err}
+	}
+	cp, err := keys.Cipher(suite, false)
+	if err != nil {
+		return nil, string(uuid), &Error{Op: "cipher", Err: err}
+	}
+	if _, err := writeMsg(c, MSG_SERVER_DONE, append(keys.Finished(false), token...)); err != nil {
+		return nil, string(uuid), &Error{Op: "server done", Err: err}
+	}
+	p, err := cfg.newProxy(c, cp, token, session, linkID)
+	if err != nil {
+		return nil, string(uuid), &Error{Op: "join", Err: err}
+	}
+	return p, string(uuid), nil
+}
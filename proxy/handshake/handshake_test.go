@@ -0,0 +1,352 @@
+// Copyright 2019 The goproxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package handshake
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/idste/goproxy/proxy"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+//测试用户
+var testUsers = AuthenticatorFunc(func(uuid string) (string, bool) {
+	if uuid == "alice" {
+		return "secret", true
+	}
+	return "", false
+})
+
+//握手结果
+type handshakeResult struct {
+	client *proxy.Proxy
+	server *proxy.Proxy
+	uuid   string
+	cerr   error
+	serr   error
+}
+
+//关闭握手成功的会话
+func (r *handshakeResult) close() {
+	if r.client != nil {
+		r.client.Close()
+	}
+	if r.server != nil {
+		r.server.Close()
+	}
+}
+
+//本地TCP连接对
+func testConnPair(t testing.TB) (net.Conn, net.Conn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	ch := make(chan net.Conn, 1)
+	go func() {
+		c, _ := l.Accept()
+		ch <- c
+	}()
+	c1, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2 := <-ch
+	if c2 == nil {
+		t.Fatal("accept failed")
+	}
+	return c1, c2
+}
+
+//测试用握手参数，会话日志不输出
+func testConfig(id uint32) *Config {
+	return &Config{
+		ID:         id,
+		Timeout:    5 * time.Second,
+		BufferPool: proxy.NewBufferPool(64),
+		Options:    []proxy.Option{proxy.WithLogger(proxy.NewTextLogger(ioutil.Discard, proxy.LEVEL_WARN))},
+	}
+}
+
+//在新的连接对上同时运行客户端和服务端握手，失败的一端关闭连接
+func testHandshake(t testing.TB, creds *Credentials, ccfg, scfg *Config) *handshakeResult {
+	t.Helper()
+	c1, c2 := testConnPair(t)
+	r := &handshakeResult{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if r.server, r.uuid, r.serr = ServerHandshake(c2, testUsers, scfg); r.serr != nil {
+			c2.Close()
+		}
+	}()
+	if r.client, r.cerr = ClientHandshake(c1, creds, ccfg); r.cerr != nil {
+		c1.Close()
+	}
+	<-done
+	return r
+}
+
+//经会话连接本地回显服务，确认双方加密对象一致
+func testSession(t *testing.T, client *proxy.Proxy) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(c, c)
+		c.Close()
+	}()
+	c, err := client.Dial(context.Background(), "tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("echo: %q, %v", buf, err)
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	r := testHandshake(t, &Credentials{UUID: "alice", Password: "secret"}, testConfig(1), testConfig(2))
+	defer r.close()
+	if r.cerr != nil || r.serr != nil {
+		t.Fatalf("client: %v, server: %v", r.cerr, r.serr)
+	}
+	if r.uuid != "alice" {
+		t.Fatalf("uuid = %q", r.uuid)
+	}
+	if len(r.client.Token()) != proxy.SESSION_TOKEN_SIZE || !bytes.Equal(r.client.Token(), r.server.Token()) {
+		t.Fatalf("tokens %x %x", r.client.Token(), r.server.Token())
+	}
+	go r.client.Handle()
+	go r.server.Handle()
+	testSession(t, r.client)
+}
+
+func TestHandshakeErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		creds  Credentials
+		client []byte
+		server []byte
+		cerr   error
+		serr   error
+	}{
+		{"password", Credentials{"alice", "Secret"}, nil, nil, ErrAuthFailed, ErrAuthFailed},
+		//未知用户与密码错误对客户端不可区分
+		{"user", Credentials{"bob", "secret"}, nil, nil, ErrAuthFailed, ErrUnknownUser},
+		{"cipher", Credentials{"alice", "secret"}, []byte{proxy.CIPHER_AES_128_GCM}, []byte{proxy.CIPHER_CHACHA20_POLY1305}, ErrNoCipherSuite, ErrNoCipherSuite},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ccfg, scfg := testConfig(1), testConfig(2)
+			ccfg.CipherSuites, scfg.CipherSuites = tt.client, tt.server
+			creds := tt.creds
+			r := testHandshake(t, &creds, ccfg, scfg)
+			defer r.close()
+			if !errors.Is(r.cerr, tt.cerr) {
+				t.Errorf("client: got %v, want %v", r.cerr, tt.cerr)
+			}
+			if !errors.Is(r.serr, tt.serr) {
+				t.Errorf("server: got %v, want %v", r.serr, tt.serr)
+			}
+			var herr *Error
+			if !errors.As(r.serr, &herr) || herr.Op == "" {
+				t.Errorf("server error %v is not a *Error", r.serr)
+			}
+		})
+	}
+}
+
+//Config.CipherSuites为空时使用Options中的会话参数
+func TestHandshakeConfigCipherSuites(t *testing.T) {
+	creds := &Credentials{UUID: "alice", Password: "secret"}
+	ccfg, scfg := testConfig(1), testConfig(2)
+	ccfg.Options = append(ccfg.Options, proxy.WithCipherSuites([]byte{proxy.CIPHER_AES_256_GCM}))
+	scfg.Options = append(scfg.Options, proxy.WithCipherSuites([]byte{proxy.CIPHER_CHACHA20_POLY1305}))
+	r := testHandshake(t, creds, ccfg, scfg)
+	r.close()
+	if !errors.Is(r.cerr, ErrNoCipherSuite) || !errors.Is(r.serr, ErrNoCipherSuite) {
+		t.Fatalf("client: %v, server: %v, want ErrNoCipherSuite", r.cerr, r.serr)
+	}
+	//握手参数中的套件优先
+	scfg.CipherSuites = []byte{proxy.CIPHER_AES_256_GCM}
+	r = testHandshake(t, creds, ccfg, scfg)
+	defer r.close()
+	if r.cerr != nil || r.serr != nil {
+		t.Fatalf("client: %v, server: %v", r.cerr, r.serr)
+	}
+	go r.client.Handle()
+	go r.server.Handle()
+	testSession(t, r.client)
+}
+
+//服务端按本端优先级选择版本和加密套件，不支持的版本以ALERT拒绝
+func TestHandshakeNegotiation(t *testing.T) {
+	tests := []struct {
+		versions []byte
+		offered  []byte
+		server   []byte
+		suite    byte
+		err      error
+	}{
+		{[]byte{VERSION_4}, []byte{proxy.CIPHER_CHACHA20_POLY1305, proxy.CIPHER_AES_128_GCM}, nil, proxy.CIPHER_AES_128_GCM, nil},
+		{[]byte{VERSION_4}, []byte{proxy.CIPHER_AES_128_GCM, proxy.CIPHER_AES_256_GCM}, []byte{proxy.CIPHER_AES_256_GCM, proxy.CIPHER_AES_128_GCM}, proxy.CIPHER_AES_256_GCM, nil},
+		{[]byte{5, VERSION_4, 3}, []byte{proxy.CIPHER_CHACHA20_POLY1305}, nil, proxy.CIPHER_CHACHA20_POLY1305, nil},
+		{[]byte{3}, proxy.DefaultCipherSuites, nil, 0, ErrUnsupportedVersion},
+		{nil, proxy.DefaultCipherSuites, nil, 0, ErrUnsupportedVersion},
+	}
+	for _, tt := range tests {
+		c1, c2 := testConnPair(t)
+		scfg := testConfig(2)
+		scfg.CipherSuites = tt.server
+		done := make(chan error, 1)
+		go func() {
+			_, _, err := ServerHandshake(c2, testUsers, scfg)
+			c2.Close()
+			done <- err
+		}()
+		kex, err := proxy.NewKeyExchange()
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload := appendField(nil, tt.versions)
+		payload = appendField(payload, tt.offered)
+		payload = appendField(payload, []byte("alice"))
+		payload = appendField(payload, nil)
+		payload = append(payload, kex.PublicKey()...)
+		if _, err := writeMsg(c1, MSG_CLIENT_HELLO, payload); err != nil {
+			t.Fatal(err)
+		}
+		_, payload, err = readMsg(c1, MSG_SERVER_HELLO)
+		c1.Close()
+		serr := <-done
+		if tt.err != nil {
+			if err != tt.err || !errors.Is(serr, tt.err) {
+				t.Errorf("versions %v: client %v, server %v, want %v", tt.versions, err, serr, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("versions %v: %v", tt.versions, err)
+		}
+		if payload[0] != VERSION_4 || payload[1] != tt.suite {
+			t.Errorf("versions %v, suites %v: selected version %d, suite %d, want %d, %d", tt.versions, tt.offered, payload[0], payload[1], VERSION_4, tt.suite)
+		}
+	}
+}
+
+//附加主连接出示会话令牌加入已有会话
+func TestHandshakeJoin(t *testing.T) {
+	creds := &Credentials{UUID: "alice", Password: "secret"}
+	r := testHandshake(t, creds, testConfig(1), testConfig(2))
+	defer r.close()
+	if r.cerr != nil || r.serr != nil {
+		t.Fatalf("client: %v, server: %v", r.cerr, r.serr)
+	}
+	go r.client.Handle()
+	go r.server.Handle()
+	sessions := func(uuid string) *proxy.Proxy {
+		if uuid == "alice" {
+			return r.server
+		}
+		return nil
+	}
+	ccfg, scfg := testConfig(1), testConfig(2)
+	ccfg.Join, scfg.Session = r.client, sessions
+	r2 := testHandshake(t, creds, ccfg, scfg)
+	if r2.cerr != nil || r2.serr != nil {
+		t.Fatalf("join client: %v, server: %v", r2.cerr, r2.serr)
+	}
+	if r2.client != r.client || r2.server != r.server {
+		t.Fatal("join created a new session")
+	}
+	//附加主连接由会话写go程异步启用
+	for deadline := time.Now().Add(5 * time.Second); r.client.Links() != 2 || r.server.Links() != 2; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("links %d %d, want 2", r.client.Links(), r.server.Links())
+		}
+	}
+	testSession(t, r.client)
+
+	//令牌不符时拒绝加入
+	other := testHandshake(t, creds, testConfig(3), testConfig(4))
+	defer other.close()
+	if other.cerr != nil || other.serr != nil {
+		t.Fatalf("client: %v, server: %v", other.cerr, other.serr)
+	}
+	ccfg, scfg = testConfig(3), testConfig(4)
+	ccfg.Join, scfg.Session = other.client, sessions
+	r3 := testHandshake(t, creds, ccfg, scfg)
+	if !errors.Is(r3.cerr, ErrSessionNotFound) || !errors.Is(r3.serr, ErrSessionNotFound) {
+		t.Fatalf("client: %v, server: %v, want ErrSessionNotFound", r3.cerr, r3.serr)
+	}
+	//服务端不支持加入
+	ccfg, scfg = testConfig(1), testConfig(2)
+	ccfg.Join = r.client
+	r4 := testHandshake(t, creds, ccfg, scfg)
+	if !errors.Is(r4.cerr, ErrSessionNotFound) || !errors.Is(r4.serr, ErrSessionNotFound) {
+		t.Fatalf("client: %v, server: %v, want ErrSessionNotFound", r4.cerr, r4.serr)
+	}
+}
+
+func TestHandshakeUUID(t *testing.T) {
+	c1, c2 := testConnPair(t)
+	defer c1.Close()
+	defer c2.Close()
+	for _, uuid := range []string{"", string(make([]byte, 256))} {
+		if _, err := ClientHandshake(c1, &Credentials{UUID: uuid}, testConfig(1)); !errors.Is(err, ErrProtocol) {
+			t.Errorf("uuid length %d: got %v, want ErrProtocol", len(uuid), err)
+		}
+	}
+}
+
+//会话字段由令牌和小端主连接ID组成
+func TestJoinField(t *testing.T) {
+	r := testHandshake(t, &Credentials{UUID: "alice", Password: "secret"}, testConfig(1), testConfig(2))
+	defer r.close()
+	if r.cerr != nil || r.serr != nil {
+		t.Fatalf("client: %v, server: %v", r.cerr, r.serr)
+	}
+	if field, id := (&Config{}).joinField(); field != nil || id != 0 {
+		t.Fatalf("joinField without session = %x, %d", field, id)
+	}
+	field, id := (&Config{Join: r.client}).joinField()
+	if len(field) != JOIN_FIELD_SIZE || !bytes.Equal(field[:JOIN_LINK_ID_OFFSET], r.client.Token()) {
+		t.Fatalf("joinField = %x", field)
+	}
+	scfg := &Config{Session: func(uuid string) *proxy.Proxy { return r.server }}
+	p, got, err := scfg.lookupSession("alice", field)
+	if err != nil || p != r.server || got != id {
+		t.Fatalf("lookupSession = %p, %d, %v, want %p, %d", p, got, err, r.server, id)
+	}
+	if _, _, err := scfg.lookupSession("alice", field[:JOIN_FIELD_SIZE-1]); err != ErrProtocol {
+		t.Errorf("short field: got %v, want ErrProtocol", err)
+	}
+	tampered := append([]byte{}, field...)
+	tampered[0] ^= 0x01
+	if _, _, err := scfg.lookupSession("alice", tampered); err != ErrSessionNotFound {
+		t.Errorf("tampered token: got %v, want ErrSessionNotFound", err)
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2019 The goproxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package handshake
+
+import (
+	"io"
+)
+
+//握手消息格式: [类型 1字节][数据长度 2字节 小端][数据]
+const (
+	MSG_HEAD_SIZE    = 3
+	MSG_MAX_SIZE     = 1024
+	MSG_CLIENT_HELLO = 1
+	MSG_SERVER_HELLO = 2
+	MSG_CLIENT_DONE  = 3
+	MSG_SERVER_DONE  = 4
+	MSG_ALERT        = 5
+	//TLS主连接使用的协商消息
+	MSG_TLS_CLIENT_HELLO = 6
+	MSG_TLS_SERVER_HELLO = 7
+)
+
+//MSG_ALERT携带的错误码
+const (
+	ALERT_PROTOCOL            = 1
+	ALERT_UNSUPPORTED_VERSION = 2
+	ALERT_NO_CIPHER_SUITE     = 3
+	ALERT_AUTH_FAILED         = 4
+	ALERT_SESSION_NOT_FOUND   = 5
+)
+
+//组装消息
+func buildMsg(t byte, payload []byte) []byte {
+	msg := make([]byte, MSG_HEAD_SIZE, MSG_HEAD_SIZE+len(payload))
+	msg[0] = t
+	msg[1] = byte(len(payload))
+	msg[2] = byte(len(payload) >> 8)
+	return append(msg, payload...)
+}
+
+//发送消息，返回完整消息用于计入握手记录
+func writeMsg(w io.Writer, t byte, payload []byte) ([]byte, error) {
+	if len(payload) > MSG_MAX_SIZE {
+		return nil, ErrProtocol
+	}
+	msg := buildMsg(t, payload)
+	if _, err := w.Write(msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+//读取完整消息，不依赖单次Read返回的数据量
+//收到MSG_ALERT时返回对应的错误
+//@want 期望的消息类型
+//return msg完整消息，payload数据区
+func readMsg(r io.Reader, want byte) (msg []byte, payload []byte, err error) {
+	head := make([]byte, MSG_HEAD_SIZE)
+	if _, err = io.ReadFull(r, head); err != nil {
+		return nil, nil, err
+	}
+	size := int(head[1]) + int(head[2])<<8
+	if size > MSG_MAX_SIZE {
+		return nil, nil, ErrProtocol
+	}
+	msg = make([]byte, MSG_HEAD_SIZE+size)
+	copy(msg, head)
+	if _, err = io.ReadFull(r, msg[MSG_HEAD_SIZE:]); err != nil {
+		return nil, nil, err
+	}
+	payload = msg[MSG_HEAD_SIZE:]
+	if head[0] == MSG_ALERT && len(payload) == 1 {
+		return nil, nil, alertError(payload[0])
+	}
+	if head[0] != want {
+		return nil, nil, ErrProtocol
+	}
+	return msg, payload, nil
+}
+
+//读取1字节长度前缀的字段
+//return field字段，rest剩余数据
+func readField(b []byte) (field []byte, rest []byte, ok bool) {
+	if len(b) < 1 || len(b) < 1+int(b[0]) {
+		return nil, nil, false
+	}
+	return b[1 : 1+int(b[0])], b[1+int(b[0]):], true
+}
+
+//追加1字节长度前缀的字段
+func appendField(b []byte, field []byte) []byte {
+	b = append(b, byte(len(field)))
+	return append(b, field...)
+}
@@ -0,0 +1,252 @@
+// Copyright 2019 The goproxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package handshake
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/idste/goproxy/proxy"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+/*
+TLS 1.3双向认证主连接，身份由客户端证书确定，不再使用uuid和密码
+TLS握手完成后在TLS连接上交换TLS_CLIENT_HELLO/TLS_SERVER_HELLO完成版本和加密套件协商，
+TLS_CLIENT_HELLO携带与ClientHandshake相同的会话字段，TLS_SERVER_HELLO返回会话令牌，
+帧加密密钥由TLS导出密钥(RFC 8446 7.5)派生，并绑定协商消息
+帧加密不因TLS省略，两种方式登录的主连接可以加入同一会话，所有主连接使用相同的帧格式和收发处理，
+代价是每帧多一次AEAD运算，对吞吐量的影响见bench_test.go中的BenchmarkLoopbackPassword和BenchmarkLoopbackTLS
+*/
+
+var (
+	ErrNoClientCertificate = errors.New("handshake: no client certificate")
+)
+
+//CertAuthenticator 服务端由已校验的客户端证书确定uuid
+type CertAuthenticator interface {
+	Identify(cert *x509.Certificate) (uuid string, ok bool)
+}
+
+//CertAuthenticatorFunc 以函数实现CertAuthenticator
+type CertAuthenticatorFunc func(cert *x509.Certificate) (uuid string, ok bool)
+
+func (f CertAuthenticatorFunc) Identify(cert *x509.Certificate) (string, bool) {
+	return f(cert)
+}
+
+//读取PEM格式证书池
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in %s", path)
+	}
+	return pool, nil
+}
+
+//ServerTLSConfig由PEM文件创建要求并校验客户端证书的TLS 1.3服务端配置
+//@clientCAFile 签发客户端证书的CA
+func ServerTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := loadCertPool(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS13,
+	}, nil
+}
+
+//ClientTLSConfig由PEM文件创建携带客户端证书的TLS 1.3客户端配置
+//@caFile 签发服务端证书的CA，为空时使用系统证书池
+//@serverName 服务端证书名称，为空时使用连接地址
+func ClientTLSConfig(certFile, keyFile, caFile, serverName string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ServerName:   serverName,
+		MinVersion:   tls.VersionTLS13,
+	}
+	if caFile != "" {
+		if cfg.RootCAs, err = loadCertPool(caFile); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+//由TLS导出密钥创建帧加密对象，导出上下文为协商消息的哈希
+func tlsCipher(state tls.ConnectionState, transcript []byte, suite byte, initiator bool) (*proxy.Cipher, error) {
+	th := sha256.Sum256(transcript)
+	secret, err := state.ExportKeyingMaterial("EXPORTER-goproxy frame keys", th[:], 32)
+	if err != nil {
+		return nil, err
+	}
+	sendKey, recvKey, err := proxy.DeriveKeys(suite, secret, initiator)
+	if err != nil {
+		return nil, err
+	}
+	return proxy.NewCipher(suite, sendKey, recvKey)
+}
+
+//强制TLS 1.3
+func tls13(config *tls.Config) *tls.Config {
+	config = config.Clone()
+	if config.MinVersion < tls.VersionTLS13 {
+		config.MinVersion = tls.VersionTLS13
+	}
+	return config
+}
+
+//ClientHandshakeTLS在已建立的TCP主连接上完成TLS 1.3双向认证和客户端握手
+//返回的proxy.Proxy以TLS连接作为主连接，失败时不关闭连接
+//@config 需包含客户端证书，见ClientTLSConfig
+func ClientHandshakeTLS(c net.Conn, config *tls.Config, cfg *Config) (*proxy.Proxy, error) {
+	if len(config.Certificates) == 0 && config.GetClientCertificate == nil {
+		return nil, &Error{Op: "tls", Err: ErrNoClientCertificate}
+	}
+	_ = c.SetDeadline(time.Now().Add(cfg.timeout()))
+	defer c.SetDeadline(time.Time{})
+	tc := tls.Client(c, tls13(config))
+	if err := tc.Handshake(); err != nil {
+		return nil, &Error{Op: "tls", Err: err}
+	}
+	suites := cfg.cipherSuites()
+	join, linkID := cfg.joinField()
+	payload := appendField(nil, SupportedVersions)
+	payload = appendField(payload, suites)
+	payload = appendField(payload, join)
+	hello, err := writeMsg(tc, MSG_TLS_CLIENT_HELLO, payload)
+	if err != nil {
+		return nil, &Error{Op: "client hello", Err: err}
+	}
+	msg, payload, err := readMsg(tc, MSG_TLS_SERVER_HELLO)
+	if err != nil {
+		return nil, &Error{Op: "server hello", Err: err}
+	}
+	if len(payload) != 2+proxy.SESSION_TOKEN_SIZE {
+		return nil, &Error{Op: "server hello", Err: ErrProtocol}
+	}
+	if _, ok := selectVersion(SupportedVersions, payload[0:1]); !ok {
+		return nil, &Error{Op: "server hello", Err: ErrUnsupportedVersion}
+	}
+	suite, ok := proxy.SelectCipherSuite(suites, payload[1:2])
+	if !ok {
+		return nil, &Error{Op: "server hello", Err: ErrNoCipherSuite}
+	}
+	token := payload[2:]
+	if cfg.Join != nil && !bytes.Equal(token, cfg.Join.Token()) {
+		return nil, &Error{Op: "server hello", Err: ErrSessionNotFound}
+	}
+	cp, err := tlsCipher(tc.ConnectionState(), append(hello, msg...), suite, true)
+	if err != nil {
+		return nil, &Error{Op: "cipher", Err: err}
+	}
+	p, err := cfg.newProxy(tc, cp, token, cfg.Join, linkID)
+	if err != nil {
+		return nil, &Error{Op: "join", Err: err}
+	}
+	return p, nil
+}
+
+//ServerHandshakeTLS在已接受的TCP主连接上完成TLS 1.3双向认证和服务端握手
+//客户端证书由TLS层按config校验，再由auth映射为uuid
+//成功返回以TLS连接作为主连接的proxy.Proxy和客户端uuid，失败时不关闭连接
+//@config 需设置ClientCAs，见ServerTLSConfig
+func ServerHandshakeTLS(c net.Conn, config *tls.Config, auth CertAuthenticator, cfg *Config) (*proxy.Proxy, string, error) {
+	_ = c.SetDeadline(time.Now().Add(cfg.timeout()))
+	defer c.SetDeadline(time.Time{})
+	config = tls13(config)
+	if config.ClientAuth < tls.RequireAnyClientCert {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	tc := tls.Server(c, config)
+	if err := tc.Handshake(); err != nil {
+		return nil, "", &Error{Op: "tls", Err: err}
+	}
+	p, uuid, err := serverHandshakeTLS(tc, auth, cfg)
+	if err != nil {
+		_, _ = writeMsg(tc, MSG_ALERT, []byte{alertCode(err)})
+		return nil, uuid, err
+	}
+	return p, uuid, nil
+}
+
+func serverHandshakeTLS(tc *tls.Conn, auth CertAuthenticator, cfg *Config) (*proxy.Proxy, string, error) {
+	state := tc.ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		return nil, "", &Error{Op: "tls", Err: ErrNoClientCertificate}
+	}
+	uuid, ok := auth.Identify(state.PeerCertificates[0])
+	if !ok {
+		return nil, "", &Error{Op: "tls", Err: fmt.Errorf("%w: %s", ErrUnknownUser, state.PeerCertificates[0].Subject.CommonName)}
+	}
+	hello, payload, err := readMsg(tc, MSG_TLS_CLIENT_HELLO)
+	if err != nil {
+		return nil, uuid, &Error{Op: "client hello", Err: err}
+	}
+	//先协商版本，其余字段格式可能随版本变化
+	versions, rest, ok := readField(payload)
+	if !ok {
+		return nil, uuid, &Error{Op: "client hello", Err: ErrProtocol}
+	}
+	version, ok := selectVersion(SupportedVersions, versions)
+	if !ok {
+		return nil, uuid, &Error{Op: "client hello", Err: ErrUnsupportedVersion}
+	}
+	offered, rest, ok := readField(rest)
+	if !ok {
+		return nil, uuid, &Error{Op: "client hello", Err: ErrProtocol}
+	}
+	join, rest, ok := readField(rest)
+	if !ok || len(rest) != 0 {
+		return nil, uuid, &Error{Op: "client hello", Err: ErrProtocol}
+	}
+	suite, ok := proxy.SelectCipherSuite(cfg.cipherSuites(), offered)
+	if !ok {
+		return nil, uuid, &Error{Op: "client hello", Err: ErrNoCipherSuite}
+	}
+	session, linkID, err := cfg.lookupSession(uuid, join)
+	if err != nil {
+		return nil, uuid, &Error{Op: "client hello", Err: err}
+	}
+	token := []byte(nil)
+	if session != nil {
+		token = session.Token()
+	} else if token, err = newToken(); err != nil {
+		return nil, uuid, &Error{Op: "server hello", Err: err}
+	}
+	msg, err := writeMsg(tc, MSG_TLS_SERVER_HELLO, append([]byte{version, suite}, token...))
+	if err != nil {
+		return nil, uuid, &Error{Op: "server hello", Err: err}
+	}
+	cp, err := tlsCipher(state, append(hello, msg...), suite, false)
+	if err != nil {
+		return nil, uuid, &Error{Op: "cipher", Err: err}
+	}
+	p, err := cfg.newProxy(tc, cp, token, session, linkID)
+	if err != nil {
+		return nil, uuid, &Error{Op: "join", Err: err}
+	}
+	return p, uuid, nil
+}
@@ -0,0 +1,155 @@
+// Copyright 2019 The goproxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package handshake
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"github.com/idste/goproxy/proxy"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+//由证书CommonName确定uuid
+var testIdentify = CertAuthenticatorFunc(func(cert *x509.Certificate) (string, bool) {
+	if cert.Subject.CommonName == "alice" {
+		return "alice", true
+	}
+	return "", false
+})
+
+//签发证书，parent为nil时自签名
+func testCert(t testing.TB, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, tls.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{cn},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}
+}
+
+//由同一CA签发的服务端配置和客户端配置
+//@cn 客户端证书名称
+func testTLSConfigs(t testing.TB, cn string) (*tls.Config, *tls.Config) {
+	t.Helper()
+	ca, caCert := testCert(t, "test ca", nil, nil)
+	caKey := caCert.PrivateKey.(*ecdsa.PrivateKey)
+	_, serverCert := testCert(t, "localhost", ca, caKey)
+	_, clientCert := testCert(t, cn, ca, caKey)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	server := &tls.Config{Certificates: []tls.Certificate{serverCert}, ClientCAs: pool}
+	client := &tls.Config{Certificates: []tls.Certificate{clientCert}, RootCAs: pool, ServerName: "localhost"}
+	return server, client
+}
+
+//在新的连接对上同时运行TLS客户端和服务端握手，失败的一端关闭连接
+func testHandshakeTLS(t testing.TB, server, client *tls.Config, ccfg, scfg *Config) *handshakeResult {
+	t.Helper()
+	c1, c2 := testConnPair(t)
+	r := &handshakeResult{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if r.server, r.uuid, r.serr = ServerHandshakeTLS(c2, server, testIdentify, scfg); r.serr != nil {
+			c2.Close()
+		}
+	}()
+	if r.client, r.cerr = ClientHandshakeTLS(c1, client, ccfg); r.cerr != nil {
+		c1.Close()
+	}
+	<-done
+	return r
+}
+
+func TestHandshakeTLS(t *testing.T) {
+	server, client := testTLSConfigs(t, "alice")
+	r := testHandshakeTLS(t, server, client, testConfig(1), testConfig(2))
+	defer r.close()
+	if r.cerr != nil || r.serr != nil {
+		t.Fatalf("client: %v, server: %v", r.cerr, r.serr)
+	}
+	if r.uuid != "alice" {
+		t.Fatalf("uuid = %q", r.uuid)
+	}
+	go r.client.Handle()
+	go r.server.Handle()
+	testSession(t, r.client)
+
+	//uuid和密码认证的主连接可以加入TLS登录的会话，两种主连接使用相同的帧格式
+	ccfg, scfg := testConfig(1), testConfig(2)
+	ccfg.Join = r.client
+	scfg.Session = func(uuid string) *proxy.Proxy { return r.server }
+	r2 := testHandshake(t, &Credentials{UUID: "alice", Password: "secret"}, ccfg, scfg)
+	if r2.cerr != nil || r2.serr != nil {
+		t.Fatalf("join client: %v, server: %v", r2.cerr, r2.serr)
+	}
+	for deadline := time.Now().Add(5 * time.Second); r.client.Links() != 2 || r.server.Links() != 2; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("links %d %d, want 2", r.client.Links(), r.server.Links())
+		}
+	}
+	testSession(t, r.client)
+}
+
+func TestHandshakeTLSErrors(t *testing.T) {
+	//证书名称不对应任何用户
+	server, client := testTLSConfigs(t, "bob")
+	r := testHandshakeTLS(t, server, client, testConfig(1), testConfig(2))
+	defer r.close()
+	if !errors.Is(r.cerr, ErrAuthFailed) || !errors.Is(r.serr, ErrUnknownUser) {
+		t.Errorf("unknown identity: client %v, server %v", r.cerr, r.serr)
+	}
+	//非同一CA签发的客户端证书在TLS握手阶段被拒绝
+	_, other := testTLSConfigs(t, "alice")
+	other.RootCAs = server.ClientCAs
+	r = testHandshakeTLS(t, server, other, testConfig(1), testConfig(2))
+	defer r.close()
+	if r.cerr == nil || r.serr == nil {
+		t.Errorf("untrusted client certificate: client %v, server %v", r.cerr, r.serr)
+	}
+	//客户端未配置证书
+	c1, c2 := testConnPair(t)
+	defer c1.Close()
+	defer c2.Close()
+	if _, err := ClientHandshakeTLS(c1, &tls.Config{RootCAs: server.ClientCAs}, testConfig(1)); !errors.Is(err, ErrNoClientCertificate) {
+		t.Errorf("no client certificate: got %v", err)
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2019 The goproxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+/*
+HTTP代理监听，Listener.Kind为KIND_HTTP时解析客户端的CONNECT请求和绝对URI请求，
+经Dial由对端连接目的地址，Listener.Username不为空时校验Proxy-Authorization(Basic)
+绝对URI请求以origin-form转发并附加Connection: close，每个连接只处理一个请求
+*/
+
+const (
+	KIND_HTTP = "http"
+	//请求头读取及对端连接超时
+	HTTP_PROXY_TIMEOUT = 10 * time.Second
+)
+
+//逐跳头部，转发前删除
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+//读取时先读取bufio缓存中的数据，用于转发请求头之后已读入的数据
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+//发送错误应答
+func writeHTTPError(c net.Conn, code int, header string) {
+	_, _ = fmt.Fprintf(c, "HTTP/1.1 %d %s\r\n%sContent-Length: 0\r\nConnection: close\r\n\r\n", code, http.StatusText(code), header)
+}
+
+//校验Proxy-Authorization
+func (lsn *Listener) httpAuth(req *http.Request) bool {
+	if lsn.Username == "" {
+		return true
+	}
+	auth := req.Header.Get("Proxy-Authorization")
+	const prefix = "Basic "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return false
+	}
+	r := &http.Request{Header: http.Header{"Authorization": {auth}}}
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	userOk := subtle.ConstantTimeCompare([]byte(user), []byte(lsn.Username))
+	passOk := subtle.ConstantTimeCompare([]byte(pass), []byte(lsn.Password))
+	return userOk&passOk == 1
+}
+
+//处理HTTP代理监听接受的连接
+//@lsn 监听句柄，提供认证信息
+//@c 接受的连接
+func (p *Proxy) acceptHTTP(lsn *Listener, c net.Conn) {
+	_ = c.SetDeadline(time.Now().Add(HTTP_PROXY_TIMEOUT))
+	br := bufio.NewReader(c)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		writeHTTPError(c, http.StatusBadRequest, "")
+		c.Close()
+		return
+	}
+	if !lsn.httpAuth(req) {
+		writeHTTPError(c, http.StatusProxyAuthRequired, "Proxy-Authenticate: Basic realm=\"goproxy\"\r\n")
+		c.Close()
+		return
+	}
+	//请求头已读取，对端连接的时间由httpDial限制，超时后仍需发送504应答
+	_ = c.SetDeadline(time.Time{})
+	if req.Method == http.MethodConnect {
+		p.httpConnect(&bufferedConn{Conn: c, r: br}, req.Host)
+		return
+	}
+	if req.URL.Scheme != "http" || req.URL.Host == "" {
+		writeHTTPError(c, http.StatusBadRequest, "")
+		c.Close()
+		return
+	}
+	dest := req.URL.Host
+	if _, _, err := net.SplitHostPort(dest); err != nil {
+		dest = net.JoinHostPort(strings.Trim(dest, "[]"), "80")
+	}
+	conn, err := p.httpDial(c, dest)
+	if err != nil {
+		return
+	}
+	_ = c.SetDeadline(time.Time{})
+	for _, h := range hopHeaders {
+		req.Header.Del(h)
+	}
+	//请求体已由ReadRequest处理分块编码，Write时按需重新编码
+	req.Close = true
+	go func() {
+		//Write以origin-form发送请求行
+		if err := req.Write(conn); err != nil {
+			conn.Close()
+		}
+	}()
+	_, _ = io.Copy(c, conn)
+	c.Close()
+	conn.Close()
+}
+
+//CONNECT请求，应答200后双向转发
+func (p *Proxy) httpConnect(c net.Conn, dest string) {
+	conn, err := p.httpDial(c, dest)
+	if err != nil {
+		return
+	}
+	if _, err := io.WriteString(c, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		c.Close()
+		conn.Close()
+		return
+	}
+	_ = c.SetDeadline(time.Time{})
+	relay(c, conn)
+}
+
+//经对端连接目的地址，失败时应答502并关闭客户端连接
+func (p *Proxy) httpDial(c net.Conn, dest string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), HTTP_PROXY_TIMEOUT)
+	conn, err := p.Dial(ctx, "tcp", dest)
+	cancel()
+	if err != nil {
+		p.log.Warn("http proxy connect failed", "peer", c.RemoteAddr(), "forward", dest, "error", err)
+		code := http.StatusBadGateway
+		if err == context.DeadlineExceeded {
+			code = http.StatusGatewayTimeout
+		}
+		writeHTTPError(c, code, "")
+		c.Close()
+		return nil, err
+	}
+	return conn, nil
+}
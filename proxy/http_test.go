@@ -0,0 +1,204 @@
+// Copyright 2019 The goproxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+//经HTTP代理监听发送原始请求，返回应答
+func testHTTPRequest(t *testing.T, addr, req string) (*http.Response, net.Conn) {
+	t.Helper()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = c.SetDeadline(time.Now().Add(15 * time.Second))
+	if _, err := io.WriteString(c, req); err != nil {
+		c.Close()
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		c.Close()
+		t.Fatal(err)
+	}
+	return resp, c
+}
+
+//已关闭的本地端口，连接被拒绝
+func testRefusedAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func TestHTTPAuth(t *testing.T) {
+	basic := func(s string) string {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(s))
+	}
+	tests := []struct {
+		name     string
+		username string
+		auth     string
+		ok       bool
+	}{
+		{"no auth required", "", "", true},
+		{"ok", "user", basic("user:pass"), true},
+		{"scheme case", "user", "bAsIc " + base64.StdEncoding.EncodeToString([]byte("user:pass")), true},
+		{"missing", "user", "", false},
+		{"bad scheme", "user", "Bearer " + base64.StdEncoding.EncodeToString([]byte("user:pass")), false},
+		{"short", "user", "Basic", false},
+		{"bad base64", "user", "Basic dXNlcjpwYXNz!", false},
+		{"no colon", "user", basic("userpass"), false},
+		{"wrong password", "user", basic("user:Pass"), false},
+		{"wrong user", "user", basic("admin:pass"), false},
+	}
+	for _, tt := range tests {
+		lsn := &Listener{Username: tt.username, Password: "pass"}
+		req := &http.Request{Header: http.Header{}}
+		if tt.auth != "" {
+			req.Header.Set("Proxy-Authorization", tt.auth)
+		}
+		if ok := lsn.httpAuth(req); ok != tt.ok {
+			t.Errorf("%s: httpAuth = %v, want %v", tt.name, ok, tt.ok)
+		}
+	}
+}
+
+func TestHTTPConnect(t *testing.T) {
+	echo := testEchoServer(t)
+	defer echo.Close()
+	p1, p2 := testPair(t, nil, nil)
+	defer p1.Close()
+	defer p2.Close()
+	addr := testKindListener(t, p1, KIND_HTTP, "user", "pass")
+	auth := "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte("user:pass")) + "\r\n"
+	dest := echo.Addr().String()
+	resp, c := testHTTPRequest(t, addr, "CONNECT "+dest+" HTTP/1.1\r\nHost: "+dest+"\r\n"+auth+"\r\n")
+	defer c.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT status %d", resp.StatusCode)
+	}
+	if _, err := c.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("echo: %q, %v", buf, err)
+	}
+	tests := []struct {
+		name string
+		req  string
+		code int
+	}{
+		{"no auth", "CONNECT " + dest + " HTTP/1.1\r\nHost: " + dest + "\r\n\r\n", http.StatusProxyAuthRequired},
+		{"refused", "CONNECT " + testRefusedAddr(t) + " HTTP/1.1\r\n" + auth + "\r\n", http.StatusBadGateway},
+		{"relative uri", "GET /index.html HTTP/1.1\r\nHost: " + dest + "\r\n" + auth + "\r\n", http.StatusBadRequest},
+		{"https uri", "GET https://" + dest + "/ HTTP/1.1\r\n" + auth + "\r\n", http.StatusBadRequest},
+		{"bad request", "GARBAGE\r\n\r\n", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		resp, c := testHTTPRequest(t, addr, tt.req)
+		c.Close()
+		if resp.StatusCode != tt.code {
+			t.Errorf("%s: status %d, want %d", tt.name, resp.StatusCode, tt.code)
+		}
+		if tt.code == http.StatusProxyAuthRequired && resp.Header.Get("Proxy-Authenticate") == "" {
+			t.Errorf("%s: no Proxy-Authenticate header", tt.name)
+		}
+	}
+}
+
+//绝对URI请求以origin-form转发，逐跳头部被删除
+func TestHTTPForward(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	received := make(chan string, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		var head bytes.Buffer
+		r := bufio.NewReader(c)
+		for {
+			line, err := r.ReadString('\n')
+			head.WriteString(line)
+			if err != nil || line == "\r\n" {
+				break
+			}
+		}
+		received <- head.String()
+		_, _ = io.WriteString(c, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+	}()
+	p1, p2 := testPair(t, nil, nil)
+	defer p1.Close()
+	defer p2.Close()
+	addr := testKindListener(t, p1, KIND_HTTP, "", "")
+	dest := l.Addr().String()
+	resp, c := testHTTPRequest(t, addr, "GET http://"+dest+"/path?q=1 HTTP/1.1\r\nHost: "+dest+"\r\n"+
+		"Proxy-Authorization: Basic eDp5\r\nProxy-Connection: keep-alive\r\nConnection: keep-alive, X-Hop\r\n"+
+		"Keep-Alive: timeout=5\r\nTe: trailers\r\nUpgrade: websocket\r\nX-Test: 1\r\n\r\n")
+	defer c.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "ok" || err != nil {
+		t.Fatalf("status %d, body %q, %v", resp.StatusCode, body, err)
+	}
+	head := <-received
+	if !strings.HasPrefix(head, "GET /path?q=1 HTTP/1.1\r\n") {
+		t.Errorf("request line: %q", head)
+	}
+	for _, want := range []string{"Host: " + dest + "\r\n", "X-Test: 1\r\n", "Connection: close\r\n"} {
+		if !strings.Contains(head, want) {
+			t.Errorf("missing %q in %q", want, head)
+		}
+	}
+	for _, h := range []string{"Proxy-Authorization", "Proxy-Connection", "Keep-Alive", "Te:", "Upgrade", "keep-alive"} {
+		if strings.Contains(head, h) {
+			t.Errorf("hop-by-hop %q forwarded in %q", h, head)
+		}
+	}
+}
+
+//对端连接超过HTTP_PROXY_TIMEOUT未完成时应答504
+func TestHTTPGatewayTimeout(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for HTTP_PROXY_TIMEOUT")
+	}
+	//对端连接转发地址直至会话结束
+	hang := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	p1, p2 := testPair(t, nil, []Option{WithConfig(Config{Dial: hang, DialTimeout: 2 * HTTP_PROXY_TIMEOUT})})
+	defer p1.Close()
+	defer p2.Close()
+	addr := testKindListener(t, p1, KIND_HTTP, "", "")
+	resp, c := testHTTPRequest(t, addr, "CONNECT 192.0.2.1:443 HTTP/1.1\r\n\r\n")
+	c.Close()
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("status %d, want %d", resp.StatusCode, http.StatusGatewayTimeout)
+	}
+}
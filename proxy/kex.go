@@ -0,0 +1,135 @@
+// Copyright 2019 The goproxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"hash"
+	"io"
+)
+
+/*
+登录密钥交换，双方各生成一次性X25519密钥对，由ECDH共享密钥和预置密码共同派生会话密钥，
+双方以密码派生的密钥对完整握手记录计算HMAC互相确认，临时私钥在会话结束后即丢弃，
+即使密码日后泄露，也无法解密此前录制的会话(前向安全)
+*/
+
+const (
+	KEX_PUBLIC_KEY_SIZE = curve25519.PointSize
+	KEX_FINISHED_SIZE   = sha256.Size
+)
+
+var (
+	ErrKexPublicKey = errors.New("invalid key exchange public key")
+	ErrKexFinished  = errors.New("key exchange verification failed")
+)
+
+//KeyExchange 一次登录使用的临时密钥对和握手记录
+type KeyExchange struct {
+	private    [32]byte
+	public     []byte
+	transcript hash.Hash
+}
+
+//SessionKeys 密钥交换结果
+type SessionKeys struct {
+	//会话密钥，用于派生收发密钥
+	secret []byte
+	//发起端和响应端确认值
+	clientFinished []byte
+	serverFinished []byte
+}
+
+//NewKeyExchange生成一次性X25519密钥对
+func NewKeyExchange() (*KeyExchange, error) {
+	k := &KeyExchange{transcript: sha256.New()}
+	if _, err := io.ReadFull(rand.Reader, k.private[:]); err != nil {
+		return nil, err
+	}
+	public, err := curve25519.X25519(k.private[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	k.public = public
+	return k, nil
+}
+
+//PublicKey返回本端临时公钥
+func (k *KeyExchange) PublicKey() []byte {
+	return k.public
+}
+
+//AddTranscript将握手消息计入握手记录，双方必须按相同顺序计入相同消息
+func (k *KeyExchange) AddTranscript(msg []byte) {
+	k.transcript.Write(msg)
+}
+
+//Finish使用对端临时公钥和预置密码完成密钥交换
+//调用前需将双方公钥按收发顺序计入握手记录
+func (k *KeyExchange) Finish(peerPublic []byte, password string) (*SessionKeys, error) {
+	if len(peerPublic) != KEX_PUBLIC_KEY_SIZE {
+		return nil, ErrKexPublicKey
+	}
+	//对端公钥为低阶点时共享密钥全零，X25519返回错误
+	shared, err := curve25519.X25519(k.private[:], peerPublic)
+	if err != nil {
+		return nil, ErrKexPublicKey
+	}
+	for i := range k.private {
+		k.private[i] = 0
+	}
+	th := k.transcript.Sum(nil)
+	prk := hkdf.Extract(sha256.New, append(shared, password...), th)
+	keys := &SessionKeys{secret: make([]byte, 32)}
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, prk, []byte("goproxy session secret")), keys.secret); err != nil {
+		return nil, err
+	}
+	finishedKey := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, prk, []byte("goproxy finished")), finishedKey); err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, finishedKey)
+	mac.Write([]byte("client finished"))
+	mac.Write(th)
+	keys.clientFinished = mac.Sum(nil)
+	mac.Reset()
+	mac.Write([]byte("server finished"))
+	mac.Write(th)
+	keys.serverFinished = mac.Sum(nil)
+	return keys, nil
+}
+
+//Finished返回本端需要发送的确认值
+//@initiator 是否是发起连接的一端
+func (s *SessionKeys) Finished(initiator bool) []byte {
+	if initiator {
+		return s.clientFinished
+	}
+	return s.serverFinished
+}
+
+//VerifyFinished校验对端发送的确认值
+//@initiator 本端是否是发起连接的一端
+func (s *SessionKeys) VerifyFinished(initiator bool, finished []byte) error {
+	if !hmac.Equal(s.Finished(!initiator), finished) {
+		return ErrKexFinished
+	}
+	return nil
+}
+
+//Cipher由会话密钥创建帧加密对象
+//@initiator 本端是否是发起连接的一端
+func (s *SessionKeys) Cipher(suite byte, initiator bool) (*Cipher, error) {
+	sendKey, recvKey, err := DeriveKeys(suite, s.secret, initiator)
+	if err != nil {
+		return nil, err
+	}
+	return NewCipher(suite, sendKey, recvKey)
+}
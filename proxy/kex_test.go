@@ -0,0 +1,120 @@
+// Copyright 2019 The goproxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"bytes"
+	"testing"
+)
+
+//模拟一次登录的密钥交换，双方按相同顺序计入双方公钥
+//@tamper 修改发起端计入的第二条握手记录
+func testKeyExchange(t *testing.T, password1, password2 string, tamper bool) (*SessionKeys, *SessionKeys) {
+	t.Helper()
+	k1, err := NewKeyExchange()
+	if err != nil {
+		t.Fatal(err)
+	}
+	k2, err := NewKeyExchange()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(k1.PublicKey()) != KEX_PUBLIC_KEY_SIZE || bytes.Equal(k1.PublicKey(), k2.PublicKey()) {
+		t.Fatalf("bad public keys %x %x", k1.PublicKey(), k2.PublicKey())
+	}
+	k1.AddTranscript(k1.PublicKey())
+	k2.AddTranscript(k1.PublicKey())
+	if tamper {
+		k1.AddTranscript(append([]byte{0}, k2.PublicKey()...))
+	} else {
+		k1.AddTranscript(k2.PublicKey())
+	}
+	k2.AddTranscript(k2.PublicKey())
+	s1, err := k1.Finish(k2.PublicKey(), password1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2, err := k2.Finish(k1.PublicKey(), password2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s1, s2
+}
+
+func TestKeyExchange(t *testing.T) {
+	s1, s2 := testKeyExchange(t, "password", "password", false)
+	if len(s1.Finished(true)) != KEX_FINISHED_SIZE || bytes.Equal(s1.Finished(true), s1.Finished(false)) {
+		t.Fatal("client and server finished values must differ")
+	}
+	if err := s2.VerifyFinished(false, s1.Finished(true)); err != nil {
+		t.Fatalf("server verify: %v", err)
+	}
+	if err := s1.VerifyFinished(true, s2.Finished(false)); err != nil {
+		t.Fatalf("client verify: %v", err)
+	}
+	//对端回送本端的确认值不能通过校验
+	if err := s1.VerifyFinished(true, s1.Finished(true)); err != ErrKexFinished {
+		t.Fatalf("reflected finished: got %v, want ErrKexFinished", err)
+	}
+	//双方派生的加密对象可以互通
+	bp := NewBufferPool(16)
+	for _, suite := range DefaultCipherSuites {
+		cp1, err := s1.Cipher(suite, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cp2, err := s2.Cipher(suite, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range [][2]*Cipher{{cp1, cp2}, {cp2, cp1}} {
+			plain, err := testOpen(c[1], bp, testSeal(t, c[0], bp, PROXY_CMD_KEEPALIVE, []byte("ping")))
+			if err != nil || !bytes.Equal(plain[FRAME_HEAD_SIZE:], []byte("ping")) {
+				t.Fatalf("%s: %x, %v", CipherSuiteName(suite), plain, err)
+			}
+		}
+	}
+}
+
+//密码不同时双方都无法通过确认
+func TestKeyExchangeWrongPassword(t *testing.T) {
+	s1, s2 := testKeyExchange(t, "password", "Password", false)
+	if err := s2.VerifyFinished(false, s1.Finished(true)); err != ErrKexFinished {
+		t.Fatalf("server verify: got %v, want ErrKexFinished", err)
+	}
+	if err := s1.VerifyFinished(true, s2.Finished(false)); err != ErrKexFinished {
+		t.Fatalf("client verify: got %v, want ErrKexFinished", err)
+	}
+}
+
+//握手记录不一致时双方都无法通过确认
+func TestKeyExchangeTranscript(t *testing.T) {
+	s1, s2 := testKeyExchange(t, "password", "password", true)
+	if err := s2.VerifyFinished(false, s1.Finished(true)); err != ErrKexFinished {
+		t.Fatalf("server verify: got %v, want ErrKexFinished", err)
+	}
+	if err := s1.VerifyFinished(true, s2.Finished(false)); err != ErrKexFinished {
+		t.Fatalf("client verify: got %v, want ErrKexFinished", err)
+	}
+}
+
+func TestKeyExchangePublicKey(t *testing.T) {
+	for _, peer := range [][]byte{
+		nil,
+		make([]byte, KEX_PUBLIC_KEY_SIZE-1),
+		make([]byte, KEX_PUBLIC_KEY_SIZE+1),
+		//低阶点，共享密钥全零
+		make([]byte, KEX_PUBLIC_KEY_SIZE),
+		append([]byte{1}, make([]byte, KEX_PUBLIC_KEY_SIZE-1)...),
+	} {
+		k, err := NewKeyExchange()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := k.Finish(peer, "password"); err != ErrKexPublicKey {
+			t.Errorf("Finish(%x) = %v, want ErrKexPublicKey", peer, err)
+		}
+	}
+}
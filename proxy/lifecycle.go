@@ -0,0 +1,188 @@
+// Copyright 2019 The goproxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proxy
+
+/*
+会话生命周期
+Run运行会话并返回结束原因，取代NewProxy的exit回调；Close立即关闭会话，Shutdown平滑关闭会话:
+1. 关闭本端监听，不再接受新的子连接、Dial和监听请求，拒绝对端的NEW_CONNECT和NEW_LISTEN
+2. 向对端发送PROXY_CMD_GOAWAY，对端同样关闭监听、不再发起新的子连接，会话结束时返回ErrPeerGoAway
+3. 等待已有子连接结束、待发送的帧都被对端确认后关闭会话，ctx结束时强制关闭
+会话结束原因只记录第一个，见Proxy.Err；收到对端GOAWAY后会话因主连接断开等原因结束时，结束原因为ErrPeerGoAway
+*/
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+const (
+	//Shutdown检查子连接是否结束的间隔
+	SHUTDOWN_POLL_INTERVAL = 100 * time.Millisecond
+)
+
+var (
+	ErrShutdown     = errors.New("proxy shut down")
+	ErrShuttingDown = errors.New("proxy shutting down")
+	ErrPeerGoAway   = errors.New("peer going away")
+)
+
+//Run运行会话，会话结束后返回结束原因
+//本端Close返回ErrProxyClosed，Shutdown返回ErrShutdown，对端Shutdown返回ErrPeerGoAway，
+//主连接断开返回对应的错误，如ErrKeepaliveTimeout、ErrResumeTimeout，ctx结束时立即关闭会话并返回ctx.Err()
+func (p *Proxy) Run(ctx context.Context) error {
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			p.closeWithErr(ctx.Err())
+		case <-stop:
+		}
+	}()
+	p.write()
+	close(stop)
+	return p.Err()
+}
+
+//Close立即关闭会话，子连接随之关闭，可重复调用
+func (p *Proxy) Close() {
+	p.closeWithErr(ErrProxyClosed)
+}
+
+//记录结束原因并通知写go程退出
+func (p *Proxy) closeWithErr(err error) {
+	p.setErr(err)
+	p.quitOnce.Do(func() {
+		close(p.quit)
+	})
+}
+
+//Shutdown平滑关闭会话，等待已有子连接结束后关闭，会话结束后返回
+//ctx结束时强制关闭会话并返回ctx.Err()，会话已结束时返回nil
+func (p *Proxy) Shutdown(ctx context.Context) error {
+	if p.drain() {
+		p.log.Info("proxy shutting down")
+		//写go程可能已退出或发送通道已满，不阻塞在发送上
+		if b := p.buildCommand(false, 0, PROXY_CMD_GOAWAY, nil, nil); b != nil {
+			select {
+			case p.sendChan <- b:
+			case <-p.done:
+				p.bp.put(b)
+				return nil
+			case <-ctx.Done():
+				p.bp.put(b)
+				p.closeWithErr(ErrShutdown)
+				<-p.done
+				return ctx.Err()
+			}
+		}
+	}
+	ticker := time.NewTicker(SHUTDOWN_POLL_INTERVAL)
+	defer ticker.Stop()
+	//连续两次检查都满足时关闭，避免帧已从主连接队列取出但尚未计入未确认列表
+	for idle := 0; idle < 2; {
+		select {
+		case <-p.done:
+			return nil
+		case <-ctx.Done():
+			p.closeWithErr(ErrShutdown)
+			<-p.done
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		if p.drained() {
+			idle++
+		} else {
+			idle = 0
+		}
+	}
+	p.closeWithErr(ErrShutdown)
+	<-p.done
+	return nil
+}
+
+//进入关闭状态，关闭本端监听和进程内监听，已建立的子连接不受影响
+//return 是否首次进入关闭状态
+func (p *Proxy) drain() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.draining || p.closed {
+		return false
+	}
+	p.draining = true
+	for _, lsn := range p.listeners {
+		lsn.close()
+	}
+	for name, l := range p.pipeListeners {
+		l.shutdown()
+		delete(p.pipeListeners, name)
+	}
+	return true
+}
+
+//子连接都已结束，待发送的帧都已被对端确认
+func (p *Proxy) drained() bool {
+	if len(p.sendChan) > 0 || len(p.emergencyChan) > 0 {
+		return false
+	}
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	if len(p.clients) > 0 || len(p.subClients) > 0 {
+		return false
+	}
+	for _, l := range p.links {
+		select {
+		case <-l.quit:
+			continue
+		default:
+		}
+		if !l.flushed() {
+			return false
+		}
+	}
+	return true
+}
+
+//是否可以创建子连接和监听，调用时需持有mutex
+func (p *Proxy) acceptable() error {
+	if p.closed {
+		return ErrProxyClosed
+	}
+	if p.draining {
+		return ErrShuttingDown
+	}
+	return nil
+}
+
+//对端通过PROXY_CMD_GOAWAY通知即将关闭会话
+func (p *Proxy) peerGoAway() {
+	p.mutex.Lock()
+	p.goaway = true
+	p.mutex.Unlock()
+	p.drain()
+	p.log.Info("peer going away")
+}
+
+//会话结束时确定结束原因，只在写go程退出时调用
+//对端发送GOAWAY后非本端关闭的会话，结束原因为ErrPeerGoAway，本端Close、Shutdown或Run的ctx结束时保留本端的原因
+func (p *Proxy) publishGoAway() {
+	select {
+	case <-p.quit:
+		return
+	default:
+	}
+	p.mutex.Lock()
+	if p.goaway {
+		p.err = ErrPeerGoAway
+	}
+	p.mutex.Unlock()
+}
+
+//对端是否已发送PROXY_CMD_GOAWAY，此后主连接全部断开时不再等待恢复
+func (p *Proxy) peerGone() bool {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.goaway
+}
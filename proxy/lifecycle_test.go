@@ -0,0 +1,105 @@
+// Copyright 2019 The goproxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+//对端GOAWAY后会话结束前Err返回nil，结束后返回ErrPeerGoAway
+func TestShutdownGoAway(t *testing.T) {
+	echo := testEchoServer(t)
+	defer echo.Close()
+	p1, p2 := testPair(t, nil, nil)
+	defer p1.Close()
+	defer p2.Close()
+	c, err := p1.Dial(context.Background(), "tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		done <- p1.Shutdown(ctx)
+	}()
+	testWait(t, "goaway", p2.peerGone)
+	if err := p2.Err(); err != nil {
+		t.Fatalf("Err during drain = %v, want nil", err)
+	}
+	if _, err := p2.Dial(context.Background(), "tcp", echo.Addr().String()); err != ErrShuttingDown {
+		t.Fatalf("Dial during drain = %v, want ErrShuttingDown", err)
+	}
+	//已有子连接继续传输
+	if _, err := c.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Shutdown = %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Shutdown did not return")
+	}
+	if err := p1.Err(); err != ErrShutdown {
+		t.Errorf("p1.Err = %v, want ErrShutdown", err)
+	}
+	select {
+	case <-p2.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("peer session did not end")
+	}
+	if err := p2.Err(); err != ErrPeerGoAway {
+		t.Errorf("p2.Err = %v, want ErrPeerGoAway", err)
+	}
+}
+
+//发送队列已满时Shutdown不阻塞在GOAWAY上，ctx结束时强制关闭
+func TestShutdownSendBlocked(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go func() {
+		_, _ = io.Copy(ioutil.Discard, c2)
+	}()
+	cp, _ := testCipherPair(t, CIPHER_AES_128_GCM)
+	bp := NewBufferPool(1024)
+	p := NewProxy(1, c1, nil, cp, bp, nil)
+	//写go程未运行，发送队列填满
+	for len(p.sendChan) < cap(p.sendChan) {
+		b := bp.get()
+		b.size = 8
+		p.sendChan <- b
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- p.Shutdown(ctx)
+	}()
+	testWait(t, "shutdown", func() bool { return p.Err() != nil })
+	if err := p.Err(); err != ErrShutdown {
+		t.Fatalf("Err = %v, want ErrShutdown", err)
+	}
+	go p.Handle()
+	select {
+	case err := <-done:
+		if err != context.DeadlineExceeded {
+			t.Fatalf("Shutdown = %v, want context.DeadlineExceeded", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Shutdown did not return")
+	}
+}
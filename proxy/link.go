@@ -0,0 +1,725 @@
+// Copyright 2019 The goproxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proxy
+
+/*
+多主连接
+一个会话(Proxy)可以绑定多条主连接(link)，每条主连接使用独立的帧加密对象，由写go程统一分配帧:
+子连接的帧固定在同一条主连接上发送以保证顺序，新的子连接分配至子连接最少的主连接
+
+除主连接自有命令(SETTINGS、KEEPALIVE、LINK_ACK、LINK_LOST)外，每条主连接上收发的帧都按序计数，
+接收方通过PROXY_CMD_LINK_ACK确认已处理的帧数，发送方保留已发送未确认帧的明文
+主连接断开后双方在其他主连接上通过PROXY_CMD_LINK_LOST交换各自在该主连接上已处理的帧数，
+对端未处理的帧及断开后待发送的帧按序重新分配至其他主连接，子连接不受影响
+
+会话恢复
+设置WithResumeTimeout后所有主连接断开时会话不立即结束，待发送的帧保留在断开的主连接或会话中，
+客户端出示会话令牌重新连接后，新主连接按上述方式交换已处理的帧数并重发，超时未恢复时结束会话
+*/
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	//会话令牌长度，客户端加入已有会话时出示
+	SESSION_TOKEN_SIZE = 16
+	//每处理LINK_ACK_INTERVAL个帧确认一次，其余在TICK时确认
+	LINK_ACK_INTERVAL = 64
+	//断开的主连接在LINK_RESOLVE_TIMEOUT秒内未收到对端LINK_LOST时结束会话
+	LINK_RESOLVE_TIMEOUT = 120
+	//已完成重发的主连接记录保留时间(秒)，用于回复对端重复的LINK_LOST
+	LINK_RECORD_TTL = 600
+	//监听命令的路由键，与子连接的路由键(ID|监听子连接标识<<32)不冲突
+	ROUTE_KEY_LISTEN = 1 << 33
+)
+
+//主连接事件，由读写go程或AddLink产生，在写go程中处理
+const (
+	LINK_EVENT_UP   = 0
+	LINK_EVENT_DOWN = 1
+	LINK_EVENT_LOST = 2
+)
+
+var (
+	ErrLinkExists    = errors.New("link already exists")
+	ErrLinkLost      = errors.New("link lost without recovery")
+	ErrLinkClosed    = errors.New("link closed by peer")
+	ErrResumeTimeout = errors.New("session resume timeout")
+)
+
+type linkEvent struct {
+	kind byte
+	l    *link
+	//LINK_EVENT_LOST参数，对端已处理的帧数和是否需要回复
+	id    uint32
+	count uint64
+	reply bool
+}
+
+type link struct {
+	//收发的字节数和帧数，keepalive往返时间(纳秒)，见stats.go(原子访问，保持64位对齐)
+	bytesIn   uint64
+	bytesOut  uint64
+	framesIn  uint64
+	framesOut uint64
+	rtt       int64
+	id        uint32
+	//主连接及帧加密对象
+	c      net.Conn
+	cipher *Cipher
+	proxy  *Proxy
+	//待写入的帧，写go程读取
+	queue  *bufferHeader
+	notify chan struct{}
+	quit   chan struct{}
+	once   sync.Once
+	wg     sync.WaitGroup
+	//断开原因，由mutex保护
+	err error
+	//mutex保护以下字段
+	//unacked 已写入未确认的帧，头部帧序号为ackSeq
+	//sentSeq 已写入的帧数
+	//ackSent 已向对端确认的帧数
+	mutex   sync.Mutex
+	unacked *bufferHeader
+	ackSeq  uint64
+	sentSeq uint64
+	ackSent uint64
+	//已处理的对端帧数，读go程写入(原子访问)
+	recvSeq uint64
+	//最后收到KEEPALIVE的时间(原子访问)
+	keepaliveAt int64
+	//以下字段只在写go程中访问
+	keepaliveSent int64
+	streams       int
+	started       bool
+	dead          bool
+	deadAt        int64
+	//已收到对端LINK_LOST，peerRecv为对端已处理的本端帧数
+	peerKnown bool
+	peerRecv  uint64
+	resolved  bool
+}
+
+func newLink(id uint32, c net.Conn, cp *Cipher, p *Proxy) *link {
+	l := &link{id: id, c: c, cipher: cp, proxy: p}
+	l.queue = newBufferHeader(0, p.bp)
+	l.unacked = newBufferHeader(0, p.bp)
+	l.notify = make(chan struct{}, 1)
+	l.quit = make(chan struct{})
+	return l
+}
+
+//主连接自有命令，不计数，断开后不重发
+func linkLocal(cmd byte) bool {
+	return cmd == PROXY_CMD_SETTINGS || cmd == PROXY_CMD_KEEPALIVE || cmd == PROXY_CMD_LINK_ACK || cmd == PROXY_CMD_LINK_LOST
+}
+
+//关闭主连接，只记录第一个错误
+func (l *link) close(err error) {
+	l.once.Do(func() {
+		l.mutex.Lock()
+		l.err = err
+		l.mutex.Unlock()
+		_ = l.c.Close()
+		close(l.quit)
+	})
+}
+
+//断开原因
+func (l *link) lastErr() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.err
+}
+
+//启动读写go程，两者都退出后产生LINK_EVENT_DOWN
+func (l *link) start() {
+	l.started = true
+	now := time.Now().Unix()
+	//首个KEEPALIVE在下次检查时发送，尽早测量往返时间
+	l.keepaliveSent = now - int64(l.proxy.cfg.KeepaliveInterval/time.Second)
+	atomic.StoreInt64(&l.keepaliveAt, now)
+	l.proxy.wg.Add(1)
+	l.wg.Add(2)
+	go l.read()
+	go l.write()
+	go func() {
+		l.wg.Wait()
+		l.proxy.postLinkEvent(&linkEvent{kind: LINK_EVENT_DOWN, l: l})
+		l.proxy.wg.Done()
+	}()
+}
+
+//追加待发送的帧
+func (l *link) enqueue(b *buffer) {
+	l.queue.append(b, false)
+	select {
+	case l.notify <- struct{}{}:
+	default:
+	}
+}
+
+//发送主连接自有命令，不受待发送帧顺序限制
+func (l *link) sendLocal(cmd byte, id uint32, body []byte) {
+	b := l.proxy.buildCommand(false, id, cmd, nil, body)
+	if b == nil {
+		return
+	}
+	l.queue.push(b, false)
+	select {
+	case l.notify <- struct{}{}:
+	default:
+	}
+}
+
+//确认已处理的对端帧
+//@force 为false时只在未确认帧数达到LINK_ACK_INTERVAL时确认
+func (l *link) sendAck(force bool) {
+	n := atomic.LoadUint64(&l.recvSeq)
+	l.mutex.Lock()
+	if n == l.ackSent || (!force && n-l.ackSent < LINK_ACK_INTERVAL) {
+		l.mutex.Unlock()
+		return
+	}
+	l.ackSent = n
+	l.mutex.Unlock()
+	l.sendLocal(PROXY_CMD_LINK_ACK, 0, putUint64(n))
+}
+
+//没有待写入的帧，已写入的帧都已被对端确认
+func (l *link) flushed() bool {
+	l.queue.mutex.RLock()
+	queued := l.queue.cnt
+	l.queue.mutex.RUnlock()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return queued == 0 && l.ackSeq == l.sentSeq
+}
+
+//对端确认已处理count个帧，释放已确认的帧
+func (l *link) ack(count uint64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for l.ackSeq < count {
+		b := l.unacked.pop()
+		if b == nil {
+			break
+		}
+		l.proxy.bp.put(b)
+		l.ackSeq++
+	}
+}
+
+//取出需要在其他主连接重发的帧，只能在读写go程退出后调用
+//@count 对端已处理的帧数
+//return 对端未处理的帧及待发送的帧，按发送顺序排列，不包括主连接自有命令
+func (l *link) takeFrames(count uint64) []*buffer {
+	l.ack(count)
+	var frames []*buffer
+	for _, bh := range []*bufferHeader{l.unacked, l.queue} {
+		for {
+			b := bh.pop()
+			if b == nil {
+				break
+			}
+			if linkLocal(b.data[3] & 0x1f) {
+				l.proxy.bp.put(b)
+				continue
+			}
+			frames = append(frames, b)
+		}
+	}
+	return frames
+}
+
+//释放所有缓存，会话结束时调用
+func (l *link) free() {
+	for _, bh := range []*bufferHeader{l.unacked, l.queue} {
+		for {
+			b := bh.pop()
+			if b == nil {
+				break
+			}
+			l.proxy.bp.put(b)
+		}
+	}
+}
+
+//主连接读go程
+//读缓存可容纳本端允许的最大帧，每个完整的帧复制到对应级别的缓存后解密处理，避免小帧占用大缓存
+func (l *link) read() {
+	defer l.wg.Done()
+	maxFrame := FRAME_HEAD_SIZE + int(l.proxy.frameSize) + FRAME_TAG_SIZE
+	rb := make([]byte, maxFrame+DEFAULT_FRAME_PAYLOAD)
+	//rb[start:size]为未处理的数据
+	start, size := 0, 0
+	for {
+		if start > 0 {
+			copy(rb, rb[start:size])
+			size -= start
+			start = 0
+		}
+		n, err := l.c.Read(rb[size:])
+		if err != nil {
+			//帧读取到一半时断开视为截断
+			if size > 0 {
+				err = ErrFrameTruncated
+			}
+			l.close(err)
+			return
+		}
+		size += n
+		atomic.AddUint64(&l.bytesIn, uint64(n))
+		atomic.AddUint64(&l.proxy.bytesIn, uint64(n))
+		for {
+			//长度前缀未读取完
+			if size-start < FRAME_LENGTH_SIZE {
+				break
+			}
+			//长度前缀为明文，确认整帧大小
+			frameSize := FRAME_LENGTH_SIZE + int(rb[start]) + int(rb[start+1])<<8 + int(rb[start+2])<<16
+			//大于本端声明的最大帧或不足头部和认证标签长度
+			if frameSize > maxFrame || frameSize < FRAME_HEAD_SIZE+l.cipher.Overhead() {
+				l.close(ErrFrameSize)
+				return
+			}
+			//数据未读取完
+			if size-start < frameSize {
+				break
+			}
+			b := l.proxy.bp.getSize(frameSize)
+			if b == nil {
+				l.close(ErrFrameSize)
+				return
+			}
+			copy(b.data, rb[start:start+frameSize])
+			b.size = frameSize
+			start += frameSize
+			//解密并认证，被篡改、重放或重排的帧都会导致主连接关闭
+			if err := l.cipher.open(b); err != nil {
+				l.proxy.bp.put(b)
+				l.close(err)
+				return
+			}
+			atomic.AddUint64(&l.framesIn, 1)
+			atomic.AddUint64(&l.proxy.framesIn, 1)
+			l.proc(b)
+		}
+	}
+}
+
+//处理主连接自有命令，其余帧交给Proxy.readProc处理并计数
+func (l *link) proc(b *buffer) {
+	cmd := b.data[3] & 0x1f
+	switch cmd {
+	case PROXY_CMD_SETTINGS:
+		if b.size == 12 {
+			l.proxy.setPeerFrameSize(uint32(b.data[8]) | uint32(b.data[9])<<8 | uint32(b.data[10])<<16 | uint32(b.data[11])<<24)
+		}
+	case PROXY_CMD_KEEPALIVE:
+		now := time.Now()
+		atomic.StoreInt64(&l.keepaliveAt, now.Unix())
+		//数据区为8字节小端发送时间(UnixNano)和1字节是否为回复，回复时计算往返时间
+		if b.size == 17 {
+			if b.data[16] == 0 {
+				l.sendLocal(PROXY_CMD_KEEPALIVE, 0, append(b.data[8:16:16], 1))
+			} else if rtt := now.UnixNano() - int64(getUint64(b.data[8:16])); rtt >= 0 {
+				atomic.StoreInt64(&l.rtt, rtt)
+				if hook := l.proxy.cfg.Hooks.RTT; hook != nil {
+					hook(l.proxy, l.id, time.Duration(rtt))
+				}
+			}
+		}
+	case PROXY_CMD_LINK_ACK:
+		if b.size == 16 {
+			l.ack(getUint64(b.data[8:16]))
+		}
+	case PROXY_CMD_LINK_LOST:
+		if b.size == 17 {
+			id := uint32(b.data[4]) | uint32(b.data[5])<<8 | uint32(b.data[6])<<16 | uint32(b.data[7])<<24
+			l.proxy.postLinkEvent(&linkEvent{kind: LINK_EVENT_LOST, id: id, count: getUint64(b.data[8:16]), reply: b.data[16] != 0})
+		}
+	default:
+		if !l.proxy.readProc(b) {
+			l.proxy.bp.put(b)
+		}
+		atomic.AddUint64(&l.recvSeq, 1)
+		l.sendAck(false)
+		return
+	}
+	l.proxy.bp.put(b)
+}
+
+//主连接写go程，首先声明本端可接收的帧大小
+//帧序号决定nonce，因此加密必须在写go程中按发送顺序进行
+func (l *link) write() {
+	defer l.wg.Done()
+	size := l.proxy.frameSize
+	l.sendLocal(PROXY_CMD_SETTINGS, 0, []byte{byte(size), byte(size >> 8), byte(size >> 16), byte(size >> 24)})
+	var out []byte
+	for {
+		select {
+		case <-l.quit:
+			return
+		case <-l.notify:
+		}
+		for {
+			b := l.queue.pop()
+			if b == nil {
+				break
+			}
+			if len(out) < b.size+l.cipher.Overhead() {
+				out = make([]byte, b.size+l.cipher.Overhead())
+			}
+			n, err := l.cipher.seal(b, out)
+			if err != nil {
+				l.proxy.log.Error("encrypt frame failed", "link", l.id, "error", err)
+				l.proxy.bp.put(b)
+				l.close(err)
+				return
+			}
+			//写入前计入未确认列表，写入失败时由对端LINK_LOST确认是否需要重发
+			if linkLocal(b.data[3] & 0x1f) {
+				l.proxy.bp.put(b)
+			} else {
+				l.mutex.Lock()
+				l.unacked.append(b, false)
+				l.sentSeq++
+				l.mutex.Unlock()
+			}
+			offset := 0
+			for offset < n {
+				cnt, err := l.c.Write(out[offset:n])
+				if err != nil {
+					l.close(err)
+					return
+				}
+				offset += cnt
+			}
+			atomic.AddUint64(&l.bytesOut, uint64(n))
+			atomic.AddUint64(&l.proxy.bytesOut, uint64(n))
+			atomic.AddUint64(&l.framesOut, 1)
+			atomic.AddUint64(&l.proxy.framesOut, 1)
+		}
+	}
+}
+
+func putUint64(v uint64) []byte {
+	b := make([]byte, 8)
+	for i := range b {
+		b[i] = byte(v >> (8 * uint(i)))
+	}
+	return b
+}
+
+func getUint64(b []byte) uint64 {
+	v := uint64(0)
+	for i := 7; i >= 0; i-- {
+		v = v<<8 | uint64(b[i])
+	}
+	return v
+}
+
+//AddLink将已完成握手的连接作为附加主连接加入会话，通常由handshake包在客户端携带会话令牌登录时调用
+//@id 主连接ID，由客户端分配(见NextLinkID)，同一会话内唯一
+//@cp 该连接协商的帧加密对象
+func (p *Proxy) AddLink(id uint32, c net.Conn, cp *Cipher) error {
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		return ErrProxyClosed
+	}
+	if _, ok := p.links[id]; ok {
+		p.mutex.Unlock()
+		return ErrLinkExists
+	}
+	l := newLink(id, c, cp, p)
+	p.links[id] = l
+	p.mutex.Unlock()
+	p.postLinkEvent(&linkEvent{kind: LINK_EVENT_UP, l: l})
+	return nil
+}
+
+//NextLinkID分配新的主连接ID，供客户端加入会话时使用
+func (p *Proxy) NextLinkID() uint32 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for {
+		p.linkIdx++
+		if _, ok := p.links[p.linkIdx]; !ok {
+			return p.linkIdx
+		}
+	}
+}
+
+//Links返回当前可用的主连接数，会话结束后返回0
+func (p *Proxy) Links() int {
+	return int(atomic.LoadInt32(&p.liveLinks))
+}
+
+//Token返回会话令牌，客户端出示该令牌将新连接加入本会话
+func (p *Proxy) Token() []byte {
+	return p.token
+}
+
+//提交主连接事件，由写go程处理
+func (p *Proxy) postLinkEvent(ev *linkEvent) {
+	p.mutex.Lock()
+	p.linkEvents = append(p.linkEvents, ev)
+	p.mutex.Unlock()
+	select {
+	case p.linkNotify <- struct{}{}:
+	default:
+	}
+}
+
+//处理主连接事件，只在写go程中调用
+//return 会话是否继续
+func (p *Proxy) handleLinkEvents() bool {
+	p.mutex.Lock()
+	events := p.linkEvents
+	p.linkEvents = nil
+	p.mutex.Unlock()
+	for _, ev := range events {
+		switch ev.kind {
+		case LINK_EVENT_UP:
+			l := ev.l
+			l.start()
+			atomic.AddInt32(&p.liveLinks, 1)
+			if hook := p.cfg.Hooks.LinkUp; hook != nil {
+				hook(p, l.id)
+			}
+			if p.suspendedAt != 0 {
+				p.suspendedAt = 0
+				p.log.Info("proxy resumed", "link", l.id)
+			}
+			//新主连接可能是唯一可用的主连接，重新通知尚未完成重发的断开主连接，并重新计算等待时间
+			now := time.Now().Unix()
+			p.mutex.RLock()
+			for _, v := range p.links {
+				if v.dead && !v.resolved {
+					v.deadAt = now
+				}
+			}
+			p.mutex.RUnlock()
+			p.announceLost(l, nil)
+			held := p.held
+			p.held = nil
+			for _, b := range held {
+				p.route(b)
+			}
+		case LINK_EVENT_DOWN:
+			l := ev.l
+			l.dead = true
+			l.deadAt = time.Now().Unix()
+			if hook := p.cfg.Hooks.LinkDown; hook != nil {
+				hook(p, l.id, l.lastErr())
+			}
+			if atomic.AddInt32(&p.liveLinks, -1) == 0 {
+				//对端已发送GOAWAY时不会恢复会话
+				if p.resumeTimeout == 0 || p.peerGone() {
+					p.setErr(l.lastErr())
+					return false
+				}
+				//等待客户端恢复会话
+				p.suspendedAt = l.deadAt
+				p.log.Info("all links closed, waiting for resume", "link", l.id, "timeout", time.Duration(p.resumeTimeout)*time.Second)
+				continue
+			}
+			if err := l.lastErr(); err != nil {
+				p.log.Info("link closed", "link", l.id, "peer", l.c.RemoteAddr(), "error", err)
+			}
+			//通知对端本端已处理的帧数，之前的通知可能随该主连接丢失，一并重新通知
+			p.announceLost(p.pickLink(), l)
+			if l.peerKnown {
+				p.resolveLink(l)
+			}
+		case LINK_EVENT_LOST:
+			p.mutex.RLock()
+			l, ok := p.links[ev.id]
+			p.mutex.RUnlock()
+			if !ok {
+				continue
+			}
+			if !l.peerKnown {
+				l.peerKnown = true
+				l.peerRecv = ev.count
+			}
+			//对端已断开，关闭本端，断开后通知对端
+			if !l.dead {
+				l.close(ErrLinkClosed)
+				continue
+			}
+			if !l.resolved {
+				p.resolveLink(l)
+			}
+			if ev.reply {
+				p.sendLinkLost(p.pickLink(), l)
+			}
+		}
+	}
+	return true
+}
+
+//在主连接to上发送lost的PROXY_CMD_LINK_LOST
+func (p *Proxy) sendLinkLost(to *link, lost *link) {
+	if to == nil {
+		return
+	}
+	body := append(putUint64(atomic.LoadUint64(&lost.recvSeq)), 0)
+	if !lost.peerKnown {
+		body[8] = 1
+	}
+	to.sendLocal(PROXY_CMD_LINK_LOST, lost.id, body)
+}
+
+//通知对端已断开但未完成重发的主连接
+//@to 发送通知的主连接
+//@lost 刚断开的主连接，可为nil
+func (p *Proxy) announceLost(to *link, lost *link) {
+	if to == nil {
+		return
+	}
+	if lost != nil {
+		p.sendLinkLost(to, lost)
+	}
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	for _, l := range p.links {
+		if l != lost && l.dead && !l.resolved {
+			p.sendLinkLost(to, l)
+		}
+	}
+}
+
+//断开的主连接已得到对端确认，将对端未处理的帧和待发送的帧重新分配至其他主连接
+func (p *Proxy) resolveLink(l *link) {
+	l.resolved = true
+	frames := l.takeFrames(l.peerRecv)
+	for k, v := range p.routes {
+		if v == l {
+			delete(p.routes, k)
+		}
+	}
+	l.streams = 0
+	for _, b := range frames {
+		p.route(b)
+	}
+	if len(frames) > 0 {
+		p.log.Info("frames resent", "link", l.id, "frames", len(frames))
+	}
+}
+
+//选择子连接最少的可用主连接
+func (p *Proxy) pickLink() *link {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	var best *link
+	for _, l := range p.links {
+		if !l.started || l.dead {
+			continue
+		}
+		if best == nil || l.streams < best.streams || (l.streams == best.streams && l.id < best.id) {
+			best = l
+		}
+	}
+	return best
+}
+
+//为帧选择主连接并加入发送队列，只在写go程中调用
+//子连接的帧固定在同一主连接上，主连接断开后追加至其待发送队列，完成重发时按序迁移
+//没有可用主连接时保留在会话中，新主连接加入后发送
+func (p *Proxy) route(b *buffer) {
+	id := uint32(b.data[4]) | uint32(b.data[5])<<8 | uint32(b.data[6])<<16 | uint32(b.data[7])<<24
+	cmd := b.data[3] & 0x1f
+	var l *link
+	if id == 0 {
+		//主连接级命令
+		l = p.pickLink()
+	} else if cmd == PROXY_CMD_NEW_LISTEN || cmd == PROXY_CMD_CLOSE_LISTEN || cmd == PROXY_CMD_LISTEN_RESULT {
+		//监听命令固定在同一主连接上，保证同一监听的创建和关闭顺序
+		l = p.routes[ROUTE_KEY_LISTEN]
+		if l == nil {
+			l = p.pickLink()
+			if l != nil {
+				p.routes[ROUTE_KEY_LISTEN] = l
+			}
+		}
+	} else {
+		key := uint64(id)
+		if b.data[3]&0x80 != 0 {
+			key |= 1 << 32
+		}
+		l = p.routes[key]
+		if l == nil {
+			l = p.pickLink()
+			//窗口更新经应急通道发送，可能晚于关闭命令，关闭命令也可能是子连接的唯一一帧，二者都不创建路由
+			if l != nil && cmd != PROXY_CMD_WINDOW_UPDATE && cmd != PROXY_CMD_CLOSE_CONNECT {
+				p.routes[key] = l
+				l.streams++
+			}
+		} else if cmd == PROXY_CMD_CLOSE_CONNECT {
+			//关闭命令为子连接的最后一帧
+			delete(p.routes, key)
+			l.streams--
+		}
+	}
+	if l == nil {
+		//所有主连接已断开，保留至会话恢复
+		p.held = append(p.held, b)
+		return
+	}
+	l.enqueue(b)
+}
+
+//定时检查主连接保活、确认未确认的帧、会话恢复超时、清理过期记录，只在写go程中调用
+//return 会话是否继续
+func (p *Proxy) tickLinks() bool {
+	now := time.Now().Unix()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.suspendedAt != 0 {
+		if now-p.suspendedAt > p.resumeTimeout {
+			if p.err == nil {
+				p.err = ErrResumeTimeout
+			}
+			return false
+		}
+		//等待恢复期间不检查断开主连接的重发超时
+		return true
+	}
+	for id, l := range p.links {
+		if !l.started {
+			continue
+		}
+		if !l.dead {
+			if now-atomic.LoadInt64(&l.keepaliveAt) > int64(p.cfg.KeepaliveTimeout/time.Second) {
+				l.close(ErrKeepaliveTimeout)
+				continue
+			}
+			if now-l.keepaliveSent >= int64(p.cfg.KeepaliveInterval/time.Second) {
+				l.keepaliveSent = now
+				l.sendLocal(PROXY_CMD_KEEPALIVE, 0, append(putUint64(uint64(time.Now().UnixNano())), 0))
+			}
+			l.sendAck(true)
+			continue
+		}
+		if !l.resolved && now-l.deadAt > LINK_RESOLVE_TIMEOUT {
+			if p.err == nil {
+				p.err = ErrLinkLost
+			}
+			return false
+		}
+		if l.resolved && now-l.deadAt > LINK_RECORD_TTL {
+			delete(p.links, id)
+		}
+	}
+	return true
+}
@@ -0,0 +1,170 @@
+// Copyright 2019 The goproxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+)
+
+//子连接关闭后不保留路由，包括关闭后才发送的窗口更新
+func TestRouteRelease(t *testing.T) {
+	echo := testEchoServer(t)
+	defer echo.Close()
+	opts := []Option{WithInitialWindow(STREAM_WINDOW_BASE)}
+	p1, p2 := testPair(t, opts, opts)
+	defer p1.Close()
+	defer p2.Close()
+	//超过窗口一半的数据使双方发送窗口更新
+	data := bytes.Repeat([]byte("0123456789abcdef"), STREAM_WINDOW_BASE/16)
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c, err := p1.Dial(context.Background(), "tcp", echo.Addr().String())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer c.Close()
+			go func() {
+				_, _ = c.Write(data)
+			}()
+			got := make([]byte, len(data))
+			if _, err := io.ReadFull(c, got); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	testWait(t, "streams closed", func() bool { return p1.Stats().Streams == 0 && p2.Stats().Streams == 0 })
+	//等待最后的窗口更新和关闭命令发出
+	time.Sleep(200 * time.Millisecond)
+	for _, p := range []*Proxy{p1, p2} {
+		p.Close()
+		<-p.Done()
+		//写go程已退出
+		for key := range p.routes {
+			if key != ROUTE_KEY_LISTEN {
+				t.Errorf("proxy %d: route %#x left after streams closed", p.ID, key)
+			}
+		}
+		for _, l := range p.links {
+			if l.streams != 0 {
+				t.Errorf("proxy %d: link %d has %d streams", p.ID, l.id, l.streams)
+			}
+		}
+	}
+}
+
+//断开会话的所有主连接，返回前双方都已检测到断开
+func testDropLinks(t *testing.T, p1, p2 *Proxy) {
+	t.Helper()
+	p1.mutex.RLock()
+	for _, l := range p1.links {
+		l.c.Close()
+	}
+	p1.mutex.RUnlock()
+	testWait(t, "links down", func() bool { return p1.Links() == 0 && p2.Links() == 0 })
+}
+
+//所有主连接断开后会话保留，新的主连接加入后子连接继续传输，断开期间写入的数据不丢失
+func TestSessionResume(t *testing.T) {
+	echo := testEchoServer(t)
+	defer echo.Close()
+	opts := []Option{WithResumeTimeout(30 * time.Second), WithLogger(NewTextLogger(ioutil.Discard, LEVEL_WARN))}
+	p1, p2 := testPair(t, opts, opts)
+	defer p1.Close()
+	defer p2.Close()
+	c, err := p1.Dial(context.Background(), "tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	buf := make([]byte, 4)
+	_ = c.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := c.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("echo: %q, %v", buf, err)
+	}
+	testDropLinks(t, p1, p2)
+	if _, err := c.Write([]byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-p1.Done():
+		t.Fatalf("session ended while waiting for resume: %v", p1.Err())
+	case <-time.After(200 * time.Millisecond):
+	}
+	c1, c2 := testConnPair(t)
+	cp1, cp2 := testCipherPair(t, CIPHER_AES_128_GCM)
+	id := p1.NextLinkID()
+	if err := p1.AddLink(id, c1, cp1); err != nil {
+		t.Fatal(err)
+	}
+	if err := p2.AddLink(id, c2, cp2); err != nil {
+		t.Fatal(err)
+	}
+	testWait(t, "resume", func() bool { return p1.Links() == 1 && p2.Links() == 1 })
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "pong" {
+		t.Fatalf("echo after resume: %q, %v", buf, err)
+	}
+	//恢复后新的子连接可用
+	c3, err := p2.Dial(context.Background(), "tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c3.Close()
+}
+
+//超过ResumeTimeout未恢复时双方结束会话，返回ErrResumeTimeout
+func TestSessionResumeTimeout(t *testing.T) {
+	echo := testEchoServer(t)
+	defer echo.Close()
+	opts := []Option{WithResumeTimeout(time.Second), WithLogger(NewTextLogger(ioutil.Discard, LEVEL_WARN))}
+	p1, p2 := testPair(t, opts, opts)
+	defer p1.Close()
+	defer p2.Close()
+	c, err := p1.Dial(context.Background(), "tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	start := time.Now()
+	testDropLinks(t, p1, p2)
+	for _, p := range []*Proxy{p1, p2} {
+		select {
+		case <-p.Done():
+		case <-time.After(5 * time.Second):
+			t.Fatalf("proxy %d: session did not expire", p.ID)
+		}
+		if err := p.Err(); err != ErrResumeTimeout {
+			t.Errorf("proxy %d: Err = %v, want ErrResumeTimeout", p.ID, err)
+		}
+	}
+	if d := time.Since(start); d < time.Second {
+		t.Errorf("session expired after %v, before ResumeTimeout", d)
+	}
+	//会话结束后子连接关闭，不能再加入主连接
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Error("stream still readable after the session expired")
+	}
+	c1, c2 := testConnPair(t)
+	defer c1.Close()
+	defer c2.Close()
+	cp1, _ := testCipherPair(t, CIPHER_AES_128_GCM)
+	if err := p1.AddLink(p1.NextLinkID(), c1, cp1); err != ErrProxyClosed {
+		t.Errorf("AddLink after expiry = %v, want ErrProxyClosed", err)
+	}
+}
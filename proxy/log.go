@@ -0,0 +1,197 @@
+// Copyright 2019 The goproxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proxy
+
+/*
+分级日志
+Logger的方法与log/slog.Logger相同，*slog.Logger可直接通过WithLogger传入
+args为交替的键值对，proxy包使用的键: proxy(会话ID)、link(主连接ID)、stream(子连接ID)、listen(监听地址)、
+forward(转发地址)、peer(对端地址)、error(错误信息)，会话的日志都带有proxy字段
+未设置时使用DefaultLogger，以文本格式输出INFO及以上级别的日志到标准输出
+*/
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+//Logger 分级日志接口
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+//Level 日志级别，取值与slog.Level相同
+type Level int
+
+const (
+	LEVEL_DEBUG Level = -4
+	LEVEL_INFO  Level = 0
+	LEVEL_WARN  Level = 4
+	LEVEL_ERROR Level = 8
+)
+
+//DefaultLogger 未通过WithLogger设置时使用的日志
+var DefaultLogger Logger = NewTextLogger(os.Stdout, LEVEL_INFO)
+
+func (l Level) String() string {
+	switch {
+	case l < LEVEL_INFO:
+		return "DEBUG"
+	case l < LEVEL_WARN:
+		return "INFO"
+	case l < LEVEL_ERROR:
+		return "WARN"
+	}
+	return "ERROR"
+}
+
+//ParseLevel解析日志级别名称，不区分大小写
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToUpper(s) {
+	case "DEBUG":
+		return LEVEL_DEBUG, nil
+	case "INFO":
+		return LEVEL_INFO, nil
+	case "WARN":
+		return LEVEL_WARN, nil
+	case "ERROR":
+		return LEVEL_ERROR, nil
+	}
+	return LEVEL_INFO, fmt.Errorf("unknown log level %q", s)
+}
+
+//输出到io.Writer的日志，每条日志一行
+type streamLogger struct {
+	mutex sync.Mutex
+	w     io.Writer
+	level Level
+	json  bool
+}
+
+//NewTextLogger创建文本格式的日志，格式与slog.TextHandler相同，如time=... level=INFO msg=... proxy=1
+//@level 输出的最低级别
+func NewTextLogger(w io.Writer, level Level) Logger {
+	return &streamLogger{w: w, level: level}
+}
+
+//NewJSONLogger创建JSON格式的日志，格式与slog.JSONHandler相同，如{"time":...,"level":"INFO","msg":...,"proxy":1}
+//@level 输出的最低级别
+func NewJSONLogger(w io.Writer, level Level) Logger {
+	return &streamLogger{w: w, level: level, json: true}
+}
+
+func (l *streamLogger) Debug(msg string, args ...interface{}) { l.log(LEVEL_DEBUG, msg, args) }
+func (l *streamLogger) Info(msg string, args ...interface{})  { l.log(LEVEL_INFO, msg, args) }
+func (l *streamLogger) Warn(msg string, args ...interface{})  { l.log(LEVEL_WARN, msg, args) }
+func (l *streamLogger) Error(msg string, args ...interface{}) { l.log(LEVEL_ERROR, msg, args) }
+
+func (l *streamLogger) log(level Level, msg string, args []interface{}) {
+	if level < l.level {
+		return
+	}
+	var buf bytes.Buffer
+	now := time.Now().Format(time.RFC3339Nano)
+	if l.json {
+		buf.WriteString(`{"time":`)
+		writeJSONValue(&buf, now)
+		buf.WriteString(`,"level":`)
+		writeJSONValue(&buf, level.String())
+		buf.WriteString(`,"msg":`)
+		writeJSONValue(&buf, msg)
+	} else {
+		buf.WriteString("time=" + now + " level=" + level.String() + " msg=")
+		writeTextValue(&buf, msg)
+	}
+	for i := 0; i < len(args); {
+		//与slog相同，缺少键的值使用!BADKEY作为键
+		key, ok := args[i].(string)
+		var v interface{}
+		if ok && i+1 < len(args) {
+			v = args[i+1]
+			i += 2
+		} else {
+			key = "!BADKEY"
+			v = args[i]
+			i++
+		}
+		v = logValue(v)
+		if l.json {
+			buf.WriteByte(',')
+			writeJSONValue(&buf, key)
+			buf.WriteByte(':')
+			writeJSONValue(&buf, v)
+		} else {
+			buf.WriteString(" " + key + "=")
+			if s, ok := v.(string); ok {
+				writeTextValue(&buf, s)
+			} else {
+				writeTextValue(&buf, fmt.Sprint(v))
+			}
+		}
+	}
+	if l.json {
+		buf.WriteByte('}')
+	}
+	buf.WriteByte('\n')
+	l.mutex.Lock()
+	_, _ = l.w.Write(buf.Bytes())
+	l.mutex.Unlock()
+}
+
+//错误和实现了fmt.Stringer的值按字符串输出
+func logValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+func writeJSONValue(buf *bytes.Buffer, v interface{}) {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		b.Reset()
+		_ = enc.Encode(fmt.Sprint(v))
+	}
+	buf.Write(bytes.TrimRight(b.Bytes(), "\n"))
+}
+
+//值为空或包含空格、等号、引号和不可打印字符时加引号
+func writeTextValue(buf *bytes.Buffer, s string) {
+	if s == "" || strings.IndexFunc(s, func(r rune) bool { return r == ' ' || r == '=' || r == '"' || !unicode.IsPrint(r) }) >= 0 {
+		buf.WriteString(strconv.Quote(s))
+		return
+	}
+	buf.WriteString(s)
+}
+
+//会话的日志，在参数前加上proxy字段
+type proxyLogger struct {
+	p *Proxy
+	l Logger
+}
+
+func (l *proxyLogger) args(args []interface{}) []interface{} {
+	return append([]interface{}{"proxy", l.p.ID}, args...)
+}
+
+func (l *proxyLogger) Debug(msg string, args ...interface{}) { l.l.Debug(msg, l.args(args)...) }
+func (l *proxyLogger) Info(msg string, args ...interface{})  { l.l.Info(msg, l.args(args)...) }
+func (l *proxyLogger) Warn(msg string, args ...interface{})  { l.l.Warn(msg, l.args(args)...) }
+func (l *proxyLogger) Error(msg string, args ...interface{}) { l.l.Error(msg, l.args(args)...) }
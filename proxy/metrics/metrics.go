@@ -0,0 +1,200 @@
+// Copyright 2019 The goproxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+以Prometheus文本格式(0.0.4)输出会话统计，见proxy.Proxy.Stats
+每个会话的指标带有调用者指定的标签，主连接指标另加link标签，监听指标另加listener、network和address标签
+*/
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/idste/goproxy/proxy"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+//Session 待输出的会话及其标签
+type Session struct {
+	Proxy  *proxy.Proxy
+	Labels map[string]string
+}
+
+type sample struct {
+	labels string
+	value  string
+}
+
+type writer struct {
+	w   *bufio.Writer
+	err error
+}
+
+//输出一个指标，samples为空时不输出
+func (w *writer) metric(name string, kind string, help string, samples []sample) {
+	if len(samples) == 0 || w.err != nil {
+		return
+	}
+	fmt.Fprintf(w.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	for _, s := range samples {
+		if s.labels == "" {
+			fmt.Fprintf(w.w, "%s %s\n", name, s.value)
+		} else {
+			fmt.Fprintf(w.w, "%s{%s} %s\n", name, s.labels, s.value)
+		}
+	}
+}
+
+//WriteText以文本格式输出会话和缓存池的指标
+//@bp 缓存池，为nil时不输出缓存池指标
+func WriteText(out io.Writer, sessions []Session, bp *proxy.BufferPool) error {
+	stats := make([]proxy.Stats, len(sessions))
+	labels := make([]string, len(sessions))
+	for i, s := range sessions {
+		stats[i] = s.Proxy.Stats()
+		labels[i] = formatLabels(s.Labels)
+	}
+	w := &writer{w: bufio.NewWriter(out)}
+	each := func(f func(i int, st *proxy.Stats) []sample) []sample {
+		var list []sample
+		for i := range stats {
+			list = append(list, f(i, &stats[i])...)
+		}
+		return list
+	}
+	gauge := func(get func(st *proxy.Stats) uint64) []sample {
+		return each(func(i int, st *proxy.Stats) []sample {
+			return []sample{{labels[i], strconv.FormatUint(get(st), 10)}}
+		})
+	}
+	direction := func(in func(st *proxy.Stats) uint64, out func(st *proxy.Stats) uint64) []sample {
+		return each(func(i int, st *proxy.Stats) []sample {
+			return []sample{
+				{joinLabels(labels[i], "direction", "in"), strconv.FormatUint(in(st), 10)},
+				{joinLabels(labels[i], "direction", "out"), strconv.FormatUint(out(st), 10)},
+			}
+		})
+	}
+
+	w.metric("goproxy_sessions", "gauge", "Number of sessions.", []sample{{"", strconv.Itoa(len(sessions))}})
+	w.metric("goproxy_links", "gauge", "Number of live main connections.", gauge(func(st *proxy.Stats) uint64 { return uint64(st.Links) }))
+	w.metric("goproxy_streams", "gauge", "Number of active streams by initiator.", each(func(i int, st *proxy.Stats) []sample {
+		return []sample{
+			{joinLabels(labels[i], "type", "client"), strconv.Itoa(st.Clients)},
+			{joinLabels(labels[i], "type", "sub_client"), strconv.Itoa(st.SubClients)},
+		}
+	}))
+	w.metric("goproxy_bytes_total", "counter", "Bytes transferred over all main connections, including frame overhead.",
+		direction(func(st *proxy.Stats) uint64 { return st.BytesIn }, func(st *proxy.Stats) uint64 { return st.BytesOut }))
+	w.metric("goproxy_frames_total", "counter", "Frames transferred over all main connections.",
+		direction(func(st *proxy.Stats) uint64 { return st.FramesIn }, func(st *proxy.Stats) uint64 { return st.FramesOut }))
+	w.metric("goproxy_window_stalls_total", "counter", "Times a stream waited for the peer to open its send window.",
+		gauge(func(st *proxy.Stats) uint64 { return st.WindowStalls }))
+	w.metric("goproxy_dial_failures_total", "counter", "Failed connections to forward addresses requested by the peer.",
+		gauge(func(st *proxy.Stats) uint64 { return st.DialFailures }))
+	w.metric("goproxy_policy_denials_total", "counter", "Peer dial and listen requests denied by the access control policy.",
+		gauge(func(st *proxy.Stats) uint64 { return st.PolicyDenials }))
+	w.metric("goproxy_udp_drops_total", "counter", "UDP datagrams dropped for exceeding the size limit or a full session backlog.",
+		gauge(func(st *proxy.Stats) uint64 { return st.UDPDrops }))
+
+	linkLabels := func(i int, ls *proxy.LinkStats) string {
+		return joinLabels(labels[i], "link", strconv.FormatUint(uint64(ls.ID), 10))
+	}
+	links := func(f func(i int, ls *proxy.LinkStats) []sample) []sample {
+		return each(func(i int, st *proxy.Stats) []sample {
+			var list []sample
+			for j := range st.LinkStats {
+				list = append(list, f(i, &st.LinkStats[j])...)
+			}
+			return list
+		})
+	}
+	w.metric("goproxy_link_bytes_total", "counter", "Bytes transferred over a main connection, including frame overhead.", links(func(i int, ls *proxy.LinkStats) []sample {
+		return []sample{
+			{joinLabels(linkLabels(i, ls), "direction", "in"), strconv.FormatUint(ls.BytesIn, 10)},
+			{joinLabels(linkLabels(i, ls), "direction", "out"), strconv.FormatUint(ls.BytesOut, 10)},
+		}
+	}))
+	w.metric("goproxy_link_frames_total", "counter", "Frames transferred over a main connection.", links(func(i int, ls *proxy.LinkStats) []sample {
+		return []sample{
+			{joinLabels(linkLabels(i, ls), "direction", "in"), strconv.FormatUint(ls.FramesIn, 10)},
+			{joinLabels(linkLabels(i, ls), "direction", "out"), strconv.FormatUint(ls.FramesOut, 10)},
+		}
+	}))
+	w.metric("goproxy_link_rtt_seconds", "gauge", "Last keepalive round trip time of a main connection, 0 if not measured yet.", links(func(i int, ls *proxy.LinkStats) []sample {
+		return []sample{{linkLabels(i, ls), strconv.FormatFloat(ls.RTT.Seconds(), 'g', -1, 64)}}
+	}))
+
+	listenerLabels := func(i int, ls *proxy.ListenerStats) string {
+		l := joinLabels(labels[i], "listener", strconv.Itoa(ls.ID))
+		l = joinLabels(l, "network", ls.Listen.Domain)
+		return joinLabels(l, "address", ls.Listen.Addr)
+	}
+	listeners := func(f func(i int, ls *proxy.ListenerStats) []sample) []sample {
+		return each(func(i int, st *proxy.Stats) []sample {
+			var list []sample
+			for j := range st.ListenerStats {
+				list = append(list, f(i, &st.ListenerStats[j])...)
+			}
+			return list
+		})
+	}
+	w.metric("goproxy_listener_connections_total", "counter", "Connections accepted by a listener, sessions for UDP listeners.", listeners(func(i int, ls *proxy.ListenerStats) []sample {
+		return []sample{{listenerLabels(i, ls), strconv.FormatUint(ls.Accepted, 10)}}
+	}))
+	w.metric("goproxy_listener_bytes_total", "counter", "Bytes read from and written to connections accepted by a listener.", listeners(func(i int, ls *proxy.ListenerStats) []sample {
+		return []sample{
+			{joinLabels(listenerLabels(i, ls), "direction", "in"), strconv.FormatUint(ls.BytesIn, 10)},
+			{joinLabels(listenerLabels(i, ls), "direction", "out"), strconv.FormatUint(ls.BytesOut, 10)},
+		}
+	}))
+
+	if bp != nil {
+		ps := bp.Stats()
+		w.metric("goproxy_buffer_pool_hits_total", "counter", "Buffers taken from the pool.", []sample{{"", strconv.FormatUint(ps.Hits, 10)}})
+		w.metric("goproxy_buffer_pool_misses_total", "counter", "Buffers allocated because the pool was empty.", []sample{{"", strconv.FormatUint(ps.Misses, 10)}})
+	}
+	return w.w.Flush()
+}
+
+//Handler返回输出指标的http.Handler
+//@sessions 每次请求时调用，返回当前的会话列表
+func Handler(sessions func() []Session, bp *proxy.BufferPool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", CONTENT_TYPE)
+		_ = WriteText(w, sessions(), bp)
+	})
+}
+
+//按名称排序输出标签
+func formatLabels(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	s := ""
+	for _, name := range names {
+		s = joinLabels(s, name, labels[name])
+	}
+	return s
+}
+
+func joinLabels(labels string, name string, value string) string {
+	l := name + "=\"" + labelEscaper.Replace(value) + "\""
+	if labels == "" {
+		return l
+	}
+	return labels + "," + l
+}
+
+var labelEscaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
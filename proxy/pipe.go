@@ -0,0 +1,125 @@
+// Copyright 2019 The goproxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"errors"
+	"net"
+)
+
+/*
+进程内监听，对端NEW_CONNECT命令的转发地址Domain为DOMAIN_PIPE时，不再连接网络地址，
+而是按Addr名称将内存管道交给Proxy.Listen返回的net.Listener，由调用者Accept处理
+*/
+
+const (
+	DOMAIN_PIPE = "pipe"
+	//未被Accept的连接数上限，超过时拒绝新连接
+	PIPE_BACKLOG = 64
+)
+
+var (
+	ErrPipeExists   = errors.New("pipe listener already exists")
+	ErrPipeNotFound = errors.New("pipe listener not found")
+	ErrPipeBacklog  = errors.New("pipe listener backlog full")
+	ErrPipeClosed   = errors.New("pipe listener closed")
+)
+
+//进程内监听地址
+type pipeAddr string
+
+func (a pipeAddr) Network() string {
+	return DOMAIN_PIPE
+}
+
+func (a pipeAddr) String() string {
+	return string(a)
+}
+
+type pipeListener struct {
+	name  string
+	proxy *Proxy
+	conns chan net.Conn
+	done  chan struct{}
+}
+
+//Listen在本端创建名为name的进程内监听，对端转发地址为{"Domain":"pipe","Addr":name}的连接
+//(包括对端Dial(ctx, "pipe", name))由返回的net.Listener接受，可直接用于http.Server等
+//同一代理对象内name不能重复，代理关闭时监听随之关闭
+func (p *Proxy) Listen(name string) (net.Listener, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if err := p.acceptable(); err != nil {
+		return nil, err
+	}
+	if _, ok := p.pipeListeners[name]; ok {
+		return nil, ErrPipeExists
+	}
+	l := &pipeListener{name: name, proxy: p}
+	l.conns = make(chan net.Conn, PIPE_BACKLOG)
+	l.done = make(chan struct{})
+	p.pipeListeners[name] = l
+	return l, nil
+}
+
+//为对端连接创建内存管道，一端交给监听者，另一端返回作为子连接句柄
+func (p *Proxy) dialPipe(name string) (net.Conn, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	l, ok := p.pipeListeners[name]
+	if !ok {
+		return nil, ErrPipeNotFound
+	}
+	local, remote := net.Pipe()
+	select {
+	case l.conns <- local:
+		return remote, nil
+	default:
+	}
+	local.Close()
+	remote.Close()
+	return nil, ErrPipeBacklog
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, ErrPipeClosed
+	}
+}
+
+//关闭监听并关闭未被接受的连接，调用者需持有proxy.mutex
+func (l *pipeListener) shutdown() {
+	select {
+	case <-l.done:
+		return
+	default:
+	}
+	close(l.done)
+	for {
+		select {
+		case c := <-l.conns:
+			c.Close()
+		default:
+			return
+		}
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.proxy.mutex.Lock()
+	defer l.proxy.mutex.Unlock()
+	l.shutdown()
+	if l.proxy.pipeListeners[l.name] == l {
+		delete(l.proxy.pipeListeners, l.name)
+	}
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return pipeAddr(l.name)
+}
@@ -9,14 +9,15 @@ package proxy
 通过NEW_CONNECT命令将ID和转发地址发送至对端，由对端连接至最终目的地，双方通过唯一ID识别转发的数据
 */
 import (
-	"crypto/aes"
-	"crypto/cipher"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	reuse "github.com/libp2p/go-reuseport"
-	"log"
 	"net"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -29,19 +30,56 @@ type Proxy struct {
 	idx uint32
 	//当前代理的ID
 	ID  uint32
-	keepaliveAt int64
-	//主连接
-	c net.Conn
+	//统计计数，见stats.go(原子访问，保持64位对齐)
+	bytesIn       uint64
+	bytesOut      uint64
+	framesIn      uint64
+	framesOut     uint64
+	windowStalls  uint64
+	dialFailures  uint64
+	policyDenials uint64
+	udpDrops      uint64
+	//主连接，见link.go，links由mutex保护，其余字段只在写go程中访问
+	//routes 子连接(ID|监听子连接标识<<32)固定使用的主连接
+	links      map[uint32]*link
+	linkIdx    uint32
+	liveLinks  int32
+	linkEvents []*linkEvent
+	linkNotify chan struct{}
+	routes     map[uint64]*link
+	//会话令牌
+	token []byte
+	//会话恢复等待时间(秒)，为0时所有主连接断开即结束会话
+	//suspendedAt 所有主连接断开的时间，held 期间无主连接可用的帧，只在写go程中访问
+	resumeTimeout int64
+	suspendedAt   int64
+	held          []*buffer
+	//会话结束后关闭
+	done chan struct{}
+	//对端请求的连接使用的context，会话结束时取消，见connect
+	dialCtx    context.Context
+	cancelDial context.CancelFunc
 	//缓存池
 	bp *BufferPool
 	//发送缓存
 	sendChan chan *buffer
 	//紧急消息
 	emergencyChan chan *buffer
-	//控制通道，发送CTRL_CMD_XX命令
-	ctrlChan chan byte
-	//加密aes128密钥
-	aesBlock cipher.Block
+	//会话结束原因
+	err error
+	//会话已结束，不再创建子连接
+	closed bool
+	//quit 由Close关闭，通知写go程退出，见lifecycle.go
+	//draining 正在平滑关闭，goaway 对端已发送PROXY_CMD_GOAWAY，由mutex保护
+	quit     chan struct{}
+	quitOnce sync.Once
+	draining bool
+	goaway   bool
+	//子连接接收窗口
+	window uint32
+	//本端可接收的帧数据区大小，对端可发送的帧数据区大小(原子访问)
+	frameSize     uint32
+	peerFrameSize uint32
 	//保护锁
 	mutex sync.RWMutex
 	//所有子连接go程计数、子连接、监听子连接列表
@@ -51,51 +89,151 @@ type Proxy struct {
 	//监听索引和列表
 	listenerIdx int
 	listeners   map[int]*Listener
+	//由NewPeerListener创建的对端监听，对端创建的本端监听(对端监听ID->本端监听ID)
+	peerListenerIdx int
+	peerListeners   map[int]*ListenerInfo
+	peerListenerIDs map[uint32]int
+	//等待对端监听结果的NewPeerListenerContext
+	listenWaiters map[int]chan listenResult
 	closedClient map[uint32]int64
+	//进程内监听，见Listen
+	pipeListeners map[string]*pipeListener
+	//会话参数，见config.go，NewProxy之后只读
+	cfg Config
+	//日志，见log.go
+	log Logger
 	//退出参数和回调函数
 	Ctx         interface{}
 	exitCB      callback
 }
 
-func init() {
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
+//Option NewProxy可选参数
+type Option func(p *Proxy)
+
+//WithInitialWindow设置每个子连接的接收窗口，即对端无需等待本端确认即可发送的字节数
+//窗口越大单连接吞吐越高，但慢速子连接占用的缓存也越多，超出[STREAM_WINDOW_BASE, MAX_STREAM_WINDOW]时取边界值
+func WithInitialWindow(size uint32) Option {
+	return func(p *Proxy) {
+		p.cfg.InitialWindow = size
+	}
+}
+
+//WithMaxFrameSize设置本端可接收的帧数据区大小，通过PROXY_CMD_SETTINGS通知对端
+//较大的帧可减少高速链路上的帧开销和系统调用次数，超出[FRAME_PAYLOAD_BASE, MAX_FRAME_PAYLOAD]时取边界值
+func WithMaxFrameSize(size uint32) Option {
+	return func(p *Proxy) {
+		p.cfg.MaxFrameSize = size
+	}
+}
+
+//WithSessionToken设置会话令牌，由handshake包在登录时设置
+func WithSessionToken(token []byte) Option {
+	return func(p *Proxy) {
+		p.token = token
+	}
+}
+
+//WithResumeTimeout设置会话恢复等待时间，所有主连接断开后会话保留timeout，子连接不受影响
+//期间客户端出示会话令牌加入的新主连接(见AddLink)接替断开的主连接，双方重发对端未处理的帧
+//为0(默认)时所有主连接断开即结束会话
+func WithResumeTimeout(timeout time.Duration) Option {
+	return func(p *Proxy) {
+		p.cfg.ResumeTimeout = timeout
+	}
+}
+
+//WithLogger设置会话日志，*slog.Logger可直接传入，为nil时使用DefaultLogger
+//日志都带有proxy字段，其值为会话ID
+func WithLogger(l Logger) Option {
+	return func(p *Proxy) {
+		p.cfg.Logger = l
+	}
+}
+
+//WithCipherSuites设置本端支持的加密套件，按优先级排序，用于登录握手，见handshake.Config
+func WithCipherSuites(suites []byte) Option {
+	return func(p *Proxy) {
+		p.cfg.CipherSuites = suites
+	}
 }
 
 //NewProxy创建新的代理对象
-//在调用本函数前，需要完成服务端和客户端连接并完成认证和aes128密钥协商
-func NewProxy(id uint32, c net.Conn, ctx interface{}, aesBlock cipher.Block, bp *BufferPool, exit callback) *Proxy {
-	if bp == nil || aesBlock == nil || c == nil {
+//在调用本函数前，需要完成服务端和客户端连接并完成认证、加密套件和密钥协商
+//@c 第一条主连接，其ID为0，其余主连接通过AddLink加入
+//@cp 由协商的加密套件和收发密钥创建的帧加密对象，见NewCipher
+//@exit 会话结束后调用，可为nil，使用Run时由其返回值获取结束原因
+//@opts 可选参数，如WithInitialWindow
+func NewProxy(id uint32, c net.Conn, ctx interface{}, cp *Cipher, bp *BufferPool, exit callback, opts ...Option) *Proxy {
+	if bp == nil || cp == nil || c == nil {
 		panic("buffer pool can not be nil")
 	}
-	p := &Proxy{ID: id, idx: 1, aesBlock: aesBlock, c: c, bp: bp, exitCB: exit, Ctx: ctx}
-	p.keepaliveAt = time.Now().Unix()
-	p.sendChan = make(chan *buffer, 256)
-	p.emergencyChan = make(chan *buffer, 16)
-	p.ctrlChan = make(chan byte, 64)
+	p := &Proxy{ID: id, idx: 1, bp: bp, exitCB: exit, Ctx: ctx, cfg: DefaultConfig()}
+	p.peerFrameSize = FRAME_PAYLOAD_BASE
+	for _, opt := range opts {
+		opt(p)
+	}
+	p.cfg.normalize()
+	p.window = p.cfg.InitialWindow
+	p.frameSize = p.cfg.MaxFrameSize
+	p.resumeTimeout = int64(p.cfg.ResumeTimeout / time.Second)
+	p.log = &proxyLogger{p: p, l: p.cfg.Logger}
+	p.sendChan = make(chan *buffer, p.cfg.SendQueueSize)
+	p.emergencyChan = make(chan *buffer, p.cfg.EmergencyQueueSize)
 	p.clients = make(map[uint32]*client)
 	p.subClients = make(map[uint32]*client)
 	p.listeners = make(map[int]*Listener)
+	p.peerListeners = make(map[int]*ListenerInfo)
+	p.peerListenerIDs = make(map[uint32]int)
+	p.listenWaiters = make(map[int]chan listenResult)
+	p.pipeListeners = make(map[string]*pipeListener)
 	p.closedClient = make(map[uint32] int64)
+	p.links = make(map[uint32]*link)
+	p.routes = make(map[uint64]*link)
+	p.linkNotify = make(chan struct{}, 1)
+	p.done = make(chan struct{})
+	p.dialCtx, p.cancelDial = context.WithCancel(context.Background())
+	p.quit = make(chan struct{})
+	l := newLink(0, c, cp, p)
+	p.links[0] = l
+	p.linkEvents = append(p.linkEvents, &linkEvent{kind: LINK_EVENT_UP, l: l})
 	return p
 }
 
-//aes128加密缓存，分两次加密，先加密头部，再加密数据区
-//@b 缓存
-func (p *Proxy) encryptBuffer(b *buffer) {
-	padding := byte(0)
-	//计算补零数
-	if b.size%aes.BlockSize != 0 {
-		padding = byte(aes.BlockSize - b.size%aes.BlockSize)
+//记录会话结束原因，只保留第一个错误
+func (p *Proxy) setErr(err error) {
+	p.mutex.Lock()
+	if p.err == nil {
+		p.err = err
 	}
-	//byte1高4位保留，低4位表示补齐字符数
-	b.data[1] &= 0xf0
-	b.data[1] += padding
-	b.size += int(padding)
-	b.data[2] = byte(b.size)
-	b.data[3] = byte(b.size >> 8)
-	for i:= 0; i < b.size; i += 16 {
-		p.aesBlock.Encrypt(b.data[i:i+16], b.data[i:i+16])
+	p.mutex.Unlock()
+}
+
+//记录对端声明的帧数据区大小
+func (p *Proxy) setPeerFrameSize(size uint32) {
+	if size < FRAME_PAYLOAD_BASE {
+		size = FRAME_PAYLOAD_BASE
 	}
+	if size > MAX_FRAME_PAYLOAD {
+		size = MAX_FRAME_PAYLOAD
+	}
+	atomic.StoreUint32(&p.peerFrameSize, size)
+}
+
+//本端可发送的帧数据区大小
+func (p *Proxy) peerFramePayload() int {
+	return int(atomic.LoadUint32(&p.peerFrameSize))
+}
+
+//Err返回会话结束原因，会话未结束时返回nil
+func (p *Proxy) Err() error {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.err
+}
+
+//Done返回会话结束后关闭的通道，在退出回调前关闭
+func (p *Proxy) Done() <-chan struct{} {
+	return p.done
 }
 
 //子连接退出回调
@@ -104,9 +242,13 @@ func (p *Proxy) clientExit(cli *client) {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
 	cli.sendBuffers.free()
+	cli.notifyConnected(ErrProxyClosed)
+	//同一ID可能已被新的子连接替换
 	if cli.subtype {
-		delete(p.subClients, cli.id)
-	} else {
+		if p.subClients[cli.id] == cli {
+			delete(p.subClients, cli.id)
+		}
+	} else if p.clients[cli.id] == cli {
 		delete(p.clients, cli.id)
 	}
 	p.wg.Done()
@@ -118,10 +260,25 @@ func (p *Proxy) clientExit(cli *client) {
 func (p *Proxy) accept(la *Listener, c net.Conn) {
 	body, err := json.Marshal(la.Forward)
 	if err != nil {
-		fmt.Printf("json marshal error, addr:%+v.\n", la.Forward)
+		p.log.Error("json marshal failed", "forward", la.Forward, "error", err)
 		return
 	}
+	if _, err := p.openStream(c, body, false, false); err != nil {
+		c.Close()
+	}
+}
+
+//创建监听子连接并向对端发送NEW_CONNECT命令
+//@c 本端连接句柄，可以是socket或内存管道
+//@body 转发地址json字串
+//@dial 是否等待对端连接结果
+//@packet 是否是数据报子连接
+func (p *Proxy) openStream(c net.Conn, body []byte, dial bool, packet bool) (*client, error) {
 	p.mutex.Lock()
+	if err := p.acceptable(); err != nil {
+		p.mutex.Unlock()
+		return nil, err
+	}
 	for {
 		p.idx++
 		if p.idx == 0 {
@@ -132,112 +289,535 @@ func (p *Proxy) accept(la *Listener, c net.Conn) {
 		}
 	}
 	cli := NewClient(p.idx, c, p, true)
+	cli.packet = packet
+	if dial {
+		cli.connected = make(chan error, 1)
+	}
 	p.subClients[p.idx] = cli
-	p.mutex.Unlock()
 	p.wg.Add(1)
+	p.mutex.Unlock()
 	go cli.handle()
 	//发送新连接命令
 	p.sendCommand(cli.subtype, cli.id, PROXY_CMD_NEW_CONNECT, nil, body)
+	p.sendInitialWindow(cli)
+	return cli, nil
 }
 
-//通知对端在新的地址上监听连接
-//@msg 监听地址和转发地址json字串
-//@msg 示例:[]byte("{\"Listen\":{\"Domain\":\"tcp\",\"Addr\":\"127.0.0.1:1513\"},\"Forward\":{\"Domain\":\"tcp\", \"Addr\":\"127.0.0.1:1022\"}}")
-func (p *Proxy) NewPeerListener(msg []byte) {
-	p.sendCommand(true, 0, PROXY_CMD_NEW_LISTEN, nil, msg)
+//Dial通过对端连接至network/addr，返回的net.Conn读写数据经主连接转发，不占用本地端口
+//对端连接成功后返回，对端连接失败返回ErrConnectFailed，ctx结束时放弃连接并返回ctx.Err()
+//network为udp时每次Write发送一个数据报，超过长度上限时返回ErrPacketTooLarge，
+//每次Read返回一个数据报，缓存应能容纳最大的数据报(UDP_MAX_DATAGRAM)，否则剩余部分在下次Read返回
+//@network 对端连接使用的协议，如"tcp"
+//@addr 对端连接的目的地址
+func (p *Proxy) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	body, err := json.Marshal(Address{Domain: network, Addr: addr})
+	if err != nil {
+		return nil, err
+	}
+	//local返回给调用者，remote作为子连接句柄
+	local, remote := net.Pipe()
+	cli, err := p.openStream(remote, body, true, isPacketDomain(network))
+	if err != nil {
+		local.Close()
+		remote.Close()
+		return nil, err
+	}
+	select {
+	case err = <-cli.connected:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		//关闭本端管道，子连接退出时通知对端关闭
+		local.Close()
+		return nil, err
+	}
+	if cli.packet {
+		return &packetPipe{Conn: local, proxy: p}, nil
+	}
+	return local, nil
 }
 
-//创建新的监听地址
+//通知对端在新的地址上监听连接，对端监听失败时定时重试，监听结果见PeerListeners
 //@msg 监听地址和转发地址json字串
 //@msg 示例:[]byte("{\"Listen\":{\"Domain\":\"tcp\",\"Addr\":\"127.0.0.1:1513\"},\"Forward\":{\"Domain\":\"tcp\", \"Addr\":\"127.0.0.1:1022\"}}")
-func (p *Proxy) NewListener(msg []byte) {
+//return 对端监听ID，用于ClosePeerListener，json格式错误或会话已结束时返回错误
+func (p *Proxy) NewPeerListener(msg []byte) (int, error) {
+	return p.newPeerListener(msg, nil)
+}
+
+//NewPeerListenerContext通知对端在新的地址上监听连接并等待监听结果
+//对端监听失败或ctx结束时关闭对端监听并返回错误，对端错误信息包含在ErrListenFailed中
+//return 对端监听信息，Addr为对端实际监听地址，Listen端口为0时由对端分配
+func (p *Proxy) NewPeerListenerContext(ctx context.Context, msg []byte) (ListenerInfo, error) {
+	ch := make(chan listenResult, 1)
+	id, err := p.newPeerListener(msg, ch)
+	if err != nil {
+		return ListenerInfo{}, err
+	}
+	var res listenResult
+	select {
+	case res = <-ch:
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-p.done:
+		err = ErrProxyClosed
+	}
+	if err == nil && res.Error != "" {
+		err = fmt.Errorf("%w: %s", ErrListenFailed, res.Error)
+	}
+	if err != nil {
+		p.mutex.Lock()
+		delete(p.listenWaiters, id)
+		p.mutex.Unlock()
+		_ = p.ClosePeerListener(id)
+		return ListenerInfo{}, err
+	}
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	if info, ok := p.peerListeners[id]; ok {
+		return *info, nil
+	}
+	return ListenerInfo{}, ErrListenerNotFound
+}
+
+//@ch 不为nil时接收对端的第一个监听结果
+func (p *Proxy) newPeerListener(msg []byte, ch chan listenResult) (int, error) {
 	var lsn Listener
 	if err := json.Unmarshal(msg, &lsn); err != nil {
-		fmt.Printf("json unmarshal error:%s.\n", err)
+		return 0, err
+	}
+	p.mutex.Lock()
+	if err := p.acceptable(); err != nil {
+		p.mutex.Unlock()
+		return 0, err
+	}
+	for {
+		p.peerListenerIdx++
+		if _, ok := p.peerListeners[p.peerListenerIdx]; !ok {
+			break
+		}
+	}
+	id := p.peerListenerIdx
+	p.peerListeners[id] = &ListenerInfo{ID: id, Listen: lsn.Listen, Forward: lsn.Forward, Kind: lsn.Kind}
+	if ch != nil {
+		p.listenWaiters[id] = ch
+	}
+	p.mutex.Unlock()
+	p.sendCommand(true, uint32(id), PROXY_CMD_NEW_LISTEN, nil, msg)
+	return id, nil
+}
+
+//ClosePeerListener通知对端关闭由NewPeerListener创建的监听
+func (p *Proxy) ClosePeerListener(id int) error {
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		return ErrProxyClosed
+	}
+	if _, ok := p.peerListeners[id]; !ok {
+		p.mutex.Unlock()
+		return ErrListenerNotFound
+	}
+	delete(p.peerListeners, id)
+	delete(p.listenWaiters, id)
+	p.mutex.Unlock()
+	p.sendCommand(true, uint32(id), PROXY_CMD_CLOSE_LISTEN, nil, nil)
+	return nil
+}
+
+//PeerListeners返回由NewPeerListener创建且未关闭的对端监听，按ID排序
+func (p *Proxy) PeerListeners() []ListenerInfo {
+	p.mutex.RLock()
+	list := make([]ListenerInfo, 0, len(p.peerListeners))
+	for _, info := range p.peerListeners {
+		list = append(list, *info)
+	}
+	p.mutex.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+//创建新的监听地址，监听失败时每秒重试，直至监听成功或被CloseListener关闭
+//@msg 监听地址和转发地址json字串
+//@msg 示例:[]byte("{\"Listen\":{\"Domain\":\"tcp\",\"Addr\":\"127.0.0.1:1513\"},\"Forward\":{\"Domain\":\"tcp\", \"Addr\":\"127.0.0.1:1022\"}}")
+//return 监听ID，用于CloseListener，json格式错误或会话已结束时返回错误
+func (p *Proxy) NewListener(msg []byte) (int, error) {
+	return p.newListener(msg, 0)
+}
+
+//@peerID 对端监听ID，不为0时监听由对端创建，监听结果通知对端
+func (p *Proxy) newListener(msg []byte, peerID uint32) (int, error) {
+	lsn := &Listener{peerID: peerID}
+	if err := json.Unmarshal(msg, lsn); err != nil {
+		return 0, err
+	}
+	p.mutex.Lock()
+	if err := p.acceptable(); err != nil {
+		p.mutex.Unlock()
+		return 0, err
+	}
+	for {
+		p.listenerIdx++
+		if _, ok := p.listeners[p.listenerIdx]; !ok {
+			break
+		}
+	}
+	lsn.id = p.listenerIdx
+	p.listeners[lsn.id] = lsn
+	if peerID != 0 {
+		p.peerListenerIDs[peerID] = lsn.id
+	}
+	p.mutex.Unlock()
+	go p.serveListener(lsn)
+	return lsn.id, nil
+}
+
+//CloseListener关闭本端监听，已建立的子连接不受影响
+func (p *Proxy) CloseListener(id int) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	lsn, ok := p.listeners[id]
+	if !ok {
+		return ErrListenerNotFound
+	}
+	delete(p.listeners, id)
+	lsn.close()
+	return nil
+}
+
+//Listeners返回本端未关闭的监听，包括对端通过NewPeerListener创建的监听，按ID排序
+func (p *Proxy) Listeners() []ListenerInfo {
+	p.mutex.RLock()
+	list := make([]ListenerInfo, 0, len(p.listeners))
+	for id, lsn := range p.listeners {
+		list = append(list, ListenerInfo{ID: id, Listen: lsn.Listen, Forward: lsn.Forward, Kind: lsn.Kind, Active: lsn.active, Addr: lsn.addr, Error: lsn.err})
+	}
+	p.mutex.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+//在监听地址上接受连接，监听句柄出错时重新监听，监听关闭后退出
+func (p *Proxy) serveListener(lsn *Listener) {
+	if lsn.peerID != 0 && !p.allowListen(lsn) {
 		return
 	}
-	id := -1
-	go func() {
-		for {
-			for {
-				l, err := reuse.Listen(lsn.Listen.Domain, lsn.Listen.Addr)
-				if err != nil || l == nil {
-					fmt.Printf("tcp listen (%s/%s)failed:%s.\n", lsn.Listen.Domain, lsn.Listen.Addr, err)
-					time.Sleep(time.Second * 1)
-					continue
-				}
-				lsn.active = true
-				lsn.l = l
-				p.mutex.Lock()
-				for {
-					p.listenerIdx++
-					if _, ok := p.listeners[p.listenerIdx]; ok == true {
-						continue
-					}
-					break
-				}
-				id = p.listenerIdx
-				//删除已有句柄
-				if _, ok := p.listeners[id]; ok != true {
-					delete(p.listeners, id)
-				}
-				p.listeners[id] = &lsn
-				p.mutex.Unlock()
+	for p.bindListener(lsn) {
+		var err error
+		if lsn.pc != nil {
+			err = p.servePacket(lsn)
+		}
+		for lsn.l != nil {
+			var c net.Conn
+			c, err = lsn.l.Accept()
+			if err != nil {
 				break
 			}
-			for {
-				c, err := lsn.l.Accept()
-				if err != nil {
-					if (lsn.active) {
-						fmt.Printf("accept tcp connection failed, error:%s\n", err.Error())
-					}
-					break
-				}
-				if c != nil {
-					go p.accept(&lsn, c)
-				}
+			if c == nil {
+				continue
 			}
-			if !lsn.active {
-				p.mutex.Lock()
-				delete(p.listeners, id)
-				p.mutex.Unlock()
-				break
+			atomic.AddUint64(&lsn.accepted, 1)
+			c = &countConn{Conn: c, lsn: lsn}
+			switch lsn.Kind {
+			case KIND_SOCKS5:
+				go p.acceptSocks5(lsn, c)
+			case KIND_HTTP:
+				go p.acceptHTTP(lsn, c)
+			default:
+				go p.accept(lsn, c)
 			}
 		}
-	}()
+		p.unbindListener(lsn, err)
+	}
 }
 
-//创建子连接，对端的监听地址上产生新连接时通过NET_CONNECT命令将待连接本地址址通知本端
-//@id对端分配的连接ID
-//@msg连接地址json字串
-func (p *Proxy) newConnection(id uint32, msg []byte) (bufferUsed bool) {
+//检查对端创建的监听是否经ListenPolicy允许，主机名解析可能较慢，不在主连接读go程中进行
+//不允许时删除监听并通知对端
+func (p *Proxy) allowListen(lsn *Listener) bool {
+	ctx, cancel := context.WithTimeout(p.dialCtx, p.cfg.DialTimeout)
+	addr, err := p.cfg.ListenPolicy.checkListen(ctx, lsn.Listen)
+	cancel()
+	p.mutex.Lock()
+	if err == nil {
+		lsn.Listen = addr
+		p.mutex.Unlock()
+		return true
+	}
+	if errors.Is(err, ErrAccessDenied) {
+		atomic.AddUint64(&p.policyDenials, 1)
+	}
+	stopped := lsn.stopped
+	lsn.stopped = true
+	if p.listeners[lsn.id] == lsn {
+		delete(p.listeners, lsn.id)
+	}
+	if p.peerListenerIDs[lsn.peerID] == lsn.id {
+		delete(p.peerListenerIDs, lsn.peerID)
+	}
+	p.mutex.Unlock()
+	p.log.Warn("peer listener failed", "listener", lsn.peerID, "error", err)
+	if !stopped {
+		p.sendListenResult(lsn, listenResult{Error: err.Error()})
+	}
+	return false
+}
+
+//监听出错后关闭监听句柄，1秒后重新监听，避免旧句柄仍占用地址，如unix域套接字文件被判断为正在使用
+//lsn.l和lsn.pc只在监听go程中修改
+func (p *Proxy) unbindListener(lsn *Listener, err error) {
+	p.mutex.Lock()
+	if lsn.stopped {
+		//已由close关闭
+		p.mutex.Unlock()
+		return
+	}
+	lsn.active = false
+	lsn.addr = ""
+	if err != nil {
+		lsn.err = err.Error()
+	}
+	if lsn.l != nil {
+		_ = lsn.l.Close()
+		lsn.l = nil
+	}
+	if lsn.pc != nil {
+		_ = lsn.pc.Close()
+		lsn.pc = nil
+	}
+	p.mutex.Unlock()
+	p.log.Warn("accept failed", "listen", lsn.Listen, "error", err)
+	time.Sleep(time.Second * 1)
+}
+
+//监听地址，失败时每秒重试
+//return 是否监听成功，监听已关闭时返回false
+func (p *Proxy) bindListener(lsn *Listener) bool {
 	for {
-		var addr Address
-		if err := json.Unmarshal(msg, &addr); err != nil {
-			fmt.Printf("json unmarshal error:%s.\n", err)
-			break
+		//监听关闭后不再重新监听，避免重新创建unix域套接字文件
+		p.mutex.RLock()
+		stopped := lsn.stopped
+		p.mutex.RUnlock()
+		if stopped {
+			return false
 		}
-		n, err := net.Dial(addr.Domain, addr.Addr)
-		if err != nil {
-			fmt.Printf("连接到%s %s失败, error:%s.\n", addr.Domain, addr.Addr, err.Error())
-			break
+		var l net.Listener
+		var pc net.PacketConn
+		var err error
+		if isPacketDomain(lsn.Listen.Domain) {
+			pc, err = reuse.ListenPacket(lsn.Listen.Domain, lsn.Listen.Addr)
+			if err == nil && pc == nil {
+				err = errors.New("nil packet conn")
+			}
+		} else {
+			if lsn.Listen.Domain == DOMAIN_UNIX {
+				l, err = listenUnix(lsn.Listen.Addr, lsn.Mode)
+			} else {
+				l, err = reuse.Listen(lsn.Listen.Domain, lsn.Listen.Addr)
+			}
+			if err == nil && l == nil {
+				err = errors.New("nil listener")
+			}
 		}
-		cli := NewClient(id, n, p, false)
 		p.mutex.Lock()
-		if client, ok := p.clients[id]; ok == true {
-			client.ctrlChan <- CTRL_CMD_EXIT
-			delete(p.clients, id)
+		if lsn.stopped {
+			p.mutex.Unlock()
+			if l != nil {
+				_ = l.Close()
+			}
+			if pc != nil {
+				_ = pc.Close()
+			}
+			return false
 		}
-		p.clients[id] = cli
+		if err == nil {
+			lsn.l = l
+			lsn.pc = pc
+			lsn.active = true
+			lsn.failed = false
+			lsn.err = ""
+			if l != nil {
+				lsn.addr = l.Addr().String()
+			} else {
+				lsn.addr = pc.LocalAddr().String()
+			}
+			addr := lsn.addr
+			p.mutex.Unlock()
+			p.sendListenResult(lsn, listenResult{Addr: addr})
+			return true
+		}
+		lsn.active = false
+		lsn.addr = ""
+		lsn.err = err.Error()
+		report := !lsn.failed
+		lsn.failed = true
 		p.mutex.Unlock()
-		p.wg.Add(1)
-		go cli.handle()
-		return false
+		if report {
+			p.sendListenResult(lsn, listenResult{Error: err.Error()})
+		}
+		p.log.Warn("listen failed", "listen", lsn.Listen, "error", err)
+		time.Sleep(time.Second * 1)
 	}
-	fmt.Printf("创建子连接失败, id:%d", id)
-	//发送命令关闭对端监听子连接(本端非监听子连接)
-	p.sendCommand(false, id, PROXY_CMD_CLOSE_CONNECT, nil, nil)
-	return true
+}
+
+//通知对端其创建的监听的结果，监听由本端创建时忽略
+func (p *Proxy) sendListenResult(lsn *Listener, res listenResult) {
+	if lsn.peerID == 0 {
+		return
+	}
+	body, err := json.Marshal(&res)
+	if err != nil {
+		return
+	}
+	p.sendCommand(false, lsn.peerID, PROXY_CMD_LISTEN_RESULT, nil, body)
+}
+
+//对端通过PROXY_CMD_NEW_LISTEN请求本端监听
+//@id 对端监听ID，对端据此关闭监听
+func (p *Proxy) peerNewListener(id uint32, msg []byte) {
+	if _, err := p.newListener(msg, id); err != nil {
+		p.log.Warn("peer listener failed", "listener", id, "error", err)
+		res, _ := json.Marshal(&listenResult{Error: err.Error()})
+		p.sendCommand(false, id, PROXY_CMD_LISTEN_RESULT, nil, res)
+	}
+}
+
+//对端通知NewPeerListener创建的监听的结果
+func (p *Proxy) peerListenResult(id uint32, msg []byte) {
+	var res listenResult
+	if err := json.Unmarshal(msg, &res); err != nil {
+		p.log.Warn("invalid listen result", "listener", id, "error", err)
+		return
+	}
+	p.mutex.Lock()
+	info, ok := p.peerListeners[int(id)]
+	if !ok {
+		p.mutex.Unlock()
+		return
+	}
+	info.Active = res.Error == ""
+	info.Addr = res.Addr
+	info.Error = res.Error
+	ch, wait := p.listenWaiters[int(id)]
+	delete(p.listenWaiters, int(id))
+	p.mutex.Unlock()
+	if wait {
+		ch <- res
+	}
+	if res.Error != "" {
+		p.log.Warn("peer listen failed", "listen", info.Listen, "error", res.Error)
+	}
+}
+
+//对端通过PROXY_CMD_CLOSE_LISTEN关闭其创建的监听
+func (p *Proxy) peerCloseListener(id uint32) {
+	p.mutex.Lock()
+	lid, ok := p.peerListenerIDs[id]
+	delete(p.peerListenerIDs, id)
+	p.mutex.Unlock()
+	if ok {
+		_ = p.CloseListener(lid)
+	}
+}
+
+//连接对端请求的转发地址，地址需经DialPolicy允许
+//@ctx 包含DialTimeout，会话结束时取消
+func (p *Proxy) dialForward(ctx context.Context, addr Address) (net.Conn, error) {
+	addrs, err := p.cfg.DialPolicy.checkDial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		var n net.Conn
+		if a.Domain == DOMAIN_PIPE {
+			n, err = p.dialPipe(a.Addr)
+		} else {
+			n, err = p.cfg.Dial(ctx, a.Domain, a.Addr)
+		}
+		if err == nil {
+			return n, nil
+		}
+	}
+	return nil, err
+}
+
+//创建子连接，对端的监听地址上产生新连接时通过NET_CONNECT命令将待连接本地址址通知本端
+//子连接先行登记，连接完成前收到的数据暂存在发送缓存中，在单独的go程中连接转发地址，
+//慢速或不可达的转发地址不阻塞主连接读go程上的其他子连接
+//@id对端分配的连接ID
+//@msg连接地址json字串
+func (p *Proxy) newConnection(id uint32, msg []byte) {
+	var addr Address
+	if err := json.Unmarshal(msg, &addr); err != nil {
+		p.log.Warn("invalid forward address", "stream", id, "error", err)
+		atomic.AddUint64(&p.dialFailures, 1)
+		p.sendCommand(false, id, PROXY_CMD_CLOSE_CONNECT, nil, nil)
+		return
+	}
+	cli := NewClient(id, nil, p, false)
+	cli.packet = isPacketDomain(addr.Domain)
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		return
+	}
+	if p.draining {
+		p.mutex.Unlock()
+		p.sendCommand(false, id, PROXY_CMD_CLOSE_CONNECT, nil, nil)
+		return
+	}
+	if client, ok := p.clients[id]; ok == true {
+		select {
+		case client.ctrlChan <- CTRL_CMD_EXIT:
+		default:
+		}
+		delete(p.clients, id)
+	}
+	p.clients[id] = cli
+	p.wg.Add(1)
+	p.mutex.Unlock()
+	go p.connect(cli, addr)
+}
+
+//连接转发地址，成功后运行子连接，失败时通知对端关闭
+//@cli newConnection登记的子连接，连接句柄为nil
+func (p *Proxy) connect(cli *client, addr Address) {
+	ctx, cancel := context.WithTimeout(p.dialCtx, p.cfg.DialTimeout)
+	n, err := p.dialForward(ctx, addr)
+	cancel()
+	p.mutex.Lock()
+	closed := p.closed
+	if err == nil && !closed {
+		cli.c = n
+	}
+	p.mutex.Unlock()
+	if closed {
+		if n != nil {
+			n.Close()
+		}
+		p.clientExit(cli)
+		return
+	}
+	if err != nil {
+		if errors.Is(err, ErrAccessDenied) {
+			atomic.AddUint64(&p.policyDenials, 1)
+			p.log.Warn("forward address denied", "stream", cli.id, "forward", addr, "error", err)
+		} else {
+			p.log.Warn("connect to forward address failed", "stream", cli.id, "forward", addr, "error", err)
+			if hook := p.cfg.Hooks.DialFailure; hook != nil {
+				hook(p, addr, err)
+			}
+		}
+		atomic.AddUint64(&p.dialFailures, 1)
+		//发送命令关闭对端监听子连接(本端非监听子连接)
+		p.sendCommand(false, cli.id, PROXY_CMD_CLOSE_CONNECT, nil, nil)
+		p.clientExit(cli)
+		return
+	}
+	//先于子连接数据发送，对端Dial据此返回
+	p.sendCommand(false, cli.id, PROXY_CMD_CONNECT_OK, nil, nil)
+	p.sendInitialWindow(cli)
+	cli.handle()
 }
 
 //数据处理器，首先处理主连接自有命令
@@ -245,28 +825,36 @@ func (p *Proxy) newConnection(id uint32, msg []byte) (bufferUsed bool) {
 //return bufferUsed缓存是否已使用，供调用函数判断是否需要释放缓存
 func (p *Proxy) readProc(b *buffer) (bufferUsed bool) {
 	bufferUsed = false
-	cmd := b.data[0] & 0x0f
-	//主连接自有命令,ID无效
-	if cmd == PROXY_CMD_NEW_LISTEN {
-		p.NewListener(b.data[8:b.size])
-		return
-	}
-	if cmd == PROXY_CMD_KEEPALIVE {
-		p.keepaliveAt = time.Now().Unix()
-		return
-	}
+	cmd := b.data[3] & 0x1f
 	ok := false
 	cli := (*client)(nil)
 	id := uint32(b.data[4])
 	id += uint32(b.data[5]) << 8
 	id += uint32(b.data[6]) << 16
 	id += uint32(b.data[7]) << 24
+	//监听命令，ID为对端监听ID
+	if cmd == PROXY_CMD_NEW_LISTEN {
+		p.peerNewListener(id, b.data[8:b.size])
+		return
+	}
+	if cmd == PROXY_CMD_CLOSE_LISTEN {
+		p.peerCloseListener(id)
+		return
+	}
+	if cmd == PROXY_CMD_LISTEN_RESULT {
+		p.peerListenResult(id, b.data[8:b.size])
+		return
+	}
 	if cmd == PROXY_CMD_NEW_CONNECT {
-		bufferUsed = p.newConnection(id, b.data[8:b.size])
+		p.newConnection(id, b.data[8:b.size])
+		return
+	}
+	if cmd == PROXY_CMD_GOAWAY {
+		p.peerGoAway()
 		return
 	}
 	//子连接命令，通过ID查找对应的连接句柄
-	subtype := (b.data[0] & 0x80) != 0
+	subtype := (b.data[3] & 0x80) != 0
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
 	if subtype {
@@ -280,7 +868,7 @@ func (p *Proxy) readProc(b *buffer) (bufferUsed bool) {
 	if ok == false {
 		if cmd != PROXY_CMD_CLOSE_CONNECT {
 			if _, ok := p.closedClient[id]; !ok {
-				fmt.Printf("unkown connection, type:%v, id:%d.\n", subtype, id)
+				p.log.Debug("unknown stream", "stream", id, "subtype", subtype)
 				p.sendCommand(!subtype, id, PROXY_CMD_CLOSE_CONNECT, b, nil)
 				p.closedClient[id] = time.Now().Unix()
 				bufferUsed = true
@@ -289,126 +877,45 @@ func (p *Proxy) readProc(b *buffer) (bufferUsed bool) {
 		return
 	}
 	switch cmd {
-	//子连接暂停接收,将在子连接调用clientSendCommand时阻塞起到收到PROXY_CMD_RUN
-	case PROXY_CMD_PAUSE:
-		cli.pause = true
+	//对端归还发送窗口，唤醒等待窗口的读go程
+	case PROXY_CMD_WINDOW_UPDATE:
+		if b.size == 12 {
+			cli.addSendWindow(uint32(b.data[8]) | uint32(b.data[9])<<8 | uint32(b.data[10])<<16 | uint32(b.data[11])<<24)
+		}
 		return
-	//子连接恢复接收
-	case PROXY_CMD_RUN:
-		cli.pause = false
+	case PROXY_CMD_CONNECT_OK:
+		cli.notifyConnected(nil)
 		return
 	case PROXY_CMD_CLOSE_CONNECT:
+		//Dial等待期间收到关闭命令表示对端连接失败
+		cli.notifyConnected(ErrConnectFailed)
 		select {
 		case cli.ctrlChan <- CTRL_CMD_EXIT:
 		default:
 		}
 	case PROXY_CMD_DATA:
-		//将缓存发送至子连接
-		//使用链表存储待发送数据而非通道
-		//向ctrl通道发送消息有新缓存的消息
-		cli.sendBuffers.append(b, false)
-		cli.ctrlChan <- CTRL_CMD_DATA
-		bufferUsed = true
-	}
-	return
-}
-
-//主连接读go程
-func (p *Proxy) read() {
-	p.wg.Add(1)
-	var b *buffer
-	size := 0
-	flag := 0
-	last := time.Now().UnixNano()
-	for {
-		if b == nil {
-			b = p.bp.get()
-			if b == nil {
-				goto err
-			}
-			flag = 0
-			size = 0
-		}
-		//设置读超时并在超时时生成TICK信号用于清理空闲缓存
-		_ = p.c.SetReadDeadline(time.Now().Add(TICK))
-		n, err := p.c.Read(b.data[size:])
-		if err != nil {
-			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-				now := time.Now().UnixNano()
-				if now - last > int64(TICK) {
-					p.ctrlChan <- CTRL_CMD_TICK
-					last = now
-				}
-				continue
+		//对端超出接收窗口，关闭子连接
+		if !cli.useRecvWindow(b.size - 8) {
+			p.log.Warn("stream window exceeded", "stream", id, "subtype", subtype)
+			select {
+			case cli.ctrlChan <- CTRL_CMD_EXIT:
+			default:
 			}
-			goto err
-		}
-		now := time.Now().UnixNano()
-		if now - last > int64(TICK) {
-			p.ctrlChan <- CTRL_CMD_TICK
-			last = now
+			return
 		}
-		size += n
-		for {
-			//头部未读取完
-			if size < aes.BlockSize {
-				break
-			}
-			//头部未解密时需要先解出头部，确认数据大小
-			if flag&PROXY_FLAG_HEAD_DECRYPTED == 0 {
-				//解密头部
-				p.aesBlock.Decrypt(b.data[0:aes.BlockSize], b.data[0:aes.BlockSize])
-				b.size = int(b.data[2])
-				b.size += int(b.data[3]) << 8
-				//数量大于buffer限制的值或数量不少于16字节或size非16字节对齐
-				if b.size > cap(b.data) || b.size < aes.BlockSize || (b.size%aes.BlockSize) > 0 {
-					goto err
-				}
-				flag |= PROXY_FLAG_HEAD_DECRYPTED
-			}
-			//数据未读取完
-			if size < b.size {
-				break
-			}
-			//解密剩余数据
-			for i:= aes.BlockSize; i < b.size; i += 16 {
-				p.aesBlock.Decrypt(b.data[i:i+16], b.data[i:i+16])
-			}
-			//数据量多于一个包，暂存在newB中
-			var newB *buffer = nil
-			if b.size < size {
-				//有多余数据，循环处理
-				newB = p.bp.get()
-				if newB == nil {
-					goto err
-				}
-				copy(newB.data, b.data[b.size:size])
-				size -= b.size
-			} else {
-				size = 0
-			}
-			flag = 0
-			//减去aes加密时补齐的字符
-			b.size -= int(b.data[1] & 0x0f)
-			bufferUsed := p.readProc(b)
-			if !bufferUsed {
-				p.bp.put(b)
-			}
-			b = nil
-			//有多余数据，存放在newB
-			if newB != nil {
-				b = newB
-			} else {
-				break
+		//将缓存发送至子连接
+		//使用链表存储待发送数据而非通道，缓存总量受接收窗口限制
+		//同时只有一个未处理的数据通知，ctrl通道不会被数据通知占满而丢失之后的关闭命令，慢速子连接不会阻塞主连接
+		cli.sendBuffers.append(b, false)
+		if atomic.CompareAndSwapInt32(&cli.dataNotified, 0, 1) {
+			select {
+			case cli.ctrlChan <- CTRL_CMD_DATA:
+			default:
 			}
 		}
+		bufferUsed = true
 	}
-err:
-	if b != nil {
-		p.bp.put(b)
-	}
-	p.ctrlChan <- CTRL_CMD_EXIT
-	p.wg.Done()
+	return
 }
 
 //数据组装函数
@@ -416,19 +923,28 @@ err:
 //@b 待发达缓存，不为空则利用该缓存，nil则重新分配；
 //@body 待发送数据，不为空则将数据写入缓存数据区
 func (p *Proxy) buildCommand(subtype bool, id uint32, cmd byte, b *buffer, body []byte) *buffer{
+	//命令可能在收到对端PROXY_CMD_SETTINGS前发送，数据区不超过FRAME_PAYLOAD_BASE
+	if len(body) > FRAME_PAYLOAD_BASE {
+		p.log.Error("command body too large", "stream", id, "cmd", cmd, "size", len(body))
+		if b != nil {
+			p.bp.put(b)
+		}
+		return nil
+	}
 	//头部占用8字节
 	if b == nil {
 		b = p.bp.get()
 		if b == nil {
-			fmt.Printf("allocate new buffer failed, exit.\n")
+			p.log.Error("allocate buffer failed")
 			return nil
 		}
 		b.size = 8
 	}
-	//data[0]低5位表示PROXY_CMD_XX命令
-	b.data[0] = cmd & 0x1f
+	//data[0-2]为密文长度，在写go程加密时填写
+	//data[3]低5位表示PROXY_CMD_XX命令
+	b.data[3] = cmd & 0x1f
 	if subtype {
-		b.data[0] |= 0x80
+		b.data[3] |= 0x80
 	}
 	//data[4-7]为连接ID，小端
 	b.data[4] = byte(id)
@@ -439,9 +955,6 @@ func (p *Proxy) buildCommand(subtype bool, id uint32, cmd byte, b *buffer, body
 		copy(b.data[8:len(body)+8], body)
 		b.size = 8 + len(body)
 	}
-	//data[2-3]为加密后数据大小，含头部
-	//data[1]低4位为aes128加密时补齐字节数
-	p.encryptBuffer(b)
 	return b
 }
 
@@ -455,113 +968,133 @@ func (p *Proxy) sendCommand(subtype bool, id uint32, cmd byte, b *buffer, body [
 		return
 	}
 	//尽快发送，如发送不及时，在此处阻塞
-	if cmd == PROXY_CMD_PAUSE || cmd == PROXY_CMD_RUN {
+	if cmd == PROXY_CMD_WINDOW_UPDATE {
 		p.emergencyChan <- b
 	} else {
 		p.sendChan <- b
 	}
 }
 
-//子连接发送命令/数据函数
-func (p *Proxy) clientSendCommand(cli *client, cmd byte, b *buffer, body []byte) {
-	p.sendCommand(cli.subtype, cli.id, cmd, b, body)
+//向对端发送窗口增量
+//@urgent 是否经紧急通道发送，子连接创建时的首个增量需在NEW_CONNECT/CONNECT_OK之后按序发送
+func (p *Proxy) sendWindowUpdate(cli *client, inc uint32, urgent bool) {
+	body := []byte{byte(inc), byte(inc >> 8), byte(inc >> 16), byte(inc >> 24)}
+	b := p.buildCommand(cli.subtype, cli.id, PROXY_CMD_WINDOW_UPDATE, nil, body)
+	if b == nil {
+		return
+	}
+	if urgent {
+		p.emergencyChan <- b
+	} else {
+		p.sendChan <- b
+	}
 }
 
-//将缓存写入socket
-//@b 待写入缓存
-func (p *Proxy) writeBuffer(b *buffer) bool {
-	offset := 0
-	if b.size > cap(b.data) || b.size < aes.BlockSize || (b.size%aes.BlockSize) > 0 {
-		panic("buffer size error")
-	}
-	for {
-		cnt, err := p.c.Write(b.data[offset:b.size])
-		if err != nil {
-			fmt.Printf("write with error:%s.\n", err.Error())
-			return false
-		}
-		if cnt+offset == b.size {
-			break
-		}
-		offset += cnt
-		continue
+//本端接收窗口大于STREAM_WINDOW_BASE时通知对端补足差值
+func (p *Proxy) sendInitialWindow(cli *client) {
+	if p.window > STREAM_WINDOW_BASE {
+		p.sendWindowUpdate(cli, p.window-STREAM_WINDOW_BASE, false)
 	}
-	//释放缓存，如有必要，可以清理
-	p.bp.put(b)
-	return true
 }
 
+//子连接发送命令/数据函数
+func (p *Proxy) clientSendCommand(cli *client, cmd byte, b *buffer, body []byte) {
+	p.sendCommand(cli.subtype, cli.id, cmd, b, body)
+}
 
-//主连接写和事件处理go程
-//1. 如发生各种事件，向ctrlChan发送命令字
-//2. 如有数据需要发送，向sendChan发送buffer指针
-//3. 应急数据向emergencyChan发送buffer指针
+//写和事件处理go程
+//1. 如有数据需要发送，向sendChan发送buffer指针，由本go程分配至主连接发送
+//2. 应急数据向emergencyChan发送buffer指针
+//3. 主连接的加入和断开通过linkNotify通知
 func (p *Proxy) write() {
-	go p.read()
-	var b *buffer = nil
-	tickms := 0
+	ticker := time.NewTicker(p.cfg.Tick)
+	defer ticker.Stop()
+	//启动NewProxy传入的主连接
+	if !p.handleLinkEvents() {
+		goto err
+	}
 	for {
 		select {
-		case b = <-p.emergencyChan:
-		case b = <-p.sendChan:
-		case cmd := <-p.ctrlChan:
-			switch cmd {
-			case CTRL_CMD_EXIT:
+		case b := <-p.emergencyChan:
+			p.route(b)
+		case b := <-p.sendChan:
+			p.route(b)
+		case <-p.linkNotify:
+			if !p.handleLinkEvents() {
 				goto err
-			case CTRL_CMD_TICK:
-				now := time.Now().Unix()
-				if now - p.keepaliveAt > 120 {
-					goto err
-				}
-				tickms += int(TICK) / 1000000
-				if tickms > 1000 {
-					p.mutex.Lock()
-					for k, v := range p.closedClient {
-						if v + 1 < now {
-							delete(p.closedClient, k)
-						}
-					}
-					p.mutex.Unlock()
-				}
-				if tickms > 60000 {
-					tickms -= 60000
-					b = p.buildCommand(false, 0, PROXY_CMD_KEEPALIVE, nil, nil)
-				}
 			}
-		}
-		if b != nil {
-			if ok := p.writeBuffer(b); !ok {
-				p.bp.put(b)
+		case <-ticker.C:
+			if !p.tickLinks() {
 				goto err
 			}
-			b = nil
+			now := time.Now().Unix()
+			p.mutex.Lock()
+			for k, v := range p.closedClient {
+				if v + 1 < now {
+					delete(p.closedClient, k)
+				}
+			}
+			p.mutex.Unlock()
+		case <-p.quit:
+			goto err
 		}
 	}
 err:
-	p.c.Close()
+	p.publishGoAway()
+	if err := p.Err(); err != nil {
+		p.log.Info("proxy closed", "error", err)
+	}
+	p.cancelDial()
 	p.mutex.Lock()
+	p.closed = true
+	for _, l := range p.links {
+		l.close(nil)
+	}
+	atomic.StoreInt32(&p.liveLinks, 0)
+	for name, l := range p.pipeListeners {
+		l.shutdown()
+		delete(p.pipeListeners, name)
+	}
 	for _, lsn := range p.listeners {
-		if lsn.l != nil {
-			lsn.active = false
-			_ = lsn.l.Close()
-		}
+		lsn.close()
 	}
+	//关闭子连接句柄，避免子连接阻塞在写操作(如Dial返回的管道未被读取)
 	for _, cli := range p.clients {
 		select {
 		case cli.ctrlChan <- CTRL_CMD_FORCE_EXIT:
 		default:
 		}
+		//正在连接转发地址的子连接没有连接句柄，由connect退出
+		if cli.c != nil {
+			_ = cli.c.Close()
+		}
 	}
 	for _, cli := range p.subClients {
 		select {
 		case cli.ctrlChan <- CTRL_CMD_FORCE_EXIT:
 		default:
 		}
+		_ = cli.c.Close()
 	}
 	p.mutex.Unlock()
-	p.wg.Wait()
-	finish := false
-	for !finish {
+	//等待子连接和主连接go程退出，期间丢弃待发送的数据，避免阻塞在发送通道上的go程无法退出
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	for finish := false; !finish; {
+		select {
+		case b := <-p.emergencyChan:
+			p.bp.put(b)
+		case b := <-p.sendChan:
+			p.bp.put(b)
+		case <-p.linkNotify:
+		case <-done:
+			finish = true
+		}
+	}
+	for finish := false; !finish; {
 		select {
 		case b := <-p.emergencyChan:
 			p.bp.put(b)
@@ -571,27 +1104,28 @@ err:
 			finish = true
 		}
 	}
-	p.exitCB(p)
+	p.mutex.Lock()
+	for _, l := range p.links {
+		l.free()
+	}
+	p.linkEvents = nil
+	p.mutex.Unlock()
+	for _, b := range p.held {
+		p.bp.put(b)
+	}
+	p.held = nil
+	close(p.done)
+	if p.exitCB != nil {
+		p.exitCB(p)
+	}
 }
 
 //代理处理函数
-//@c 主连接，用于承载服务器之间数据传输，需要完成必要的认证和aes128密钥分配
-//由读go程负责读取，读入数据都经aes128加密，需要解密后发送给子连接或监听子连接
-//由主连接发送的数据都需要aes128加密，子连接或监听子连接发送数据时通过sendChan传入主线程
+//@c 主连接，用于承载服务器之间数据传输，需要完成必要的认证和密钥协商
+//由读go程负责读取，读入数据都经AEAD加密，需要解密认证后发送给子连接或监听子连接
+//由主连接发送的数据都需要AEAD加密，子连接或监听子连接发送数据时通过sendChan传入主线程
 //发送或接受的包大小受buffer限制，大于buffer限制的包需要手动分包
+//与Run(context.Background())相同，会话结束后调用NewProxy传入的exit回调，新代码使用Run
 func (p *Proxy) Handle() {
 	p.write()
 }
-
-
-//主动退出函数
-//@c 主连接，用于承载服务器之间数据传输，需要完成必要的认证和aes128密钥分配
-//由读go程负责读取，读入数据都经aes128加密，需要解密后发送给子连接或监听子连接
-//由主连接发送的数据都需要aes128加密，子连接或监听子连接发送数据时通过sendChan传入主线程
-//发送或接受的包大小受buffer限制，大于buffer限制的包需要手动分包
-func (p *Proxy) Close() {
-	select {
-	case p.ctrlChan <- CTRL_CMD_EXIT:
-	default:
-	}
-}
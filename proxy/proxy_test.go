@@ -0,0 +1,298 @@
+// Copyright 2019 The goproxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//创建通过一条TCP主连接相连的两个会话，p1为发起方
+func testPair(t testing.TB, o1, o2 []Option) (*Proxy, *Proxy) {
+	t.Helper()
+	c1, c2 := testConnPair(t)
+	cp1, cp2 := testCipherPair(t, CIPHER_AES_128_GCM)
+	bp := NewBufferPool(1024)
+	p1 := NewProxy(1, c1, nil, cp1, bp, nil, o1...)
+	p2 := NewProxy(2, c2, nil, cp2, bp, nil, o2...)
+	go p1.Handle()
+	go p2.Handle()
+	return p1, p2
+}
+
+//由同一密钥派生的发起方和接收方加密对象
+func testCipherPair(t testing.TB, suite byte) (*Cipher, *Cipher) {
+	t.Helper()
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	s1, r1, err := DeriveKeys(suite, secret, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2, r2, err := DeriveKeys(suite, secret, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp1, err := NewCipher(suite, s1, r1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp2, err := NewCipher(suite, s2, r2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cp1, cp2
+}
+
+//等待条件成立，超时时测试失败
+func testWait(t testing.TB, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+//本地TCP连接对
+func testConnPair(t testing.TB) (net.Conn, net.Conn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	ch := make(chan net.Conn, 1)
+	go func() {
+		c, _ := l.Accept()
+		ch <- c
+	}()
+	c1, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2 := <-ch
+	if c2 == nil {
+		t.Fatal("accept failed")
+	}
+	return c1, c2
+}
+
+//TCP回显服务，返回监听地址，关闭返回的监听即停止
+func testEchoServer(t testing.TB) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return l
+}
+
+//监听信息
+func testListenerInfo(p *Proxy, id int) ListenerInfo {
+	for _, info := range p.Listeners() {
+		if info.ID == id {
+			return info
+		}
+	}
+	return ListenerInfo{}
+}
+
+//accept出错后关闭旧的监听句柄并重新监听
+func TestListenerRebind(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	echo := testEchoServer(t)
+	defer echo.Close()
+	p1, p2 := testPair(t, nil, nil)
+	defer p1.Close()
+	defer p2.Close()
+	path := filepath.Join(dir, "l.sock")
+	msg, _ := json.Marshal(Listener{
+		Listen:  Address{Domain: DOMAIN_UNIX, Addr: path},
+		Forward: Address{Domain: "tcp", Addr: echo.Addr().String()},
+	})
+	id, err := p1.NewListener(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testWait(t, "listen", func() bool { return testListenerInfo(p1, id).Active })
+	//accept超时出错，监听句柄仍然打开
+	p1.mutex.RLock()
+	err = p1.listeners[id].l.(*net.UnixListener).SetDeadline(time.Now())
+	p1.mutex.RUnlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testWait(t, "accept error", func() bool { return !testListenerInfo(p1, id).Active })
+	testWait(t, "rebind", func() bool { return testListenerInfo(p1, id).Active })
+	c, err := net.Dial(DOMAIN_UNIX, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("echo: %q, %v", buf, err)
+	}
+}
+
+//CloseListener和ClosePeerListener关闭监听后端口可以重新监听
+func TestCloseListener(t *testing.T) {
+	echo := testEchoServer(t)
+	defer echo.Close()
+	p1, p2 := testPair(t, nil, nil)
+	defer p1.Close()
+	defer p2.Close()
+	msg, _ := json.Marshal(Listener{
+		Listen:  Address{Domain: "tcp", Addr: "127.0.0.1:0"},
+		Forward: Address{Domain: "tcp", Addr: echo.Addr().String()},
+	})
+	id, err := p1.NewListener(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testWait(t, "listen", func() bool { return testListenerInfo(p1, id).Active })
+	addr := testListenerInfo(p1, id).Addr
+	if err := p1.CloseListener(id); err != nil {
+		t.Fatal(err)
+	}
+	if err := p1.CloseListener(id); err != ErrListenerNotFound {
+		t.Errorf("second CloseListener = %v, want ErrListenerNotFound", err)
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("port not freed by CloseListener: %v", err)
+	}
+	l.Close()
+
+	//对端收到PROXY_CMD_CLOSE_LISTEN后关闭监听
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	info, err := p1.NewPeerListenerContext(ctx, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p2.Listeners()) != 1 {
+		t.Fatalf("peer listeners %+v", p2.Listeners())
+	}
+	if err := p1.ClosePeerListener(info.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := p1.ClosePeerListener(info.ID); err != ErrListenerNotFound {
+		t.Errorf("second ClosePeerListener = %v, want ErrListenerNotFound", err)
+	}
+	if n := len(p1.PeerListeners()); n != 0 {
+		t.Errorf("%d peer listeners left", n)
+	}
+	testWait(t, "peer listener closed", func() bool { return len(p2.Listeners()) == 0 })
+	l, err = net.Listen("tcp", info.Addr)
+	if err != nil {
+		t.Fatalf("port not freed on the peer: %v", err)
+	}
+	l.Close()
+}
+
+//对端通过PROXY_CMD_LISTEN_RESULT通知实际监听地址，监听失败时通知原因，重试成功后再次通知
+func TestPeerListenResult(t *testing.T) {
+	echo := testEchoServer(t)
+	defer echo.Close()
+	p1, p2 := testPair(t, nil, []Option{WithLogger(NewTextLogger(ioutil.Discard, LEVEL_ERROR))})
+	defer p1.Close()
+	defer p2.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	msg, _ := json.Marshal(Listener{
+		Listen:  Address{Domain: "tcp", Addr: "127.0.0.1:0"},
+		Forward: Address{Domain: "tcp", Addr: echo.Addr().String()},
+	})
+	info, err := p1.NewPeerListenerContext(ctx, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(info.Addr)
+	if !info.Active || info.Error != "" || port == "" || port == "0" {
+		t.Fatalf("listener info %+v", info)
+	}
+	if peer := p2.Listeners(); len(peer) != 1 || peer[0].Addr != info.Addr {
+		t.Fatalf("peer listeners %+v, want address %s", peer, info.Addr)
+	}
+	c, err := net.Dial("tcp", info.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	buf := make([]byte, 4)
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("echo: %q, %v", buf, err)
+	}
+
+	//端口被占用时通知失败原因，端口释放后对端重新监听成功并再次通知
+	hold, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hold.Close()
+	msg, _ = json.Marshal(Listener{
+		Listen:  Address{Domain: "tcp", Addr: hold.Addr().String()},
+		Forward: Address{Domain: "tcp", Addr: echo.Addr().String()},
+	})
+	if _, err := p1.NewPeerListenerContext(ctx, msg); !errors.Is(err, ErrListenFailed) {
+		t.Fatalf("listen on a used port: %v, want ErrListenFailed", err)
+	}
+	id, err := p1.NewPeerListener(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testWait(t, "listen failure", func() bool {
+		for _, info := range p1.PeerListeners() {
+			if info.ID == id {
+				return !info.Active && info.Error != ""
+			}
+		}
+		return false
+	})
+	hold.Close()
+	testWait(t, "listen retry", func() bool {
+		for _, info := range p1.PeerListeners() {
+			if info.ID == id {
+				return info.Active && info.Error == "" && info.Addr == hold.Addr().String()
+			}
+		}
+		return false
+	})
+}
@@ -0,0 +1,393 @@
+// Copyright 2019 The goproxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+SOCKS5监听(RFC 1928)，Listener.Kind为KIND_SOCKS5时不使用固定的Forward地址，
+由客户端请求的目的地址经Dial发送至对端，由对端连接，支持CONNECT和UDP ASSOCIATE命令，
+Listener.Username不为空时要求用户名密码认证(RFC 1929)
+*/
+
+const (
+	KIND_SOCKS5 = "socks5"
+	//握手及对端连接超时
+	SOCKS5_TIMEOUT = 10 * time.Second
+)
+
+const (
+	socks5Version        = 5
+	socks5AuthNone       = 0
+	socks5AuthPassword   = 2
+	socks5AuthNoAccept   = 0xff
+	socks5CmdConnect     = 1
+	socks5CmdAssociate   = 3
+	socks5AtypIPv4       = 1
+	socks5AtypDomain     = 3
+	socks5AtypIPv6       = 4
+	socks5RepSuccess     = 0
+	socks5RepFailure     = 1
+	socks5RepUnreachable = 4
+	socks5RepRefused     = 5
+	socks5RepCmdNotSup   = 7
+	socks5RepAtypNotSup  = 8
+)
+
+var (
+	ErrSocks5Version = errors.New("socks5: unsupported version")
+	ErrSocks5Auth    = errors.New("socks5: authentication failed")
+	ErrSocks5Atyp    = errors.New("socks5: unsupported address type")
+)
+
+//读取SOCKS5地址，返回host:port形式的地址
+func readSocks5Addr(r io.Reader, atyp byte) (string, error) {
+	var host string
+	switch atyp {
+	case socks5AtypIPv4, socks5AtypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if atyp == socks5AtypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socks5AtypDomain:
+		var size [1]byte
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			return "", err
+		}
+		domain := make([]byte, size[0])
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		return "", ErrSocks5Atyp
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+//组装SOCKS5地址，host为IP时使用IP类型，否则使用域名类型
+func appendSocks5Addr(b []byte, addr string) []byte {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return append(b, socks5AtypIPv4, 0, 0, 0, 0, 0, 0)
+	}
+	n, _ := strconv.Atoi(port)
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			b = append(b, socks5AtypIPv4)
+			b = append(b, ip4...)
+		} else {
+			b = append(b, socks5AtypIPv6)
+			b = append(b, ip.To16()...)
+		}
+	} else {
+		b = append(b, socks5AtypDomain, byte(len(host)))
+		b = append(b, host...)
+	}
+	return append(b, byte(n>>8), byte(n))
+}
+
+//发送请求应答
+func writeSocks5Reply(c net.Conn, rep byte, bind string) error {
+	b := appendSocks5Addr([]byte{socks5Version, rep, 0}, bind)
+	_, err := c.Write(b)
+	return err
+}
+
+//由Dial错误得到应答码
+func socks5ReplyCode(err error) byte {
+	switch {
+	case errors.Is(err, ErrConnectFailed):
+		return socks5RepRefused
+	case errors.Is(err, context.DeadlineExceeded):
+		return socks5RepUnreachable
+	}
+	return socks5RepFailure
+}
+
+//协商认证方式，需要时完成用户名密码认证
+func (lsn *Listener) socks5Auth(c net.Conn) error {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(c, head); err != nil {
+		return err
+	}
+	if head[0] != socks5Version {
+		return ErrSocks5Version
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(c, methods); err != nil {
+		return err
+	}
+	want := byte(socks5AuthNone)
+	if lsn.Username != "" {
+		want = socks5AuthPassword
+	}
+	method := byte(socks5AuthNoAccept)
+	for _, m := range methods {
+		if m == want {
+			method = want
+		}
+	}
+	if _, err := c.Write([]byte{socks5Version, method}); err != nil {
+		return err
+	}
+	if method == socks5AuthNoAccept {
+		return ErrSocks5Auth
+	}
+	if method == socks5AuthNone {
+		return nil
+	}
+	//RFC 1929: [版本1][用户名长度][用户名][密码长度][密码]
+	if _, err := io.ReadFull(c, head); err != nil {
+		return err
+	}
+	user := make([]byte, head[1])
+	if _, err := io.ReadFull(c, user); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(c, head[:1]); err != nil {
+		return err
+	}
+	pass := make([]byte, head[0])
+	if _, err := io.ReadFull(c, pass); err != nil {
+		return err
+	}
+	userOk := subtle.ConstantTimeCompare(user, []byte(lsn.Username))
+	passOk := subtle.ConstantTimeCompare(pass, []byte(lsn.Password))
+	if userOk&passOk != 1 {
+		_, _ = c.Write([]byte{1, 1})
+		return ErrSocks5Auth
+	}
+	_, err := c.Write([]byte{1, 0})
+	return err
+}
+
+//处理SOCKS5监听接受的连接，完成握手后按请求命令转发
+//@lsn 监听句柄，提供认证信息
+//@c 接受的连接
+func (p *Proxy) acceptSocks5(lsn *Listener, c net.Conn) {
+	_ = c.SetDeadline(time.Now().Add(SOCKS5_TIMEOUT))
+	if err := lsn.socks5Auth(c); err != nil {
+		p.log.Warn("socks5 handshake failed", "listen", lsn.Listen, "peer", c.RemoteAddr(), "error", err)
+		c.Close()
+		return
+	}
+	//请求: [版本][命令][保留][地址类型][地址][端口]
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(c, head); err != nil || head[0] != socks5Version {
+		c.Close()
+		return
+	}
+	dest, err := readSocks5Addr(c, head[3])
+	if err != nil {
+		_ = writeSocks5Reply(c, socks5RepAtypNotSup, "")
+		c.Close()
+		return
+	}
+	//请求已读取，对端连接的时间由socks5Connect限制，超时后仍需发送应答
+	_ = c.SetDeadline(time.Time{})
+	switch head[1] {
+	case socks5CmdConnect:
+		p.socks5Connect(c, dest)
+	case socks5CmdAssociate:
+		p.socks5Associate(c)
+	default:
+		_ = writeSocks5Reply(c, socks5RepCmdNotSup, "")
+		c.Close()
+	}
+}
+
+//CONNECT命令，经对端连接目的地址后双向转发
+func (p *Proxy) socks5Connect(c net.Conn, dest string) {
+	ctx, cancel := context.WithTimeout(context.Background(), SOCKS5_TIMEOUT)
+	conn, err := p.Dial(ctx, "tcp", dest)
+	cancel()
+	if err != nil {
+		p.log.Warn("socks5 connect failed", "peer", c.RemoteAddr(), "forward", dest, "error", err)
+		_ = writeSocks5Reply(c, socks5ReplyCode(err), "")
+		c.Close()
+		return
+	}
+	if err := writeSocks5Reply(c, socks5RepSuccess, "0.0.0.0:0"); err != nil {
+		c.Close()
+		conn.Close()
+		return
+	}
+	_ = c.SetDeadline(time.Time{})
+	relay(c, conn)
+}
+
+//UDP ASSOCIATE命令，在TCP监听地址的IP上创建UDP端口，客户端数据报按目的地址经Dial("udp")转发，
+//TCP控制连接关闭时结束
+func (p *Proxy) socks5Associate(c net.Conn) {
+	defer c.Close()
+	host, _, _ := net.SplitHostPort(c.LocalAddr().String())
+	pc, err := net.ListenPacket("udp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		_ = writeSocks5Reply(c, socks5RepFailure, "")
+		return
+	}
+	defer pc.Close()
+	if err := writeSocks5Reply(c, socks5RepSuccess, pc.LocalAddr().String()); err != nil {
+		return
+	}
+	_ = c.SetDeadline(time.Time{})
+	as := &socks5Association{proxy: p, pc: pc, conns: make(map[string]net.Conn)}
+	if ta, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		as.clientIP = ta.IP
+	}
+	go as.serve()
+	//控制连接不再传输数据，读取至关闭
+	_, _ = io.Copy(ioutil.Discard, c)
+	pc.Close()
+	as.closeAll()
+}
+
+//UDP ASSOCIATE会话
+type socks5Association struct {
+	proxy *Proxy
+	pc    net.PacketConn
+	//控制连接的客户端IP，为空时不限制来源
+	clientIP net.IP
+	mutex    sync.Mutex
+	//客户端地址，取自第一个数据报
+	client net.Addr
+	closed bool
+	//目的地址对应的对端数据报连接
+	conns map[string]net.Conn
+}
+
+//接收客户端数据报，去除SOCKS5 UDP头部后转发至对应目的地址
+func (as *socks5Association) serve() {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := as.pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		//只接受控制连接所在IP发送的数据报
+		if ua, ok := addr.(*net.UDPAddr); as.clientIP != nil && (!ok || !ua.IP.Equal(as.clientIP)) {
+			continue
+		}
+		//[保留 2字节][分片][地址类型][地址][端口][数据]，不支持分片
+		if n < 4 || buf[2] != 0 {
+			continue
+		}
+		r := bytes.NewReader(buf[4:n])
+		dest, err := readSocks5Addr(r, buf[3])
+		if err != nil {
+			continue
+		}
+		if max := as.proxy.udpMaxPayload(); r.Len() > max {
+			as.proxy.dropPacket(Address{Domain: "udp", Addr: as.pc.LocalAddr().String()}, addr, r.Len(), "exceeds "+strconv.Itoa(max)+" bytes")
+			continue
+		}
+		data := buf[n-r.Len() : n]
+		as.mutex.Lock()
+		as.client = addr
+		as.mutex.Unlock()
+		conn, err := as.conn(dest)
+		if err != nil {
+			as.proxy.log.Warn("socks5 udp associate failed", "forward", dest, "error", err)
+			continue
+		}
+		_, _ = conn.Write(data)
+	}
+}
+
+//获取目的地址对应的对端数据报连接，不存在时创建并启动回复转发go程
+func (as *socks5Association) conn(dest string) (net.Conn, error) {
+	as.mutex.Lock()
+	conn, ok := as.conns[dest]
+	as.mutex.Unlock()
+	if ok {
+		return conn, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), SOCKS5_TIMEOUT)
+	conn, err := as.proxy.Dial(ctx, "udp", dest)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	as.mutex.Lock()
+	if as.closed {
+		as.mutex.Unlock()
+		conn.Close()
+		return nil, ErrProxyClosed
+	}
+	as.conns[dest] = conn
+	as.mutex.Unlock()
+	go as.reply(dest, conn)
+	return conn, nil
+}
+
+//将对端回复的数据报加上SOCKS5 UDP头部发回客户端
+func (as *socks5Association) reply(dest string, conn net.Conn) {
+	buf := make([]byte, 65536)
+	head := appendSocks5Addr([]byte{0, 0, 0}, dest)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			break
+		}
+		as.mutex.Lock()
+		client := as.client
+		as.mutex.Unlock()
+		pkt := append(append(make([]byte, 0, len(head)+n), head...), buf[:n]...)
+		if _, err := as.pc.WriteTo(pkt, client); err != nil {
+			break
+		}
+	}
+	as.mutex.Lock()
+	if as.conns[dest] == conn {
+		delete(as.conns, dest)
+	}
+	as.mutex.Unlock()
+	conn.Close()
+}
+
+func (as *socks5Association) closeAll() {
+	as.mutex.Lock()
+	as.closed = true
+	for _, conn := range as.conns {
+		conn.Close()
+	}
+	as.mutex.Unlock()
+}
+
+//双向转发数据，任一方向结束时关闭两端连接
+func relay(a, b net.Conn) {
+	var once sync.Once
+	closeBoth := func() {
+		a.Close()
+		b.Close()
+	}
+	go func() {
+		_, _ = io.Copy(a, b)
+		once.Do(closeBoth)
+	}()
+	_, _ = io.Copy(b, a)
+	once.Do(closeBoth)
+}
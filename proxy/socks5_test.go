@@ -0,0 +1,267 @@
+// Copyright 2019 The goproxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+//创建KIND_SOCKS5或KIND_HTTP监听，返回实际监听地址
+func testKindListener(t *testing.T, p *Proxy, kind, username, password string) string {
+	t.Helper()
+	msg, _ := json.Marshal(Listener{
+		Listen:   Address{Domain: "tcp", Addr: "127.0.0.1:0"},
+		Kind:     kind,
+		Username: username,
+		Password: password,
+	})
+	id, err := p.NewListener(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testWait(t, kind+" listen", func() bool { return testListenerInfo(p, id).Active })
+	return testListenerInfo(p, id).Addr
+}
+
+//连接SOCKS5监听并完成认证，username为空时不认证
+func testSocks5Client(t *testing.T, addr, username, password string) net.Conn {
+	t.Helper()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+	method := byte(socks5AuthNone)
+	if username != "" {
+		method = socks5AuthPassword
+	}
+	reply := make([]byte, 2)
+	if _, err := c.Write([]byte{socks5Version, 1, method}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(c, reply); err != nil || reply[1] != method {
+		t.Fatalf("method reply %x, %v", reply, err)
+	}
+	if username != "" {
+		req := append([]byte{1, byte(len(username))}, username...)
+		req = append(append(req, byte(len(password))), password...)
+		if _, err := c.Write(req); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(c, reply); err != nil || reply[1] != 0 {
+			t.Fatalf("auth reply %x, %v", reply, err)
+		}
+	}
+	return c
+}
+
+//发送请求，返回应答码和绑定地址
+func testSocks5Request(t *testing.T, c net.Conn, cmd byte, dest string) (byte, string) {
+	t.Helper()
+	if _, err := c.Write(appendSocks5Addr([]byte{socks5Version, cmd, 0}, dest)); err != nil {
+		t.Fatal(err)
+	}
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(c, head); err != nil {
+		t.Fatal(err)
+	}
+	bind, err := readSocks5Addr(c, head[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return head[1], bind
+}
+
+func TestReadSocks5Addr(t *testing.T) {
+	long := strings.Repeat("a", 255)
+	tests := []struct {
+		name string
+		atyp byte
+		in   []byte
+		addr string
+		err  error
+	}{
+		{"ipv4", socks5AtypIPv4, []byte{127, 0, 0, 1, 0x1f, 0x90}, "127.0.0.1:8080", nil},
+		{"ipv6", socks5AtypIPv6, append(net.ParseIP("fd00::1"), 0, 22), "[fd00::1]:22", nil},
+		{"domain", socks5AtypDomain, append([]byte{11}, "example.com\x01\xbb"...), "example.com:443", nil},
+		{"long domain", socks5AtypDomain, append(append([]byte{255}, long...), 0, 80), long + ":80", nil},
+		{"empty domain", socks5AtypDomain, []byte{0, 0, 80}, ":80", nil},
+		{"unknown type", 2, []byte{127, 0, 0, 1, 0, 80}, "", ErrSocks5Atyp},
+		{"truncated ipv4", socks5AtypIPv4, []byte{127, 0}, "", io.ErrUnexpectedEOF},
+		{"truncated ipv6", socks5AtypIPv6, make([]byte, 10), "", io.ErrUnexpectedEOF},
+		{"truncated port", socks5AtypIPv4, []byte{127, 0, 0, 1, 0}, "", io.ErrUnexpectedEOF},
+		{"no length", socks5AtypDomain, nil, "", io.EOF},
+		//长度字节超出实际数据
+		{"oversized domain", socks5AtypDomain, append([]byte{200}, "example.com\x00\x50"...), "", io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		r := bytes.NewReader(tt.in)
+		addr, err := readSocks5Addr(r, tt.atyp)
+		if err != tt.err || addr != tt.addr {
+			t.Errorf("%s: got %q, %v, want %q, %v", tt.name, addr, err, tt.addr, tt.err)
+		}
+		if tt.err == nil && r.Len() != 0 {
+			t.Errorf("%s: %d bytes left unread", tt.name, r.Len())
+		}
+	}
+	//组装的地址可以读回
+	for _, addr := range []string{"10.1.2.3:53", "[::1]:443", "example.com:80"} {
+		b := appendSocks5Addr(nil, addr)
+		got, err := readSocks5Addr(bytes.NewReader(b[1:]), b[0])
+		if err != nil || got != addr {
+			t.Errorf("appendSocks5Addr(%q) read back as %q, %v", addr, got, err)
+		}
+	}
+}
+
+func TestSocks5Auth(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		//客户端发送的认证方式协商和认证请求
+		in    []byte
+		reply []byte
+		err   error
+	}{
+		{"none", "", []byte{5, 1, socks5AuthNone}, []byte{5, 0}, nil},
+		{"password", "user", []byte{5, 2, socks5AuthNone, socks5AuthPassword, 1, 4, 'u', 's', 'e', 'r', 4, 'p', 'a', 's', 's'}, []byte{5, 2, 1, 0}, nil},
+		{"wrong password", "user", []byte{5, 1, socks5AuthPassword, 1, 4, 'u', 's', 'e', 'r', 4, 'p', 'a', 's', 'S'}, []byte{5, 2, 1, 1}, ErrSocks5Auth},
+		{"wrong user", "user", []byte{5, 1, socks5AuthPassword, 1, 3, 'u', 's', 'e', 4, 'p', 'a', 's', 's'}, []byte{5, 2, 1, 1}, ErrSocks5Auth},
+		//需要认证时不接受无认证方式
+		{"no acceptable method", "user", []byte{5, 1, socks5AuthNone}, []byte{5, 0xff}, ErrSocks5Auth},
+		{"no methods", "", []byte{5, 0}, []byte{5, 0xff}, ErrSocks5Auth},
+		{"version", "", []byte{4, 1, socks5AuthNone}, nil, ErrSocks5Version},
+		{"truncated", "user", []byte{5, 1, socks5AuthPassword, 1, 4, 'u'}, []byte{5, 2}, io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c1, c2 := testConnPair(t)
+			defer c1.Close()
+			if _, err := c1.Write(tt.in); err != nil {
+				t.Fatal(err)
+			}
+			_ = c1.(*net.TCPConn).CloseWrite()
+			lsn := &Listener{Username: tt.username, Password: "pass"}
+			err := lsn.socks5Auth(c2)
+			c2.Close()
+			if !errors.Is(err, tt.err) {
+				t.Errorf("socks5Auth = %v, want %v", err, tt.err)
+			}
+			reply := make([]byte, 16)
+			_ = c1.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, _ := io.ReadFull(c1, reply)
+			if !bytes.Equal(reply[:n], tt.reply) {
+				t.Errorf("reply %x, want %x", reply[:n], tt.reply)
+			}
+		})
+	}
+}
+
+func TestSocks5Connect(t *testing.T) {
+	echo := testEchoServer(t)
+	defer echo.Close()
+	p1, p2 := testPair(t, nil, nil)
+	defer p1.Close()
+	defer p2.Close()
+	addr := testKindListener(t, p1, KIND_SOCKS5, "user", "pass")
+	c := testSocks5Client(t, addr, "user", "pass")
+	defer c.Close()
+	if rep, _ := testSocks5Request(t, c, socks5CmdConnect, echo.Addr().String()); rep != socks5RepSuccess {
+		t.Fatalf("connect reply %d", rep)
+	}
+	if _, err := c.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("echo: %q, %v", buf, err)
+	}
+	//对端连接失败
+	c2 := testSocks5Client(t, addr, "user", "pass")
+	defer c2.Close()
+	if rep, _ := testSocks5Request(t, c2, socks5CmdConnect, testRefusedAddr(t)); rep != socks5RepRefused {
+		t.Errorf("refused connect reply %d, want %d", rep, socks5RepRefused)
+	}
+	//不支持的命令
+	c3 := testSocks5Client(t, addr, "user", "pass")
+	defer c3.Close()
+	if rep, _ := testSocks5Request(t, c3, 2, echo.Addr().String()); rep != socks5RepCmdNotSup {
+		t.Errorf("bind reply %d, want %d", rep, socks5RepCmdNotSup)
+	}
+}
+
+func TestSocks5Associate(t *testing.T) {
+	echo := testUDPEchoServer(t)
+	defer echo.Close()
+	p1, p2 := testPair(t, nil, nil)
+	defer p1.Close()
+	defer p2.Close()
+	addr := testKindListener(t, p1, KIND_SOCKS5, "", "")
+	c := testSocks5Client(t, addr, "", "")
+	defer c.Close()
+	rep, bind := testSocks5Request(t, c, socks5CmdAssociate, "0.0.0.0:0")
+	if rep != socks5RepSuccess {
+		t.Fatalf("associate reply %d", rep)
+	}
+	uc, err := net.Dial("udp", bind)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uc.Close()
+	head := appendSocks5Addr([]byte{0, 0, 0}, echo.LocalAddr().String())
+	buf := make([]byte, 2048)
+	for _, data := range []string{"first", "second"} {
+		if _, err := uc.Write(append(append([]byte{}, head...), data...)); err != nil {
+			t.Fatal(err)
+		}
+		_ = uc.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := uc.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		//回复带有目的地址头部
+		if !bytes.Equal(buf[:n], append(append([]byte{}, head...), data...)) {
+			t.Fatalf("reply %q", buf[:n])
+		}
+	}
+	//分片的数据报被丢弃
+	frag := append([]byte{0, 0, 1}, head[3:]...)
+	if _, err := uc.Write(append(frag, "frag"...)); err != nil {
+		t.Fatal(err)
+	}
+	_ = uc.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, err := uc.Read(buf); err == nil {
+		t.Fatalf("fragment answered: %q", buf[:n])
+	}
+}
+
+//对端连接超过SOCKS5_TIMEOUT未完成时应答主机不可达
+func TestSocks5ConnectTimeout(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for SOCKS5_TIMEOUT")
+	}
+	hang := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	p1, p2 := testPair(t, nil, []Option{WithConfig(Config{Dial: hang, DialTimeout: 2 * SOCKS5_TIMEOUT})})
+	defer p1.Close()
+	defer p2.Close()
+	addr := testKindListener(t, p1, KIND_SOCKS5, "", "")
+	c := testSocks5Client(t, addr, "", "")
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(2 * SOCKS5_TIMEOUT))
+	if rep, _ := testSocks5Request(t, c, socks5CmdConnect, "192.0.2.1:443"); rep != socks5RepUnreachable {
+		t.Errorf("connect reply %d, want %d", rep, socks5RepUnreachable)
+	}
+}
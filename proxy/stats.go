@@ -0,0 +1,132 @@
+// Copyright 2019 The goproxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proxy
+
+/*
+会话统计
+计数器都用原子操作累加，读取时不加锁，各项之间不保证是同一时刻的快照
+字节数包含帧头和认证标签，帧数包含主连接自有命令
+*/
+import (
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+//Stats 会话统计信息，见Proxy.Stats
+type Stats struct {
+	//可用主连接数
+	Links int
+	//子连接数，包括监听子连接
+	Streams int
+	//本端发起的子连接数和对端发起的子连接数
+	Clients    int
+	SubClients int
+	//所有主连接收发的字节数和帧数
+	BytesIn   uint64
+	BytesOut  uint64
+	FramesIn  uint64
+	FramesOut uint64
+	//子连接因发送窗口耗尽而等待的次数
+	WindowStalls uint64
+	//对端请求创建子连接而本端连接目标失败的次数，包括被DialPolicy拒绝的请求
+	DialFailures uint64
+	//对端请求的转发地址和监听地址被DialPolicy或ListenPolicy拒绝的次数
+	PolicyDenials uint64
+	//UDP监听和SOCKS5 UDP转发丢弃的数据报数，包括超过长度限制和会话积压的数据报
+	UDPDrops uint64
+	//可用主连接的统计，按ID排序
+	LinkStats []LinkStats
+	//本端监听的统计，按ID排序
+	ListenerStats []ListenerStats
+}
+
+//LinkStats 主连接统计信息
+type LinkStats struct {
+	ID        uint32
+	BytesIn   uint64
+	BytesOut  uint64
+	FramesIn  uint64
+	FramesOut uint64
+	//最近一次keepalive的往返时间，0表示尚未测量
+	RTT time.Duration
+}
+
+//ListenerStats 监听统计信息
+type ListenerStats struct {
+	ID     int
+	Listen Address
+	//接受的连接数，UDP监听为会话数
+	Accepted uint64
+	//从本端连接读取和向本端连接写入的字节数
+	BytesIn  uint64
+	BytesOut uint64
+}
+
+//Stats返回会话统计信息
+func (p *Proxy) Stats() Stats {
+	p.mutex.RLock()
+	stats := Stats{
+		Clients:    len(p.clients),
+		SubClients: len(p.subClients),
+	}
+	for id, l := range p.links {
+		select {
+		case <-l.quit:
+			continue
+		default:
+		}
+		stats.LinkStats = append(stats.LinkStats, LinkStats{
+			ID:        id,
+			BytesIn:   atomic.LoadUint64(&l.bytesIn),
+			BytesOut:  atomic.LoadUint64(&l.bytesOut),
+			FramesIn:  atomic.LoadUint64(&l.framesIn),
+			FramesOut: atomic.LoadUint64(&l.framesOut),
+			RTT:       time.Duration(atomic.LoadInt64(&l.rtt)),
+		})
+	}
+	for id, lsn := range p.listeners {
+		stats.ListenerStats = append(stats.ListenerStats, ListenerStats{
+			ID:       id,
+			Listen:   lsn.Listen,
+			Accepted: atomic.LoadUint64(&lsn.accepted),
+			BytesIn:  atomic.LoadUint64(&lsn.bytesIn),
+			BytesOut: atomic.LoadUint64(&lsn.bytesOut),
+		})
+	}
+	p.mutex.RUnlock()
+	sort.Slice(stats.LinkStats, func(i, j int) bool { return stats.LinkStats[i].ID < stats.LinkStats[j].ID })
+	sort.Slice(stats.ListenerStats, func(i, j int) bool { return stats.ListenerStats[i].ID < stats.ListenerStats[j].ID })
+	stats.Links = p.Links()
+	stats.Streams = stats.Clients + stats.SubClients
+	stats.BytesIn = atomic.LoadUint64(&p.bytesIn)
+	stats.BytesOut = atomic.LoadUint64(&p.bytesOut)
+	stats.FramesIn = atomic.LoadUint64(&p.framesIn)
+	stats.FramesOut = atomic.LoadUint64(&p.framesOut)
+	stats.WindowStalls = atomic.LoadUint64(&p.windowStalls)
+	stats.DialFailures = atomic.LoadUint64(&p.dialFailures)
+	stats.PolicyDenials = atomic.LoadUint64(&p.policyDenials)
+	stats.UDPDrops = atomic.LoadUint64(&p.udpDrops)
+	return stats
+}
+
+//监听接受的连接，统计读写字节数
+type countConn struct {
+	net.Conn
+	lsn *Listener
+}
+
+func (c *countConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddUint64(&c.lsn.bytesIn, uint64(n))
+	return n, err
+}
+
+func (c *countConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddUint64(&c.lsn.bytesOut, uint64(n))
+	return n, err
+}
@@ -0,0 +1,269 @@
+// Copyright 2019 The goproxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+UDP监听，按来源地址将数据报划分为会话，每个会话作为一个监听子连接，
+每个数据报对应一个DATA帧以保持数据报边界，发送窗口不足一个数据报时等待，不拆分数据报，对端使用net.Dial("udp")连接转发地址，
+会话空闲超过UDP_IDLE_TIMEOUT后关闭，对端回复的数据报发回对应的来源地址
+单个数据报不超过对端声明的帧数据区大小和UDP_MAX_DATAGRAM，超过的数据报和会话积压时的数据报被丢弃，计入Stats.UDPDrops
+*/
+
+const (
+	UDP_IDLE_TIMEOUT = 60 * time.Second
+	//UDP数据报最大长度(IPv4)
+	UDP_MAX_DATAGRAM = 65507
+	//每个会话待读取数据报数上限，超过时丢弃
+	UDP_SESSION_BACKLOG = 64
+)
+
+var ErrPacketTooLarge = errors.New("udp packet too large")
+
+//是否是数据报协议
+func isPacketDomain(domain string) bool {
+	return strings.HasPrefix(domain, "udp")
+}
+
+//本端可转发的单个数据报最大长度，由对端声明的帧数据区大小决定
+func (p *Proxy) udpMaxPayload() int {
+	if n := p.peerFramePayload(); n < UDP_MAX_DATAGRAM {
+		return n
+	}
+	return UDP_MAX_DATAGRAM
+}
+
+//本端可接收的单个数据报最大长度，由本端声明的帧数据区大小决定
+func (p *Proxy) udpRecvPayload() int {
+	if n := int(p.frameSize); n < UDP_MAX_DATAGRAM {
+		return n
+	}
+	return UDP_MAX_DATAGRAM
+}
+
+//丢弃数据报
+func (p *Proxy) dropPacket(lsn Address, from net.Addr, size int, reason string) {
+	atomic.AddUint64(&p.udpDrops, 1)
+	p.log.Warn("udp packet dropped", "listen", lsn, "peer", from, "size", size, "reason", reason)
+}
+
+//Dial("udp")返回的内存管道，每次Write为一个数据报，超过长度上限时不发送
+type packetPipe struct {
+	net.Conn
+	proxy *Proxy
+}
+
+func (c *packetPipe) Write(b []byte) (int, error) {
+	if len(b) > c.proxy.udpMaxPayload() {
+		return 0, ErrPacketTooLarge
+	}
+	return c.Conn.Write(b)
+}
+
+type timeoutError struct{}
+
+func (e timeoutError) Error() string   { return "i/o timeout" }
+func (e timeoutError) Timeout() bool   { return true }
+func (e timeoutError) Temporary() bool { return true }
+
+//UDP会话，以net.Conn形式作为监听子连接句柄，每次Read返回一个数据报
+type udpSession struct {
+	lsn   *Listener
+	pc    net.PacketConn
+	raddr net.Addr
+	key   string
+	owner *udpSessions
+	recv  chan []byte
+	done  chan struct{}
+	once  sync.Once
+	//最后活动时间，UnixNano
+	activeAt int64
+	mutex    sync.Mutex
+	deadline time.Time
+}
+
+func (s *udpSession) active() {
+	atomic.StoreInt64(&s.activeAt, time.Now().UnixNano())
+}
+
+func (s *udpSession) Read(b []byte) (int, error) {
+	s.mutex.Lock()
+	deadline := s.deadline
+	s.mutex.Unlock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case pkt := <-s.recv:
+		return copy(b, pkt), nil
+	case <-s.done:
+		return 0, io.EOF
+	case <-timeout:
+		return 0, timeoutError{}
+	}
+}
+
+func (s *udpSession) Write(b []byte) (int, error) {
+	select {
+	case <-s.done:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+	s.active()
+	n, err := s.pc.WriteTo(b, s.raddr)
+	atomic.AddUint64(&s.lsn.bytesOut, uint64(n))
+	return n, err
+}
+
+func (s *udpSession) Close() error {
+	s.once.Do(func() {
+		close(s.done)
+		s.owner.remove(s)
+	})
+	return nil
+}
+
+func (s *udpSession) LocalAddr() net.Addr {
+	return s.pc.LocalAddr()
+}
+
+func (s *udpSession) RemoteAddr() net.Addr {
+	return s.raddr
+}
+
+func (s *udpSession) SetDeadline(t time.Time) error {
+	return s.SetReadDeadline(t)
+}
+
+func (s *udpSession) SetReadDeadline(t time.Time) error {
+	s.mutex.Lock()
+	s.deadline = t
+	s.mutex.Unlock()
+	return nil
+}
+
+func (s *udpSession) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+//UDP监听的会话列表
+type udpSessions struct {
+	mutex    sync.Mutex
+	sessions map[string]*udpSession
+}
+
+func (us *udpSessions) remove(s *udpSession) {
+	us.mutex.Lock()
+	if us.sessions[s.key] == s {
+		delete(us.sessions, s.key)
+	}
+	us.mutex.Unlock()
+}
+
+//关闭空闲会话，会话对应的子连接随之退出并通知对端
+func (us *udpSessions) expire(idle time.Duration) {
+	now := time.Now().UnixNano()
+	var expired []*udpSession
+	us.mutex.Lock()
+	for _, s := range us.sessions {
+		if now-atomic.LoadInt64(&s.activeAt) > int64(idle) {
+			expired = append(expired, s)
+		}
+	}
+	us.mutex.Unlock()
+	for _, s := range expired {
+		s.Close()
+	}
+}
+
+func (us *udpSessions) closeAll() {
+	us.mutex.Lock()
+	all := make([]*udpSession, 0, len(us.sessions))
+	for _, s := range us.sessions {
+		all = append(all, s)
+	}
+	us.mutex.Unlock()
+	for _, s := range all {
+		s.Close()
+	}
+}
+
+//接收UDP监听地址上的数据报并分发至会话，新来源地址创建新会话并向对端发送NEW_CONNECT命令
+//监听关闭或出错时返回错误，所有会话随之关闭
+//@lsn 监听句柄，lsn.pc为UDP监听
+func (p *Proxy) servePacket(lsn *Listener) error {
+	body, err := json.Marshal(lsn.Forward)
+	if err != nil {
+		return err
+	}
+	us := &udpSessions{sessions: make(map[string]*udpSession)}
+	stop := make(chan struct{})
+	defer func() {
+		close(stop)
+		us.closeAll()
+	}()
+	go func() {
+		ticker := time.NewTicker(p.cfg.Tick)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				us.expire(UDP_IDLE_TIMEOUT)
+			case <-stop:
+				return
+			}
+		}
+	}()
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := lsn.pc.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		if max := p.udpMaxPayload(); n > max {
+			p.dropPacket(lsn.Listen, addr, n, "exceeds "+strconv.Itoa(max)+" bytes")
+			continue
+		}
+		key := addr.String()
+		us.mutex.Lock()
+		s, ok := us.sessions[key]
+		if !ok {
+			s = &udpSession{lsn: lsn, pc: lsn.pc, raddr: addr, key: key, owner: us}
+			s.recv = make(chan []byte, UDP_SESSION_BACKLOG)
+			s.done = make(chan struct{})
+			us.sessions[key] = s
+		}
+		us.mutex.Unlock()
+		s.active()
+		pkt := make([]byte, n)
+		copy(pkt, buf[:n])
+		select {
+		case s.recv <- pkt:
+		default:
+			p.dropPacket(lsn.Listen, addr, n, "session backlog full")
+		}
+		atomic.AddUint64(&lsn.bytesIn, uint64(n))
+		if !ok {
+			atomic.AddUint64(&lsn.accepted, 1)
+			if _, err := p.openStream(s, body, false, true); err != nil {
+				s.Close()
+			}
+		}
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2019 The goproxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+//UDP回显服务
+func testUDPEchoServer(t testing.TB) net.PacketConn {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = pc.WriteTo(buf[:n], addr)
+		}
+	}()
+	return pc
+}
+
+//发送不同长度的数据报，每个回显的数据报都需完整
+func testDatagrams(t *testing.T, c net.Conn, sizes []int) {
+	t.Helper()
+	buf := make([]byte, UDP_MAX_DATAGRAM+1)
+	for i, size := range sizes {
+		pkt := bytes.Repeat([]byte{byte('a' + i%26)}, size)
+		if _, err := c.Write(pkt); err != nil {
+			t.Fatalf("write %d bytes: %v", size, err)
+		}
+		_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := c.Read(buf)
+		if err != nil {
+			t.Fatalf("read %d bytes: %v", size, err)
+		}
+		if !bytes.Equal(buf[:n], pkt) {
+			t.Fatalf("datagram %d: got %d bytes, want %d", i, n, size)
+		}
+	}
+}
+
+func TestDialUDPBoundaries(t *testing.T) {
+	echo := testUDPEchoServer(t)
+	defer echo.Close()
+	tests := []struct {
+		name  string
+		frame uint32
+		sizes []int
+	}{
+		{"default", DEFAULT_FRAME_PAYLOAD, []int{1, 1288, 1289, 8000, DEFAULT_FRAME_PAYLOAD, 100}},
+		//数据报接近最小窗口时，对端需及时归还窗口
+		{"max", MAX_FRAME_PAYLOAD, []int{UDP_MAX_DATAGRAM, 40000, UDP_MAX_DATAGRAM, 30000, UDP_MAX_DATAGRAM, UDP_MAX_DATAGRAM, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := []Option{WithInitialWindow(STREAM_WINDOW_BASE), WithMaxFrameSize(tt.frame)}
+			p1, p2 := testPair(t, opts, opts)
+			defer p1.Close()
+			defer p2.Close()
+			c, err := p1.Dial(context.Background(), "udp", echo.LocalAddr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			testWait(t, "settings", func() bool { return p1.udpMaxPayload() > FRAME_PAYLOAD_BASE && p2.udpMaxPayload() > FRAME_PAYLOAD_BASE })
+			testDatagrams(t, c, tt.sizes)
+			testDatagrams(t, c, tt.sizes)
+			if _, err := c.Write(make([]byte, p1.udpMaxPayload()+1)); err != ErrPacketTooLarge {
+				t.Fatalf("oversize write: got %v, want ErrPacketTooLarge", err)
+			}
+		})
+	}
+}
+
+func TestUDPListenerDrops(t *testing.T) {
+	echo := testUDPEchoServer(t)
+	defer echo.Close()
+	p1, p2 := testPair(t, nil, nil)
+	defer p1.Close()
+	defer p2.Close()
+	msg, _ := json.Marshal(Listener{
+		Listen:  Address{Domain: "udp", Addr: "127.0.0.1:0"},
+		Forward: Address{Domain: "udp", Addr: echo.LocalAddr().String()},
+	})
+	id, err := p1.NewListener(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var la string
+	testWait(t, "listener", func() bool {
+		for _, info := range p1.Listeners() {
+			if info.ID == id {
+				la = info.Addr
+			}
+		}
+		return la != ""
+	})
+	testWait(t, "settings", func() bool { return p1.udpMaxPayload() > FRAME_PAYLOAD_BASE && p2.udpMaxPayload() > FRAME_PAYLOAD_BASE })
+	c, err := net.Dial("udp", la)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	testDatagrams(t, c, []int{10, 1288, 1289})
+	max := p1.udpMaxPayload()
+	if _, err := c.Write(make([]byte, max+1)); err != nil {
+		t.Fatal(err)
+	}
+	testWait(t, "drop", func() bool { return p1.Stats().UDPDrops > 0 })
+	if drops := p1.Stats().UDPDrops; drops != 1 {
+		t.Fatalf("UDPDrops = %d, want 1", drops)
+	}
+	testDatagrams(t, c, []int{max})
+}
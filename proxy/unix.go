@@ -0,0 +1,137 @@
+// Copyright 2019 The goproxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+unix域套接字监听，Addr为套接字文件路径，以"@"开头表示Linux抽象命名空间
+监听前清理无进程监听的残留套接字文件，监听关闭时删除套接字文件，Listener.Mode设置文件权限
+设置了Mode时先在同目录下权限为0700的临时目录中监听并修改权限，再重命名为监听地址，
+避免套接字文件以umask决定的权限短暂可见
+转发地址为unix域套接字时直接使用net.Dial，无需额外处理
+*/
+
+const (
+	DOMAIN_UNIX = "unix"
+)
+
+var (
+	ErrAbstractUnix = errors.New("abstract unix socket is only supported on linux")
+	ErrSocketInUse  = errors.New("unix socket is in use")
+	ErrNotSocket    = errors.New("file exists and is not a unix socket")
+)
+
+//是否是抽象命名空间地址
+func isAbstractUnix(addr string) bool {
+	return strings.HasPrefix(addr, "@")
+}
+
+//清理残留的套接字文件，文件仍有进程监听时返回ErrSocketInUse
+func removeStaleUnix(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return ErrNotSocket
+	}
+	c, err := net.DialTimeout(DOMAIN_UNIX, path, time.Second)
+	if err == nil {
+		c.Close()
+		return ErrSocketInUse
+	}
+	return os.Remove(path)
+}
+
+//在unix域套接字上监听
+//@mode 八进制文件权限，如"0660"，为空时使用umask决定的默认权限，抽象命名空间地址忽略该参数
+func listenUnix(addr string, mode string) (net.Listener, error) {
+	abstract := isAbstractUnix(addr)
+	if abstract && runtime.GOOS != "linux" {
+		return nil, ErrAbstractUnix
+	}
+	var perm uint64
+	if mode != "" && !abstract {
+		var err error
+		if perm, err = strconv.ParseUint(mode, 8, 32); err != nil {
+			return nil, err
+		}
+	}
+	if !abstract {
+		if err := removeStaleUnix(addr); err != nil {
+			return nil, err
+		}
+	}
+	if mode != "" && !abstract {
+		return listenUnixMode(addr, os.FileMode(perm))
+	}
+	l, err := net.Listen(DOMAIN_UNIX, addr)
+	if err != nil {
+		return nil, err
+	}
+	//关闭监听时删除套接字文件
+	l.(*net.UnixListener).SetUnlinkOnClose(true)
+	return l, nil
+}
+
+//在临时目录中监听并设置权限后重命名为addr
+func listenUnixMode(addr string, perm os.FileMode) (net.Listener, error) {
+	dir, err := ioutil.TempDir(filepath.Dir(addr), ".goproxy")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "s")
+	l, err := net.Listen(DOMAIN_UNIX, tmp)
+	if err != nil {
+		return nil, err
+	}
+	ul := l.(*net.UnixListener)
+	//重命名后由unixListener删除套接字文件
+	ul.SetUnlinkOnClose(false)
+	if err := os.Chmod(tmp, perm); err != nil {
+		ul.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmp, addr); err != nil {
+		ul.Close()
+		return nil, err
+	}
+	return &unixListener{UnixListener: ul, path: addr}, nil
+}
+
+//重命名后的unix域套接字监听，Addr返回重命名后的路径，关闭时删除套接字文件
+type unixListener struct {
+	*net.UnixListener
+	path   string
+	unlink sync.Once
+}
+
+func (l *unixListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: l.path, Net: DOMAIN_UNIX}
+}
+
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	l.unlink.Do(func() {
+		_ = os.Remove(l.path)
+	})
+	return err
+}
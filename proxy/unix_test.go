@@ -0,0 +1,73 @@
+// Copyright 2019 The goproxy Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proxy
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+)
+
+//解析八进制文件权限
+func testParseMode(t *testing.T, mode string) uint64 {
+	t.Helper()
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return perm
+}
+
+//设置Mode时套接字文件以指定权限出现在监听地址，临时目录已删除，关闭监听时删除套接字文件
+func TestListenUnixMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix socket permissions are not supported on windows")
+	}
+	dir, err := ioutil.TempDir("", "goproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "l.sock")
+	for _, mode := range []string{"0600", "0660"} {
+		l, err := listenUnix(path, mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Lstat(path)
+		if err != nil {
+			l.Close()
+			t.Fatal(err)
+		}
+		if fi.Mode()&os.ModeSocket == 0 {
+			t.Errorf("mode %s: %v is not a socket", mode, fi.Mode())
+		}
+		if got := fi.Mode().Perm().String(); got != os.FileMode(testParseMode(t, mode)).String() {
+			t.Errorf("mode %s: permission %s", mode, got)
+		}
+		if l.Addr().String() != path {
+			t.Errorf("mode %s: Addr = %s, want %s", mode, l.Addr(), path)
+		}
+		c, err := net.Dial(DOMAIN_UNIX, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Close()
+		if names, _ := ioutil.ReadDir(dir); len(names) != 1 {
+			t.Errorf("mode %s: %d entries in %s, want only the socket", mode, len(names), dir)
+		}
+		l.Close()
+		if _, err := os.Lstat(path); !os.IsNotExist(err) {
+			t.Errorf("mode %s: socket file left after close: %v", mode, err)
+		}
+	}
+	if _, err := listenUnix(path, "9"); err == nil {
+		t.Error("listenUnix accepted a bad mode")
+	}
+}